@@ -0,0 +1,376 @@
+package hypatia
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HeaderTimestamp = "X-Hypatia-Timestamp"
+	HeaderSignature = "X-Hypatia-Signature"
+	HeaderNonce     = "X-Hypatia-Nonce"
+	// HeaderSignedPath is the path a request was signed for, set when hypatia rewrites the path to route it.
+	HeaderSignedPath = "X-Hypatia-Signed-Path"
+
+	defaultHMACMaxSkew = 5 * time.Minute
+)
+
+// Authenticator decides whether a request may change server state. Errors should be an *AuthError so the server can
+// pick between 401 and 403.
+type Authenticator interface {
+	Authenticate(req *http.Request) error
+}
+
+type AuthError struct {
+	Status int
+	Reason string
+}
+
+func (e *AuthError) Error() string {
+	return e.Reason
+}
+
+func unauthorized(format string, args ...any) error {
+	return &AuthError{Status: http.StatusUnauthorized, Reason: fmt.Sprintf(format, args...)}
+}
+
+func forbidden(format string, args ...any) error {
+	return &AuthError{Status: http.StatusForbidden, Reason: fmt.Sprintf(format, args...)}
+}
+
+// AllOf passes only if every authenticator passes, e.g. a CIDR allowlist plus a credential.
+type AllOf []Authenticator
+
+func (a AllOf) Authenticate(req *http.Request) error {
+	for _, auth := range a {
+		if err := auth.Authenticate(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AnyOf passes if any authenticator passes, e.g. either a bearer token or an hmac signature.
+type AnyOf []Authenticator
+
+func (a AnyOf) Authenticate(req *http.Request) error {
+	err := unauthorized("no credentials accepted")
+	for _, auth := range a {
+		if err = auth.Authenticate(req); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// TokenAuth accepts `Authorization: Bearer <token>` for any of its tokens.
+type TokenAuth struct {
+	Tokens []string
+}
+
+// LoadTokens reads one token per line from a file, skipping blank lines and # comments.
+func LoadTokens(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			tokens = append(tokens, line)
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("no tokens found in " + path)
+	}
+	return tokens, nil
+}
+
+func (t *TokenAuth) Authenticate(req *http.Request) error {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return unauthorized("missing bearer token")
+	}
+	for _, candidate := range t.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(candidate)) == 1 {
+			return nil
+		}
+	}
+	return unauthorized("invalid bearer token")
+}
+
+// HMACAuth accepts requests signed with SignRequest. The signature covers the method, host, path, query, timestamp, a
+// nonce and the body. The path is the one the client sent, so it still verifies after hypatia forwards the request
+// through /task/{arn}/... or /any/...; the server only keeps that path if it leads to this task. A request that wasn't
+// forwarded has to be addressed to this server: a host that's an ip has to be the address the request arrived on, and
+// localhost has to arrive on loopback. Each nonce is accepted once within MaxSkew for each path it's served on, so a
+// request can pass through a proxy and still be authenticated where it lands.
+type HMACAuth struct {
+	Secret  []byte
+	MaxSkew time.Duration
+	m       sync.Mutex
+	seen    map[string]struct{}
+	// expiring is every key in seen, in the order they can be forgotten
+	expiring []seenNonce
+}
+
+type seenNonce struct {
+	key     string
+	expires time.Time
+}
+
+// SignRequest sets the timestamp, nonce and signature headers for HMACAuth. The body is read and replaced.
+func SignRequest(req *http.Request, secret []byte) error {
+	body, err := readBody(req)
+	if err != nil {
+		return err
+	}
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	timestamp, nonce := strconv.FormatInt(time.Now().Unix(), 10), hex.EncodeToString(random)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Del(HeaderSignedPath)
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	req.Header.Set(HeaderSignature, signature(secret, req.Method, host, req.URL.Path, req.URL.RawQuery, timestamp, nonce, body))
+	return nil
+}
+
+func signature(secret []byte, method, host, path, query, timestamp, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{method, host, path, query, timestamp, nonce, hex.EncodeToString(sum[:])}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (h *HMACAuth) Authenticate(req *http.Request) error {
+	timestamp, nonce, sig := req.Header.Get(HeaderTimestamp), req.Header.Get(HeaderNonce), req.Header.Get(HeaderSignature)
+	if timestamp == "" || nonce == "" || sig == "" {
+		return unauthorized("missing request signature")
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return unauthorized("invalid %s header", HeaderTimestamp)
+	}
+	skew := h.MaxSkew
+	if skew == 0 {
+		skew = defaultHMACMaxSkew
+	}
+	signedAt := time.Unix(unix, 0)
+	if d := time.Since(signedAt); d > skew || d < -skew {
+		return unauthorized("request signature expired")
+	}
+	body, err := readBody(req)
+	if err != nil {
+		return unauthorized("unable to read body: %s", err)
+	}
+	path := req.Header.Get(HeaderSignedPath)
+	if path == "" {
+		if !addressedHere(req) {
+			return unauthorized("request signed for another host")
+		}
+		path = req.URL.Path
+	}
+	if !hmac.Equal([]byte(sig), []byte(signature(h.Secret, req.Method, req.Host, path, req.URL.RawQuery, timestamp, nonce, body))) {
+		return unauthorized("invalid request signature")
+	}
+	// a nonce is only good while its timestamp is, at most twice the skew from now
+	if h.replayed(nonce+" "+req.URL.Path, time.Now(), 2*skew) {
+		return unauthorized("request nonce already used")
+	}
+	return nil
+}
+
+// replayed records a key until keep has passed, reporting whether it was already recorded. Keys are forgotten in the
+// order they were recorded, so checking doesn't scan every key.
+func (h *HMACAuth) replayed(key string, now time.Time, keep time.Duration) bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.seen == nil {
+		h.seen = make(map[string]struct{})
+	}
+	expired := 0
+	for expired < len(h.expiring) && now.After(h.expiring[expired].expires) {
+		delete(h.seen, h.expiring[expired].key)
+		expired++
+	}
+	h.expiring = h.expiring[expired:]
+	if _, ok := h.seen[key]; ok {
+		return true
+	}
+	h.seen[key] = struct{}{}
+	h.expiring = append(h.expiring, seenNonce{key: key, expires: now.Add(keep)})
+	return false
+}
+
+// addressedHere reports whether the host a request was sent to is this server. Names other than localhost can't be
+// checked, so they pass.
+func addressedHere(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+	local, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return true
+	}
+	localHost, _, err := net.SplitHostPort(local.String())
+	if err != nil {
+		return true
+	}
+	localIP := net.ParseIP(localHost)
+	if strings.EqualFold(host, "localhost") {
+		return localIP != nil && localIP.IsLoopback()
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip == nil || ip.Equal(localIP)
+}
+
+// CIDRAuth only accepts requests from addresses inside one of its networks.
+type CIDRAuth struct {
+	Allowed []*net.IPNet
+}
+
+// ParseCIDRs parses a comma separated list of networks.
+func ParseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (c *CIDRAuth) Authenticate(req *http.Request) error {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return forbidden("unable to parse remote address %q", req.RemoteAddr)
+	}
+	for _, n := range c.Allowed {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+	return forbidden("address %s not allowed", ip)
+}
+
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, err
+}
+
+// keepSignedPath records the path a request was sent to before it's rewritten, so its signature can still be checked.
+// A path that was already rewritten keeps the first one.
+func keepSignedPath(req *http.Request) {
+	if req.Header.Get(HeaderSignedPath) == "" {
+		req.Header.Set(HeaderSignedPath, req.URL.Path)
+	}
+}
+
+// checkSignedPath drops a signed path that doesn't lead to this request, so it can't be used to replay a request
+// signed for another task or endpoint. The path has to be this request's path behind /any or a /task naming this task.
+func (hs *Server) checkSignedPath(req *http.Request) {
+	signed := req.Header.Get(HeaderSignedPath)
+	if signed == "" {
+		return
+	}
+	rest := ""
+	if ref, r := splitTaskPath(signed); ref != "" {
+		if self, err := hs.isSelf(ref); err == nil && self {
+			rest = r
+		}
+	} else if p, ok := strings.CutPrefix(signed, "/any"); ok && (p == "" || p[0] == '/') {
+		rest = "/" + strings.TrimPrefix(p, "/")
+	}
+	if rest != req.URL.Path {
+		req.Header.Del(HeaderSignedPath)
+	}
+}
+
+// authorizeWrite checks a mutating request against Writeable and Auth, writing the error response if it's rejected.
+func (hs *Server) authorizeWrite(res http.ResponseWriter, req *http.Request) bool {
+	if status, err := hs.checkWrite(req); err != nil {
+		handleError(res, status, err)
+		return false
+	}
+	return true
+}
+
+// authenticate checks a request against Auth, writing the error response if it's rejected. Proxied writes only need
+// this; whether the neighbor is writeable is up to the neighbor.
+func (hs *Server) authenticate(res http.ResponseWriter, req *http.Request) bool {
+	if status, err := hs.checkAuth(req); err != nil {
+		handleError(res, status, err)
+		return false
+	}
+	return true
+}
+
+// checkWrite is authorizeWrite for callers with their own error format. It returns the status to reject with.
+func (hs *Server) checkWrite(req *http.Request) (int, error) {
+	if !hs.Writeable {
+		log.Println("not authorized for writes")
+		return http.StatusForbidden, errors.New("server is read only")
+	}
+	return hs.checkAuth(req)
+}
+
+func (hs *Server) checkAuth(req *http.Request) (int, error) {
+	if hs.Auth == nil {
+		return 0, nil
+	}
+	err := hs.Auth.Authenticate(req)
+	if err == nil {
+		return 0, nil
+	}
+	log.Println("rejected write: ", err)
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		return authErr.Status, err
+	}
+	return http.StatusUnauthorized, err
+}
+
+func isWrite(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,242 @@
+package hypatia
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenAuth(t *testing.T) {
+	auth := &TokenAuth{Tokens: []string{"potat"}}
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	if err := auth.Authenticate(req); err == nil {
+		t.Error("expected missing token to fail")
+	}
+	req.Header.Set("Authorization", "Bearer tomat")
+	if err := auth.Authenticate(req); err == nil {
+		t.Error("expected wrong token to fail")
+	}
+	req.Header.Set("Authorization", "Bearer potat")
+	if err := auth.Authenticate(req); err != nil {
+		t.Error("expected token to pass: ", err)
+	}
+}
+
+func TestHMACAuth(t *testing.T) {
+	secret := []byte("secret")
+	auth := &HMACAuth{Secret: secret}
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"setLocalHealth":true}`))
+	if err := SignRequest(req, secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.Authenticate(req); err != nil {
+		t.Fatal("expected signed request to pass: ", err)
+	}
+	if err := auth.Authenticate(req); err == nil {
+		t.Error("expected replayed request to fail")
+	}
+
+	tampered := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"setLocalHealth":false}`))
+	SignRequest(tampered, secret)
+	tampered.Body = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"setLocalHealth":true}`)).Body
+	if err := auth.Authenticate(tampered); err == nil {
+		t.Error("expected tampered body to fail")
+	}
+
+	stale := httptest.NewRequest(http.MethodPost, "/", nil)
+	SignRequest(stale, secret)
+	stale.Header.Set(HeaderTimestamp, "1")
+	if err := auth.Authenticate(stale); err == nil {
+		t.Error("expected stale timestamp to fail")
+	}
+
+	for i := 0; i < 2; i++ {
+		same := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"setLocalHealth":true}`))
+		SignRequest(same, secret)
+		if err := auth.Authenticate(same); err != nil {
+			t.Errorf("expected the same write signed twice to pass, got %v", err)
+		}
+	}
+
+	for _, target := range []string{"/stress", "/?task=other"} {
+		moved := httptest.NewRequest(http.MethodPost, "/", nil)
+		SignRequest(moved, secret)
+		u, _ := url.Parse(target)
+		moved.URL.Path, moved.URL.RawQuery = u.Path, u.RawQuery
+		if err := auth.Authenticate(moved); err == nil {
+			t.Errorf("expected a request signed for / to fail at %s", target)
+		}
+	}
+
+	rehosted := httptest.NewRequest(http.MethodPost, "http://10.0.0.1:8080/", nil)
+	SignRequest(rehosted, secret)
+	rehosted.Host = "10.0.0.2:8080"
+	if err := auth.Authenticate(rehosted); err == nil {
+		t.Error("expected a request signed for another host to fail")
+	}
+}
+
+func TestHMACAuthHost(t *testing.T) {
+	secret := []byte("secret")
+	auth := &HMACAuth{Secret: secret}
+	for _, tc := range []struct {
+		host, local string
+		ok          bool
+	}{
+		{"10.0.0.1:8080", "10.0.0.1:8080", true},
+		{"10.0.0.1:8080", "10.0.0.2:8080", false},
+		{"[::1]:8080", "[::1]:8080", true},
+		{"localhost:8080", "127.0.0.1:8080", true},
+		{"localhost:8080", "10.0.0.2:8080", false},
+		{"hypatia.internal:8080", "10.0.0.2:8080", true},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "http://"+tc.host+"/", nil)
+		local, _ := net.ResolveTCPAddr("tcp", tc.local)
+		req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, local))
+		SignRequest(req, secret)
+		if err := auth.Authenticate(req); (err == nil) != tc.ok {
+			t.Errorf("%s arriving on %s: expected ok %t, got %v", tc.host, tc.local, tc.ok, err)
+		}
+	}
+}
+
+func TestHMACAuthForgets(t *testing.T) {
+	auth := &HMACAuth{}
+	now := time.Now()
+	if auth.replayed("a", now, time.Minute) || !auth.replayed("a", now, time.Minute) {
+		t.Error("expected a key to be replayed the second time")
+	}
+	auth.replayed("b", now.Add(30*time.Second), time.Minute)
+	if auth.replayed("a", now.Add(2*time.Minute), time.Minute) {
+		t.Error("expected a key to be forgotten once it expires")
+	}
+	if len(auth.seen) != 1 || len(auth.expiring) != 1 {
+		t.Errorf("expected only the new key to be kept, got %v", auth.seen)
+	}
+}
+
+func TestHMACAuthProxied(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	secret := []byte("secret")
+	newServer := func(arn string, sd ServiceDiscoveryIface) *Server {
+		srv := newV1TestServer(t)
+		srv.Metadata = staticMetadata(arn)
+		srv.ServiceDiscovery = sd
+		srv.Auth = &HMACAuth{Secret: secret}
+		return srv
+	}
+	var captured *http.Request
+	neighbor := newServer(testNeighborArn, nil)
+	upstream := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		captured = req.Clone(req.Context())
+		body, _ := readBody(req)
+		captured.Body = io.NopCloser(bytes.NewReader(body))
+		neighbor.ServeHTTP(res, req)
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	srv := newServer(testSelfArn, &staticDiscovery{tasks: map[string]*url.URL{testNeighborArn: u}})
+
+	post := func(srv *Server, req *http.Request) int {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	signed := func(path string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"setLocalHealth":true}`))
+		SignRequest(req, secret)
+		return req
+	}
+	if code := post(srv, signed("/task/"+testNeighborArn+"/")); code != http.StatusOK {
+		t.Fatalf("expected a signed write to pass through the proxy, got %d", code)
+	}
+	if code := post(srv, signed("/task/self/")); code != http.StatusOK {
+		t.Errorf("expected a signed write addressed to this task to pass, got %d", code)
+	}
+
+	replay := func() *http.Request {
+		req := captured.Clone(captured.Context())
+		body, _ := readBody(captured)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.RequestURI = ""
+		return req
+	}
+	if code := post(neighbor, replay()); code != http.StatusUnauthorized {
+		t.Errorf("expected a replayed forwarded write to fail, got %d", code)
+	}
+	other := newServer("arn:aws:ecs:us-west-2:012:task/default/beef", nil)
+	if code := post(other, replay()); code != http.StatusUnauthorized {
+		t.Errorf("expected a write signed for another task to fail, got %d", code)
+	}
+}
+
+func TestCIDRAuth(t *testing.T) {
+	nets, err := ParseCIDRs("10.0.0.0/8, 192.168.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &CIDRAuth{Allowed: nets}
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	for addr, allowed := range map[string]bool{"10.1.2.3:80": true, "192.168.1.9:80": true, "192.168.2.9:80": false} {
+		req.RemoteAddr = addr
+		err := auth.Authenticate(req)
+		if (err == nil) != allowed {
+			t.Errorf("%s: expected allowed=%v, got %v", addr, allowed, err)
+		}
+		if authErr, ok := err.(*AuthError); err != nil && (!ok || authErr.Status != http.StatusForbidden) {
+			t.Errorf("%s: expected 403, got %v", addr, err)
+		}
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	var forwarded string
+	upstream := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		forwarded = req.Header.Get("Authorization")
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	srv := newProxyTestServer(&staticDiscovery{tasks: map[string]*url.URL{testNeighborArn: u}})
+	srv.LocalHealth = FileHealthcheck{Filepath: filepath.Join(t.TempDir(), "local")}
+	srv.Writeable = true
+	srv.Auth = &TokenAuth{Tokens: []string{"potat"}}
+
+	post := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"setLocalHealth":true}`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post("/", "")
+	var output RequestResponse
+	if rec.Code != http.StatusUnauthorized || json.Unmarshal(rec.Body.Bytes(), &output) != nil || len(output.Errors) != 1 {
+		t.Errorf("expected 401 with an error body, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := post("/", "potat"); rec.Code != http.StatusOK {
+		t.Errorf("expected authorized write, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := post("/task/"+testNeighborArn, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected proxied write to be checked, got %d", rec.Code)
+	}
+	if rec := post("/task/"+testNeighborArn, "potat"); rec.Code != http.StatusOK || forwarded != "Bearer potat" {
+		t.Errorf("expected credentials to be forwarded, got %d %q", rec.Code, forwarded)
+	}
+
+	srv.Writeable = false
+	if rec := post("/", "potat"); rec.Code != http.StatusForbidden {
+		t.Errorf("expected read only server to refuse, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,221 @@
+package hypatia
+
+import (
+	"errors"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BalanceRoundRobin       = "round-robin"
+	BalanceRandom           = "random"
+	BalanceLeastOutstanding = "least-outstanding"
+	BalanceHash             = "hash"
+
+	defaultBalancerHealthTTL = 5 * time.Second
+)
+
+var errNoHealthyTargets = errors.New("no healthy tasks in service")
+
+// Balancer picks a task from the service map for requests to /any. Tasks whose /ping fails are skipped until they
+// recover. The zero value balances round-robin.
+type Balancer struct {
+	// Strategy is one of the Balance* constants.
+	Strategy string
+	// HashHeader is the request header hashed by BalanceHash. Requests without it fall back to round-robin.
+	HashHeader string
+	// HealthTTL is how long a /ping result is trusted before the task is probed again.
+	HealthTTL time.Duration
+	// Client probes /ping on each task.
+	Client  *http.Client
+	m       sync.Mutex
+	next    int
+	targets map[string]*balancerTarget
+}
+
+type BalancerStats struct {
+	Address     string `json:"address"`
+	Requests    int64  `json:"requests"`
+	Failures    int64  `json:"failures"`
+	Outstanding int64  `json:"outstanding"`
+	Healthy     bool   `json:"healthy"`
+}
+
+type balancerTarget struct {
+	BalancerStats
+	url      *url.URL
+	checked  time.Time
+	checking bool
+}
+
+func ValidBalanceStrategy(s string) bool {
+	switch s {
+	case "", BalanceRoundRobin, BalanceRandom, BalanceLeastOutstanding, BalanceHash:
+		return true
+	}
+	return false
+}
+
+// Pick chooses a healthy task and counts a request against it. Callers must pair it with Done.
+func (b *Balancer) Pick(services *ServiceMap, req *http.Request) (string, *url.URL, error) {
+	b.refresh(services)
+
+	b.m.Lock()
+	defer b.m.Unlock()
+	var healthy []string
+	for taskArn := range services.Tasks {
+		if t := b.targets[taskArn]; t != nil && t.Healthy {
+			healthy = append(healthy, taskArn)
+		}
+	}
+	if len(healthy) == 0 {
+		return "", nil, errNoHealthyTargets
+	}
+	sort.Strings(healthy)
+
+	var chosen string
+	key := ""
+	if b.HashHeader != "" {
+		key = req.Header.Get(b.HashHeader)
+	}
+	switch {
+	case b.Strategy == BalanceRandom:
+		chosen = healthy[rand.Intn(len(healthy))]
+	case b.Strategy == BalanceLeastOutstanding:
+		chosen = healthy[0]
+		for _, taskArn := range healthy[1:] {
+			if b.targets[taskArn].Outstanding < b.targets[chosen].Outstanding {
+				chosen = taskArn
+			}
+		}
+	case b.Strategy == BalanceHash && key != "":
+		// rendezvous hashing keeps most keys in place when tasks come and go
+		var best uint64
+		for _, taskArn := range healthy {
+			h := fnv.New64a()
+			h.Write([]byte(key))
+			h.Write([]byte(taskArn))
+			if score := h.Sum64(); chosen == "" || score > best {
+				chosen, best = taskArn, score
+			}
+		}
+	default:
+		chosen = healthy[b.next%len(healthy)]
+		b.next++
+	}
+	t := b.targets[chosen]
+	t.Requests++
+	t.Outstanding++
+	return chosen, t.url, nil
+}
+
+// Done records the outcome of a request started by Pick, given the task and url Pick returned. A failed request marks
+// the task unhealthy until its next successful probe. A task whose url has changed since is left alone, since the
+// request wasn't counted against it.
+func (b *Balancer) Done(taskArn string, u *url.URL, err error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	t, ok := b.targets[taskArn]
+	if !ok || t.url != u || t.Outstanding <= 0 {
+		return
+	}
+	t.Outstanding--
+	if err != nil {
+		t.Failures++
+		t.Healthy = false
+		t.checked = time.Now()
+	}
+}
+
+// Stats returns the per-task distribution counters, keyed by task arn.
+func (b *Balancer) Stats() map[string]BalancerStats {
+	b.m.Lock()
+	defer b.m.Unlock()
+	stats := make(map[string]BalancerStats, len(b.targets))
+	for taskArn, t := range b.targets {
+		stats[taskArn] = t.BalancerStats
+	}
+	return stats
+}
+
+// refresh syncs targets with the service map. New tasks are probed before they can be picked; stale results are
+// re-probed in the background, and tasks that have left the service are forgotten.
+func (b *Balancer) refresh(services *ServiceMap) {
+	ttl := b.HealthTTL
+	if ttl == 0 {
+		ttl = defaultBalancerHealthTTL
+	}
+	var wait sync.WaitGroup
+	b.m.Lock()
+	if b.targets == nil {
+		b.targets = make(map[string]*balancerTarget)
+	}
+	for taskArn := range b.targets {
+		if _, ok := services.Tasks[taskArn]; !ok {
+			delete(b.targets, taskArn)
+		}
+	}
+	for taskArn, u := range services.Tasks {
+		t, ok := b.targets[taskArn]
+		if !ok || t.url.String() != u.String() {
+			t = &balancerTarget{url: u, BalancerStats: BalancerStats{Address: u.Host}}
+			b.targets[taskArn] = t
+		}
+		if t.checking || time.Since(t.checked) < ttl {
+			continue
+		}
+		t.checking = true
+		if t.checked.IsZero() {
+			wait.Add(1)
+			go func(taskArn string, u *url.URL) {
+				defer wait.Done()
+				b.probe(taskArn, u)
+			}(taskArn, t.url)
+		} else {
+			go b.probe(taskArn, t.url)
+		}
+	}
+	b.m.Unlock()
+	wait.Wait()
+}
+
+func (b *Balancer) probe(taskArn string, u *url.URL) {
+	client := b.Client
+	if client == nil {
+		client = &http.Client{Timeout: 2 * time.Second}
+	}
+	err := ping(client, u)
+	if err != nil {
+		log.Println("balancer target unhealthy: ", taskArn, err)
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	if t, ok := b.targets[taskArn]; ok && t.url == u {
+		t.Healthy = err == nil
+		t.checked = time.Now()
+		t.checking = false
+	}
+}
+
+func ping(client *http.Client, u *url.URL) error {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(u.String(), "/")+"/ping", nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.New("ping returned " + res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package hypatia
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func newBalancerUpstreams(t *testing.T, healthy ...bool) map[string]*url.URL {
+	tasks := make(map[string]*url.URL)
+	for i, h := range healthy {
+		h := h
+		upstream := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/ping" && !h {
+				res.WriteHeader(http.StatusInternalServerError)
+			}
+		}))
+		t.Cleanup(upstream.Close)
+		u, _ := url.Parse(upstream.URL)
+		tasks["arn:aws:ecs:us-west-2:012:task/default/"+string(rune('a'+i))] = u
+	}
+	return tasks
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	tasks := newBalancerUpstreams(t, true, false, true)
+	srv := newProxyTestServer(&staticDiscovery{tasks: tasks})
+	for i := 0; i < 10; i++ {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/any/stats", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+	stats := srv.Balancer.Stats()
+	if stats["arn:aws:ecs:us-west-2:012:task/default/a"].Requests != 5 ||
+		stats["arn:aws:ecs:us-west-2:012:task/default/c"].Requests != 5 {
+		t.Errorf("expected requests split between healthy tasks: %v", stats)
+	}
+	if s := stats["arn:aws:ecs:us-west-2:012:task/default/b"]; s.Requests != 0 || s.Healthy {
+		t.Errorf("expected unhealthy task to be skipped: %v", s)
+	}
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/balancer", nil))
+	var served map[string]BalancerStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil || len(served) != 3 {
+		t.Errorf("expected stats for every task, got %s", rec.Body.String())
+	}
+}
+
+func TestBalancerHash(t *testing.T) {
+	tasks := newBalancerUpstreams(t, true, true, true)
+	b := &Balancer{Strategy: BalanceHash, HashHeader: "X-User"}
+	services := &ServiceMap{Tasks: tasks}
+	req := httptest.NewRequest(http.MethodGet, "/any", nil)
+	req.Header.Set("X-User", "potat")
+	first, u, err := b.Pick(services, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Done(first, u, nil)
+	for i := 0; i < 5; i++ {
+		next, u, _ := b.Pick(services, req)
+		b.Done(next, u, nil)
+		if next != first {
+			t.Errorf("expected the same key to stick to %s, got %s", first, next)
+		}
+	}
+}
+
+func TestBalancerNoHealthyTasks(t *testing.T) {
+	srv := newProxyTestServer(&staticDiscovery{tasks: newBalancerUpstreams(t, false)})
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/any", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", rec.Code)
+	}
+}
+
+func TestBalancerForgetsDepartedTasks(t *testing.T) {
+	tasks := newBalancerUpstreams(t, true, true)
+	b := &Balancer{}
+	req := httptest.NewRequest(http.MethodGet, "/any", nil)
+	picked, u, err := b.Pick(&ServiceMap{Tasks: tasks}, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Done(picked, u, nil)
+	delete(tasks, picked)
+	if _, _, err := b.Pick(&ServiceMap{Tasks: tasks}, req); err != nil {
+		t.Fatal(err)
+	}
+	if stats := b.Stats(); len(stats) != 1 {
+		t.Errorf("expected only the remaining task, got %v", stats)
+	} else if _, ok := stats[picked]; ok {
+		t.Errorf("expected %s to be forgotten, got %v", picked, stats)
+	}
+}
+
+func TestBalancerDoneAfterMove(t *testing.T) {
+	tasks := newBalancerUpstreams(t, true)
+	b := &Balancer{}
+	req := httptest.NewRequest(http.MethodGet, "/any", nil)
+	taskArn, before, err := b.Pick(&ServiceMap{Tasks: tasks}, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks[taskArn] = newBalancerUpstreams(t, true)["arn:aws:ecs:us-west-2:012:task/default/a"]
+	_, after, err := b.Pick(&ServiceMap{Tasks: tasks}, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Done(taskArn, before, errors.New("boom"))
+	if s := b.Stats()[taskArn]; s.Outstanding != 1 || s.Failures != 0 {
+		t.Errorf("expected a request to the old url not to count against the new one: %+v", s)
+	}
+	b.Done(taskArn, after, nil)
+	b.Done(taskArn, after, nil)
+	if s := b.Stats()[taskArn]; s.Outstanding != 0 {
+		t.Errorf("expected outstanding to stop at zero: %+v", s)
+	}
+}
+
+func TestBalancerAbortedResponse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/ping" {
+			return
+		}
+		res.Header().Set("Content-Length", "100")
+		res.Write([]byte("cut off"))
+		res.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	srv := newProxyTestServer(&staticDiscovery{tasks: map[string]*url.URL{testNeighborArn: u}})
+	// the proxy only aborts when it's served by an http.Server
+	proxy := httptest.NewServer(srv)
+	defer proxy.Close()
+	proxy.Config.ErrorLog = log.New(io.Discard, "", 0)
+	if res, err := http.Get(proxy.URL + "/any/stats"); err == nil {
+		_, err = io.ReadAll(res.Body)
+		res.Body.Close()
+		if err == nil {
+			t.Fatal("expected the response to be cut off")
+		}
+	}
+	if s := srv.Balancer.Stats()[testNeighborArn]; s.Requests != 1 || s.Outstanding != 0 {
+		t.Errorf("expected the aborted request to be done: %+v", s)
+	}
+}
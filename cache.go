@@ -1,42 +1,348 @@
 package hypatia
 
 import (
-	"github.com/aws/smithy-go/container/private/cache"
-	"github.com/aws/smithy-go/container/private/cache/lru"
-	"log"
+	"container/list"
+	"errors"
+	"fmt"
+	"hash/maphash"
 	"sync"
+	"time"
 )
 
-type Cache interface {
-	Get(string) (string, bool)
-	Put(string, string)
+const defaultCacheShards = 16
+
+// ErrMissing is returned by GetOrLoad for a key remembered as having no value.
+var ErrMissing = errors.New("remembered as missing")
+
+type Cache[K comparable, V any] interface {
+	Get(K) (V, bool)
+	Put(K, V)
+	// PutTTL stores a value that expires after ttl instead of the cache's default. Zero never expires.
+	PutTTL(K, V, time.Duration)
+	// PutMissing remembers that a key has no value, so it isn't looked up again until ttl passes.
+	PutMissing(K, time.Duration)
+	// Missing reports whether a key is remembered as having no value. Get reports these keys as misses.
+	Missing(K) bool
+	// Invalidate forgets a key, for when upstream disagrees with what's cached.
+	Invalidate(K)
+	// GetOrLoad returns the cached value, or loads and caches it. Concurrent loads of one key share a single call to
+	// load. Errors aren't cached.
+	GetOrLoad(K, func(K) (V, error)) (V, error)
+	Stats() CacheStats
+}
+
+type CacheStats struct {
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	NegativeHits  uint64 `json:"negativeHits"`
+	Evictions     uint64 `json:"evictions"`
+	Expirations   uint64 `json:"expirations"`
+	Invalidations uint64 `json:"invalidations"`
+	// Loads counts calls to a GetOrLoad loader, and Shared the callers that waited on someone else's.
+	Loads  uint64 `json:"loads"`
+	Shared uint64 `json:"shared"`
+	Size   int    `json:"size"`
+}
+
+func (s *CacheStats) add(o CacheStats) {
+	s.Hits += o.Hits
+	s.Misses += o.Misses
+	s.NegativeHits += o.NegativeHits
+	s.Evictions += o.Evictions
+	s.Expirations += o.Expirations
+	s.Invalidations += o.Invalidations
+	s.Loads += o.Loads
+	s.Shared += o.Shared
+	s.Size += o.Size
+}
+
+type CacheOptions struct {
+	// Size bounds the number of entries, dropping the least recently used. Zero is unbounded.
+	Size int
+	// TTL expires entries put without their own ttl. Zero never expires.
+	TTL time.Duration
+	// Shards splits the cache, each with its own lock and an even share of Size, so concurrent callers rarely wait on
+	// each other. Least recently used is then tracked per shard. Defaults to 16, or Size if that's smaller.
+	Shards int
+}
+
+// NewCache holds up to size entries, dropping the least recently used. Entries never expire unless put with a ttl.
+func NewCache[K comparable, V any](size int) Cache[K, V] {
+	return NewCacheWith[K, V](CacheOptions{Size: size})
+}
+
+// NewTTLCache is NewCache where every Put expires after ttl.
+func NewTTLCache[K comparable, V any](size int, ttl time.Duration) Cache[K, V] {
+	return NewCacheWith[K, V](CacheOptions{Size: size, TTL: ttl})
+}
+
+func NewCacheWith[K comparable, V any](opts CacheOptions) Cache[K, V] {
+	shards := opts.Shards
+	if shards <= 0 {
+		shards = defaultCacheShards
+	}
+	if opts.Size > 0 && opts.Size < shards {
+		shards = opts.Size
+	}
+	c := &lruCache[K, V]{seed: maphash.MakeSeed(), shards: make([]*cacheShard[K, V], shards)}
+	for i := range c.shards {
+		size := 0
+		if opts.Size > 0 {
+			// round up, so the shards together hold at least Size
+			size = (opts.Size + shards - 1) / shards
+		}
+		c.shards[i] = &cacheShard[K, V]{
+			size:    size,
+			ttl:     opts.TTL,
+			entries: make(map[K]*list.Element),
+			mru:     list.New(),
+			loading: make(map[K]*cacheLoad[V]),
+			now:     time.Now,
+		}
+	}
+	return c
+}
+
+type lruCache[K comparable, V any] struct {
+	seed   maphash.Seed
+	shards []*cacheShard[K, V]
 }
 
-func NewCache(size int) Cache {
-	return &lruStringCache{
-		smithy: lru.New(size),
-		m:      &sync.RWMutex{},
+func (c *lruCache[K, V]) shard(k K) *cacheShard[K, V] {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	var h uint64
+	switch key := any(k).(type) {
+	case string:
+		h = maphash.String(c.seed, key)
+	case int:
+		h = uint64(key) * 0x9E3779B97F4A7C15
+	case int64:
+		h = uint64(key) * 0x9E3779B97F4A7C15
+	case uint64:
+		h = key * 0x9E3779B97F4A7C15
+	default:
+		// equal keys print the same, which is all sharding needs
+		h = maphash.String(c.seed, fmt.Sprintf("%#v", k))
 	}
+	return c.shards[h%uint64(len(c.shards))]
+}
+
+func (c *lruCache[K, V]) Get(k K) (V, bool) {
+	return c.shard(k).get(k)
+}
+
+func (c *lruCache[K, V]) Put(k K, v V) {
+	s := c.shard(k)
+	s.put(k, v, false, s.ttl)
+}
+
+func (c *lruCache[K, V]) PutTTL(k K, v V, ttl time.Duration) {
+	c.shard(k).put(k, v, false, ttl)
+}
+
+func (c *lruCache[K, V]) PutMissing(k K, ttl time.Duration) {
+	var zero V
+	c.shard(k).put(k, zero, true, ttl)
+}
+
+func (c *lruCache[K, V]) Missing(k K) bool {
+	return c.shard(k).missing(k)
+}
+
+func (c *lruCache[K, V]) Invalidate(k K) {
+	c.shard(k).invalidate(k)
 }
 
-type lruStringCache struct {
-	smithy cache.Cache
-	m      *sync.RWMutex
+func (c *lruCache[K, V]) GetOrLoad(k K, load func(K) (V, error)) (V, error) {
+	return c.shard(k).getOrLoad(k, load)
 }
 
-func (l *lruStringCache) Get(s string) (string, bool) {
-	l.m.RLock()
-	defer l.m.RUnlock()
-	str, ok := l.smithy.Get(s)
-	if _, converts := str.(string); !converts {
-		log.Println("expected: ", s, "; got ", str)
-		return "", false
+func (c *lruCache[K, V]) Stats() CacheStats {
+	var stats CacheStats
+	for _, s := range c.shards {
+		stats.add(s.stats())
 	}
-	return str.(string), ok
+	return stats
+}
+
+// entries copies every live entry, least recently used first, for DiskCache to compact.
+func (c *lruCache[K, V]) entries() []cacheEntry[K, V] {
+	var out []cacheEntry[K, V]
+	for _, s := range c.shards {
+		s.m.Lock()
+		now := s.now()
+		for e := s.mru.Back(); e != nil; e = e.Prev() {
+			if entry := e.Value.(*cacheEntry[K, V]); entry.expires.IsZero() || now.Before(entry.expires) {
+				out = append(out, *entry)
+			}
+		}
+		s.m.Unlock()
+	}
+	return out
+}
+
+// clear drops every entry, for DiskCache to replay a compacted file from scratch.
+func (c *lruCache[K, V]) clear() {
+	for _, s := range c.shards {
+		s.m.Lock()
+		s.entries = make(map[K]*list.Element)
+		s.mru.Init()
+		s.m.Unlock()
+	}
+}
+
+type cacheShard[K comparable, V any] struct {
+	size    int
+	ttl     time.Duration
+	m       sync.Mutex
+	entries map[K]*list.Element
+	// least recently used is at the back
+	mru     *list.List
+	loading map[K]*cacheLoad[V]
+	counts  CacheStats
+	now     func() time.Time
+}
+
+type cacheEntry[K comparable, V any] struct {
+	key     K
+	value   V
+	missing bool
+	expires time.Time
+}
+
+// cacheLoad is a GetOrLoad in progress, for other callers of the same key to wait on.
+type cacheLoad[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// lookup finds a live entry, dropping it if it has expired. s.m must be held.
+func (s *cacheShard[K, V]) lookup(k K) *cacheEntry[K, V] {
+	e, ok := s.entries[k]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*cacheEntry[K, V])
+	if !entry.expires.IsZero() && !s.now().Before(entry.expires) {
+		s.remove(e)
+		s.counts.Expirations++
+		return nil
+	}
+	s.mru.MoveToFront(e)
+	return entry
+}
+
+func (s *cacheShard[K, V]) remove(e *list.Element) {
+	s.mru.Remove(e)
+	delete(s.entries, e.Value.(*cacheEntry[K, V]).key)
+}
+
+func (s *cacheShard[K, V]) get(k K) (V, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	entry := s.lookup(k)
+	if entry == nil || entry.missing {
+		s.counts.Misses++
+		var zero V
+		return zero, false
+	}
+	s.counts.Hits++
+	return entry.value, true
+}
+
+func (s *cacheShard[K, V]) put(k K, v V, missing bool, ttl time.Duration) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.putLocked(k, v, missing, ttl)
+}
+
+func (s *cacheShard[K, V]) putLocked(k K, v V, missing bool, ttl time.Duration) {
+	entry := &cacheEntry[K, V]{key: k, value: v, missing: missing}
+	if ttl > 0 {
+		entry.expires = s.now().Add(ttl)
+	}
+	if e, ok := s.entries[k]; ok {
+		e.Value = entry
+		s.mru.MoveToFront(e)
+		return
+	}
+	s.entries[k] = s.mru.PushFront(entry)
+	if s.size > 0 && s.mru.Len() > s.size {
+		s.remove(s.mru.Back())
+		s.counts.Evictions++
+	}
+}
+
+func (s *cacheShard[K, V]) missing(k K) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if entry := s.lookup(k); entry != nil && entry.missing {
+		s.counts.NegativeHits++
+		return true
+	}
+	return false
+}
+
+func (s *cacheShard[K, V]) invalidate(k K) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if e, ok := s.entries[k]; ok {
+		s.remove(e)
+		s.counts.Invalidations++
+	}
+}
+
+func (s *cacheShard[K, V]) getOrLoad(k K, load func(K) (V, error)) (V, error) {
+	s.m.Lock()
+	if entry := s.lookup(k); entry != nil {
+		if entry.missing {
+			s.counts.NegativeHits++
+			s.m.Unlock()
+			var zero V
+			return zero, ErrMissing
+		}
+		s.counts.Hits++
+		s.m.Unlock()
+		return entry.value, nil
+	}
+	s.counts.Misses++
+	if l, ok := s.loading[k]; ok {
+		s.counts.Shared++
+		s.m.Unlock()
+		<-l.done
+		return l.value, l.err
+	}
+	l := &cacheLoad[V]{done: make(chan struct{})}
+	s.loading[k] = l
+	s.counts.Loads++
+	s.m.Unlock()
+
+	loaded := false
+	defer func() {
+		// a panicking loader still releases its waiters
+		if !loaded {
+			l.err = errors.New("cache load panicked")
+		}
+		s.m.Lock()
+		delete(s.loading, k)
+		if l.err == nil {
+			s.putLocked(k, l.value, false, s.ttl)
+		}
+		s.m.Unlock()
+		close(l.done)
+	}()
+	l.value, l.err = load(k)
+	loaded = true
+	return l.value, l.err
 }
 
-func (l *lruStringCache) Put(k string, v string) {
-	l.m.Lock()
-	defer l.m.Unlock()
-	l.smithy.Put(k, v)
+func (s *cacheShard[K, V]) stats() CacheStats {
+	s.m.Lock()
+	defer s.m.Unlock()
+	stats := s.counts
+	stats.Size = s.mru.Len()
+	return stats
 }
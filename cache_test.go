@@ -1,13 +1,17 @@
 package hypatia
 
 import (
+	"errors"
+	"github.com/aws/smithy-go/container/private/cache/lru"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestCache(t *testing.T) {
-	c := NewCache(10)
+	c := NewCache[string, string](10)
 	c.Put("potat", "tomat")
 	x, ok := c.Get("potat")
 	if !ok {
@@ -21,7 +25,7 @@ func TestCache(t *testing.T) {
 func TestCacheRace(t *testing.T) {
 	var wait sync.WaitGroup
 	wait.Add(10)
-	cache := NewCache(100)
+	cache := NewCache[string, string](100)
 	cache.Put("foo", "init")
 	for i := 0; i < 10; i++ {
 		go func() {
@@ -39,3 +43,194 @@ func TestCacheRace(t *testing.T) {
 	t.Log("done")
 
 }
+
+func TestCacheTTL(t *testing.T) {
+	now := time.Now()
+	c := NewCacheWith[string, string](CacheOptions{Size: 10, TTL: time.Minute, Shards: 1})
+	c.(*lruCache[string, string]).shards[0].now = func() time.Time { return now }
+	c.Put("potat", "tomat")
+	c.PutTTL("forever", "ever", 0)
+	c.PutMissing("nope", time.Second)
+	if _, ok := c.Get("nope"); ok || !c.Missing("nope") {
+		t.Error("expected a negative entry to miss")
+	}
+	now = now.Add(2 * time.Second)
+	if c.Missing("nope") {
+		t.Error("expected the negative entry to expire")
+	}
+	now = now.Add(time.Minute)
+	if _, ok := c.Get("potat"); ok {
+		t.Error("expected the entry to expire")
+	}
+	if v, ok := c.Get("forever"); !ok || v != "ever" {
+		t.Error("expected a zero ttl to never expire")
+	}
+	c.Invalidate("forever")
+	if _, ok := c.Get("forever"); ok {
+		t.Error("expected an invalidated entry to be gone")
+	}
+	want := CacheStats{Hits: 1, Misses: 3, NegativeHits: 1, Expirations: 2, Invalidations: 1}
+	if stats := c.Stats(); stats != want {
+		t.Errorf("expected %+v, got %+v", want, stats)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := NewCacheWith[string, string](CacheOptions{Size: 2, Shards: 1})
+	c.Put("a", "1")
+	c.Put("b", "2")
+	c.Put("a", "3")
+	c.Get("a")
+	c.Put("c", "4")
+	if _, ok := c.Get("b"); ok {
+		t.Error("expected the least recently used entry to be evicted")
+	}
+	if v, ok := c.Get("a"); !ok || v != "3" {
+		t.Errorf("expected a replaced entry to survive, got %q", v)
+	}
+	if stats := c.Stats(); stats.Evictions != 1 || stats.Size != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCacheShards(t *testing.T) {
+	c := NewCacheWith[int, int](CacheOptions{Size: 64, Shards: 4})
+	for i := 0; i < 1000; i++ {
+		c.Put(i, i*2)
+	}
+	if stats := c.Stats(); stats.Size != 64 || stats.Evictions != 1000-64 {
+		t.Errorf("expected the shards to hold the size between them: %+v", stats)
+	}
+	if v, ok := c.Get(999); !ok || v != 1998 {
+		t.Errorf("expected the newest entry to survive, got %d", v)
+	}
+
+	type key struct {
+		cluster string
+		id      int
+	}
+	k := NewCache[key, string](0)
+	k.Put(key{"default", 1}, "one")
+	if v, _ := k.Get(key{"default", 1}); v != "one" {
+		t.Error("expected struct keys to find their shard")
+	}
+}
+
+func TestCacheGetOrLoad(t *testing.T) {
+	c := NewCache[string, int](10)
+	var loads atomic.Int32
+	release := make(chan struct{})
+	load := func(string) (int, error) {
+		loads.Add(1)
+		<-release
+		return 42, nil
+	}
+	var wait sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if v, err := c.GetOrLoad("answer", load); v != 42 || err != nil {
+				t.Errorf("expected the loaded value, got %d %v", v, err)
+			}
+		}()
+	}
+	for c.Stats().Loads+c.Stats().Shared < 10 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wait.Wait()
+	if loads.Load() != 1 {
+		t.Errorf("expected one load, got %d", loads.Load())
+	}
+	if v, ok := c.Get("answer"); !ok || v != 42 {
+		t.Error("expected the loaded value to be cached")
+	}
+
+	failed := errors.New("nope")
+	if _, err := c.GetOrLoad("broken", func(string) (int, error) { return 0, failed }); err != failed {
+		t.Errorf("expected the load error, got %v", err)
+	}
+	if _, ok := c.Get("broken"); ok {
+		t.Error("expected errors not to be cached")
+	}
+	c.PutMissing("gone", time.Minute)
+	if _, err := c.GetOrLoad("gone", load); !errors.Is(err, ErrMissing) {
+		t.Errorf("expected a missing key to skip loading, got %v", err)
+	}
+}
+
+// smithyCache is how the cache used to work, wrapping smithy's lru, for comparison. smithy's Get reorders the list,
+// so this takes the write lock where the original took a read lock and raced.
+type smithyCache struct {
+	m   sync.Mutex
+	lru interface {
+		Get(any) (any, bool)
+		Put(any, any)
+	}
+}
+
+func (s *smithyCache) Get(k string) (string, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	v, ok := s.lru.Get(k)
+	str, _ := v.(string)
+	return str, ok
+}
+
+func (s *smithyCache) Put(k, v string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.lru.Put(k, v)
+}
+
+type benchCache interface {
+	Get(string) (string, bool)
+	Put(string, string)
+}
+
+func benchmarkCaches(b *testing.B, run func(*testing.B, benchCache)) {
+	b.Run("smithy", func(b *testing.B) { run(b, &smithyCache{lru: lru.New(512)}) })
+	b.Run("unsharded", func(b *testing.B) { run(b, NewCacheWith[string, string](CacheOptions{Size: 512, Shards: 1})) })
+	b.Run("sharded", func(b *testing.B) { run(b, NewCache[string, string](512)) })
+}
+
+func benchKeys() []string {
+	keys := make([]string, 256)
+	for i := range keys {
+		keys[i] = "arn:aws:ecs:us-west-2:0123456789:container-instance/" + strconv.Itoa(i)
+	}
+	return keys
+}
+
+func BenchmarkCacheGet(b *testing.B) {
+	keys := benchKeys()
+	benchmarkCaches(b, func(b *testing.B, c benchCache) {
+		for _, k := range keys {
+			c.Put(k, k)
+		}
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				c.Get(keys[i%len(keys)])
+			}
+		})
+	})
+}
+
+func BenchmarkCacheMixed(b *testing.B) {
+	keys := benchKeys()
+	benchmarkCaches(b, func(b *testing.B, c benchCache) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				k := keys[i%len(keys)]
+				// mostly reads, with the odd refresh, like service discovery
+				if i%10 == 0 {
+					c.Put(k, k)
+				} else {
+					c.Get(k)
+				}
+			}
+		})
+	})
+}
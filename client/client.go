@@ -0,0 +1,316 @@
+// Package client talks to a running hypatia Server over its http api.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/petderek/hypatia"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIError is returned when the server answers with a failing status or reports errors in its response.
+type APIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Errors     []string
+}
+
+func (e *APIError) Error() string {
+	msg := strings.Join(e.Errors, "; ")
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	return fmt.Sprintf("%s %s (%d): %s", e.Method, e.Path, e.StatusCode, msg)
+}
+
+// Unwrap converts each reported error into its own error value.
+func (e *APIError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, msg := range e.Errors {
+		errs[i] = errors.New(msg)
+	}
+	return errs
+}
+
+type Client struct {
+	// Endpoint is the server's base url, like http://localhost:8000.
+	Endpoint *url.URL
+	// HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// Token is sent as a bearer token on writes.
+	Token string
+	// HMACSecret signs writes for servers using hypatia.HMACAuth.
+	HMACSecret []byte
+	// task scopes requests to /task/{task}/... on the endpoint
+	task string
+}
+
+func New(endpoint string) (*Client, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{Endpoint: u}, nil
+}
+
+// ForTask returns a copy of the client that reaches the given task, by arn or task id, through this server's proxy.
+func (c *Client) ForTask(task string) *Client {
+	scoped := *c
+	scoped.task = task
+	return &scoped
+}
+
+// Task is the task this client is scoped to, or empty for the server itself.
+func (c *Client) Task() string {
+	return c.task
+}
+
+// Status returns the server's GET / response. Errors the server reports alongside a 200, like imds being unavailable
+// off of ec2, come back as an *APIError together with the response. Any other error comes back without one.
+func (c *Client) Status(ctx context.Context) (*hypatia.RequestResponse, error) {
+	return c.do(ctx, http.MethodGet, "/", nil)
+}
+
+func (c *Client) SetLocalHealth(ctx context.Context, healthy bool) error {
+	_, err := c.do(ctx, http.MethodPost, "/", &hypatia.RequestResponse{SetLocalHealth: &healthy})
+	return err
+}
+
+func (c *Client) SetRemoteHealth(ctx context.Context, healthy bool) error {
+	_, err := c.do(ctx, http.MethodPost, "/", &hypatia.RequestResponse{SetRemoteHealth: &healthy})
+	return err
+}
+
+// Health returns every healthcheck on the server by name, local and remote included.
+func (c *Client) Health(ctx context.Context) (map[string]hypatia.V1Health, error) {
+	var health map[string]hypatia.V1Health
+	return health, c.call(ctx, http.MethodGet, "/health", nil, &health)
+}
+
+// SetHealth sets any named healthcheck. The reason is kept by extended file healthchecks.
+func (c *Client) SetHealth(ctx context.Context, name string, healthy bool, reason string) (*hypatia.V1Health, error) {
+	var health hypatia.V1Health
+	return &health, c.call(ctx, http.MethodPut, "/health/"+url.PathEscape(name), &hypatia.HealthRequest{Healthy: &healthy, Reason: reason}, &health)
+}
+
+// SetProtection turns task protection on or off. Nil minutes uses the agent's default expiry.
+func (c *Client) SetProtection(ctx context.Context, enabled bool, minutes *int) error {
+	_, err := c.do(ctx, http.MethodPost, "/", &hypatia.RequestResponse{
+		TaskProtectionEnabled: &enabled,
+		ExpiresInMinutes:      minutes,
+	})
+	return err
+}
+
+// Ping returns nil if the healthchecks the server's /ping reports are passing, by default the remote one.
+func (c *Client) Ping(ctx context.Context) error {
+	res, err := c.send(ctx, http.MethodGet, "/ping", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return &APIError{
+			Method:     http.MethodGet,
+			Path:       res.Request.URL.Path,
+			StatusCode: res.StatusCode,
+			Errors:     []string{strings.TrimSpace(string(body))},
+		}
+	}
+	return nil
+}
+
+// Neighbors lists the task arns in the server's service.
+func (c *Client) Neighbors(ctx context.Context) ([]string, error) {
+	output, err := c.do(ctx, http.MethodGet, "/tasks", nil)
+	if err != nil {
+		return nil, err
+	}
+	return output.Tasks, nil
+}
+
+// NeighborDetail returns the server's view of every task in its service.
+func (c *Client) NeighborDetail(ctx context.Context) ([]hypatia.Neighbor, error) {
+	output, err := c.do(ctx, http.MethodGet, "/tasks?detail=true", nil)
+	if err != nil {
+		return nil, err
+	}
+	return output.Neighbors, nil
+}
+
+// Broadcast runs fn against every task in the service, concurrently, and returns each task's error keyed by arn.
+func (c *Client) Broadcast(ctx context.Context, fn func(*Client) error) (map[string]error, error) {
+	tasks, err := c.Neighbors(ctx)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]error, len(tasks))
+	var m sync.Mutex
+	var wait sync.WaitGroup
+	for _, task := range tasks {
+		wait.Add(1)
+		go func(task string) {
+			defer wait.Done()
+			err := fn(c.ForTask(task))
+			m.Lock()
+			results[task] = err
+			m.Unlock()
+		}(task)
+	}
+	wait.Wait()
+	return results, nil
+}
+
+// Stress starts burning cpu and memory on the server, replacing any stress already running.
+func (c *Client) Stress(ctx context.Context, r hypatia.StressRequest) (*hypatia.StressStatus, error) {
+	var status hypatia.StressStatus
+	return &status, c.call(ctx, http.MethodPost, "/stress", &r, &status)
+}
+
+func (c *Client) StopStress(ctx context.Context) error {
+	return c.call(ctx, http.MethodDelete, "/stress", nil, nil)
+}
+
+func (c *Client) StressStatus(ctx context.Context) (*hypatia.StressStatus, error) {
+	var status hypatia.StressStatus
+	return &status, c.call(ctx, http.MethodGet, "/stress", nil, &status)
+}
+
+// Crash makes the server exit with the given code after delay.
+func (c *Client) Crash(ctx context.Context, exitCode int, delay time.Duration) error {
+	return c.call(ctx, http.MethodPost, "/crash", &hypatia.CrashRequest{ExitCode: exitCode, Delay: hypatia.Duration(delay)}, nil)
+}
+
+// Events streams the server's events after lastID, calling fn for each one, until ctx is done, the server ends the
+// stream or fn returns an error.
+func (c *Client) Events(ctx context.Context, lastID uint64, fn func(hypatia.Event) error) error {
+	res, err := c.send(ctx, http.MethodGet, fmt.Sprintf("/events?since=%d", lastID), nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var failure hypatia.RequestResponse
+		json.NewDecoder(res.Body).Decode(&failure)
+		return &APIError{Method: http.MethodGet, Path: res.Request.URL.Path, StatusCode: res.StatusCode, Errors: failure.Errors}
+	}
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	var data []byte
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			if len(data) == 0 {
+				continue
+			}
+			var e hypatia.Event
+			if err := json.Unmarshal(data, &e); err != nil {
+				return fmt.Errorf("unexpected event: %s", data)
+			}
+			data = data[:0]
+			if err := fn(e); err != nil {
+				return err
+			}
+			continue
+		}
+		if rest, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			data = append(data, bytes.TrimPrefix(rest, []byte(" "))...)
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return scanner.Err()
+}
+
+func (c *Client) do(ctx context.Context, method, path string, input *hypatia.RequestResponse) (*hypatia.RequestResponse, error) {
+	var output hypatia.RequestResponse
+	if err := c.call(ctx, method, path, input, &output); err != nil {
+		return nil, err
+	}
+	if len(output.Errors) > 0 {
+		return &output, &APIError{Method: method, Path: path, StatusCode: http.StatusOK, Errors: output.Errors}
+	}
+	return &output, nil
+}
+
+// call sends input as json and decodes the response into output. Failing statuses become an *APIError built from
+// the errors in the response body.
+func (c *Client) call(ctx context.Context, method, path string, input, output any) error {
+	var body []byte
+	if input != nil {
+		var err error
+		if body, err = json.Marshal(input); err != nil {
+			return err
+		}
+	}
+	res, err := c.send(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	raw, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= 300 {
+		var failure hypatia.RequestResponse
+		json.Unmarshal(raw, &failure)
+		return &APIError{Method: method, Path: res.Request.URL.Path, StatusCode: res.StatusCode, Errors: failure.Errors}
+	}
+	if output != nil && len(raw) > 0 {
+		if err := json.Unmarshal(raw, output); err != nil {
+			return fmt.Errorf("unexpected response (%d): %s", res.StatusCode, raw)
+		}
+	}
+	return nil
+}
+
+func (c *Client) send(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	if c.Endpoint == nil {
+		return nil, errors.New("no endpoint configured")
+	}
+	target := *c.Endpoint
+	p, query, _ := strings.Cut(path, "?")
+	if c.task != "" {
+		p = "/task/" + c.task + p
+	}
+	target.Path = strings.TrimSuffix(target.Path, "/") + p
+	target.RawQuery = query
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if method != http.MethodGet {
+		if c.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		}
+		if len(c.HMACSecret) > 0 {
+			if err := hypatia.SignRequest(req, c.HMACSecret); err != nil {
+				return nil, err
+			}
+		}
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
@@ -0,0 +1,158 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/petderek/hypatia"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	selfArn     = "arn:aws:ecs:us-west-2:012:task/default/self"
+	neighborArn = "arn:aws:ecs:us-west-2:012:task/default/cafe"
+)
+
+type staticDiscovery map[string]*url.URL
+
+func (s staticDiscovery) GetServiceMap() (*hypatia.ServiceMap, error) {
+	return &hypatia.ServiceMap{Tasks: s}, nil
+}
+
+type staticMetadata string
+
+func (s staticMetadata) Self() (*hypatia.TaskMetadata, error) {
+	arn := string(s)
+	return &hypatia.TaskMetadata{TaskARN: &arn}, nil
+}
+
+func newServer(t *testing.T, taskArn string, sd hypatia.ServiceDiscoveryIface) *hypatia.Server {
+	dir := t.TempDir()
+	return &hypatia.Server{
+		Protection:       &hypatia.TaskProtectionStub{Protection: &hypatia.Protection{TaskArn: &taskArn}},
+		Metadata:         staticMetadata(taskArn),
+		LocalHealth:      hypatia.FileHealthcheck{Filepath: filepath.Join(dir, "local")},
+		RemoteHealth:     hypatia.FileHealthcheck{Filepath: filepath.Join(dir, "remote")},
+		ServiceDiscovery: sd,
+		Writeable:        true,
+	}
+}
+
+// newService starts a neighbor and a server that can reach it, and returns a client for the server.
+func newService(t *testing.T) *Client {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	neighbor := httptest.NewServer(newServer(t, neighborArn, nil))
+	t.Cleanup(neighbor.Close)
+	nu, _ := url.Parse(neighbor.URL)
+	tasks := staticDiscovery{neighborArn: nu}
+	self := httptest.NewServer(newServer(t, selfArn, tasks))
+	t.Cleanup(self.Close)
+	su, _ := url.Parse(self.URL)
+	tasks[selfArn] = su
+	c, err := New(self.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	c := newService(t)
+
+	err := c.Ping(ctx)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected ping to fail with an api error, got %v", err)
+	}
+	if err := c.SetRemoteHealth(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ping(ctx); err != nil {
+		t.Error("expected ping to pass after setting remote health: ", err)
+	}
+	if err := c.SetLocalHealth(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	minutes := 5
+	if err := c.SetProtection(ctx, true, &minutes); err != nil {
+		t.Fatal(err)
+	}
+
+	status, _ := c.Status(ctx)
+	if status == nil || *status.TaskArn != selfArn || *status.LocalHealth != "Healthy" || !*status.TaskProtectionEnabled {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	tasks, err := c.Neighbors(ctx)
+	if err != nil || len(tasks) != 2 {
+		t.Errorf("expected two tasks, got %v %v", tasks, err)
+	}
+}
+
+func TestClientForTask(t *testing.T) {
+	ctx := context.Background()
+	c := newService(t)
+	neighbor := c.ForTask("cafe")
+	if err := neighbor.SetRemoteHealth(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := neighbor.Ping(ctx); err != nil {
+		t.Error("expected neighbor ping to pass: ", err)
+	}
+	if err := c.Ping(ctx); err == nil {
+		t.Error("expected the server itself to be untouched")
+	}
+	status, _ := neighbor.Status(ctx)
+	if status == nil || *status.TaskArn != neighborArn {
+		t.Errorf("expected status from the neighbor, got %+v", status)
+	}
+
+	status, err := c.ForTask("nope").Status(ctx)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || len(apiErr.Unwrap()) != 1 || status != nil {
+		t.Errorf("expected not found and no status, got %+v %v", status, err)
+	}
+
+	results, err := c.Broadcast(ctx, func(c *Client) error {
+		return c.SetLocalHealth(ctx, true)
+	})
+	if err != nil || len(results) != 2 {
+		t.Fatalf("expected a result per task, got %v %v", results, err)
+	}
+	for task, err := range results {
+		if err != nil {
+			t.Errorf("%s: %v", task, err)
+		}
+	}
+}
+
+func TestClientEvents(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	neighbor := newService(t).ForTask("cafe")
+	if err := neighbor.SetLocalHealth(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	errDone := errors.New("done")
+	var seen []hypatia.Event
+	err := neighbor.Events(ctx, 0, func(e hypatia.Event) error {
+		seen = append(seen, e)
+		if len(seen) == 1 {
+			// the stream is open, so this arrives live through the proxy
+			go neighbor.SetRemoteHealth(ctx, false)
+			return nil
+		}
+		return errDone
+	})
+	if !errors.Is(err, errDone) {
+		t.Fatal(err)
+	}
+	if seen[0].Data["slot"] != "local" || seen[1].Data["slot"] != "remote" {
+		t.Errorf("expected both health changes from the neighbor, got %+v", seen)
+	}
+}
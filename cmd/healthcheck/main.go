@@ -1,30 +1,274 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/petderek/hypatia"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
+const usage = `usage: healthcheck [flags] [check|on|off]
+
+checks every target and prints one line, so it can be an ecs container healthCheck.command:
+
+  ["CMD", "healthcheck", "-server", "http://localhost:8000", "-grace", "30s"]
+
+with no targets it checks the file health.status. on and off set every -file target instead.
+
+exit codes:
+  0  healthy, or unhealthy within the grace period
+  1  unhealthy
+  2  invalid input
+
+flags:
+`
+
+const (
+	exitUnhealthy = 1
+	exitUsage     = 2
+
+	// maxOutput keeps the line well within what ecs keeps of a healthcheck's output
+	maxOutput = 1000
+)
+
+// list is a flag that can be given more than once.
+type list []string
+
+func (l *list) String() string     { return strings.Join(*l, ",") }
+func (l *list) Set(s string) error { *l = append(*l, s); return nil }
+
+// target is one thing to check. check returns nil when it's healthy.
+type target struct {
+	name  string
+	check func() error
+}
+
+// grace remembers when checks started and whether the container has been healthy since, so failures while it starts
+// up don't count.
+type grace struct {
+	FirstCheck time.Time `json:"firstCheck"`
+	HealthyAt  time.Time `json:"healthyAt,omitempty"`
+}
+
 func main() {
-	file := flag.String("file", "", "number of minutes to be protected")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	var files, urls, servers list
+	flag.Var(&files, "file", "file healthcheck, healthy when the file exists. repeatable")
+	maxAge := flag.Duration("max-age", 0, "file targets are unhealthy once they haven't been written for this long")
+	reason := flag.String("reason", "", "with on or off, write the status and this reason into the file")
+	flag.Var(&urls, "url", "url that is healthy when GET returns 2xx. repeatable")
+	flag.Var(&servers, "server", "hypatia server to check, e.g. http://localhost:8000. repeatable")
+	slots := flag.String("slot", "ping", "comma separated healthchecks to check on each server: ping (whatever /ping checks), local, remote, both (local and remote) or any other named healthcheck")
+	mode := flag.String("mode", "all", "all targets must be healthy, or any one of them")
+	timeout := flag.Duration("timeout", 2*time.Second, "timeout for each http check")
+	graceFor := flag.Duration("grace", 0, "how long after the first check failures are ignored, until the first success")
+	graceFile := flag.String("grace-file", filepath.Join(os.TempDir(), "hypatia-healthcheck.json"), "where the grace period is tracked")
 	flag.Parse()
-	signal := flag.Arg(0)
-	hc := &hypatia.FileHealthcheck{Filepath: *file}
-
-	var err error
-	switch signal {
-	case "on":
-		err = hc.SetHealth(true)
-	case "off":
-		err = hc.SetHealth(false)
-	default:
-		err = hc.GetHealth()
+
+	switch {
+	case flag.NArg() > 1:
+		usageError("unexpected arguments %v", flag.Args()[1:])
+	case *mode != "all" && *mode != "any":
+		usageError("-mode must be all or any, got %q", *mode)
+	}
+	names := slotNames(*slots)
+	if len(names) == 0 {
+		usageError("-slot must name at least one healthcheck")
+	}
+	if len(files)+len(urls)+len(servers) == 0 {
+		files = list{"health.status"}
+	}
+
+	if command := flag.Arg(0); command == "on" || command == "off" {
+		if len(urls)+len(servers) > 0 {
+			usageError("%s only applies to -file targets", command)
+		}
+		for _, file := range files {
+			hc := &hypatia.FileHealthcheck{Filepath: file}
+			var err error
+			if *reason != "" {
+				err = hc.SetStatus(command == "on", *reason)
+			} else {
+				err = hc.SetHealth(command == "on")
+			}
+			if err != nil {
+				fmt.Println("failed: ", err)
+				os.Exit(exitUnhealthy)
+			}
+		}
+		fmt.Println("succeeded")
+		return
+	} else if command != "" && command != "check" {
+		usageError("unknown command %q", command)
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	var targets []target
+	for _, file := range files {
+		hc := &hypatia.FileHealthcheck{Filepath: file, MaxAge: *maxAge}
+		targets = append(targets, target{name: "file " + file, check: hc.GetHealth})
+	}
+	for _, u := range urls {
+		targets = append(targets, target{name: u, check: func() error {
+			_, err := get(client, u)
+			return err
+		}})
+	}
+	for _, server := range servers {
+		server = strings.TrimSuffix(server, "/")
+		for _, name := range names {
+			if name == "ping" {
+				targets = append(targets, target{name: server + "/ping", check: func() error {
+					_, err := get(client, server+"/ping")
+					return err
+				}})
+				continue
+			}
+			targets = append(targets, target{name: server + " " + name, check: func() error {
+				return slotHealth(client, server, name)
+			}})
+		}
+	}
+
+	healthy, line := check(targets, *mode == "all")
+	status := "healthy"
+	code := 0
+	if *graceFor > 0 {
+		if starting, left := inGrace(*graceFile, *graceFor, healthy); starting {
+			status = fmt.Sprintf("starting (grace ends in %s)", left.Round(time.Second))
+		} else if !healthy {
+			status, code = "unhealthy", exitUnhealthy
+		}
+	} else if !healthy {
+		status, code = "unhealthy", exitUnhealthy
+	}
+	out := status + ": " + line
+	if len(out) > maxOutput {
+		out = out[:maxOutput]
 	}
+	fmt.Println(out)
+	os.Exit(code)
+}
+
+func usageError(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "invalid input: "+format+"\n", args...)
+	flag.Usage()
+	os.Exit(exitUsage)
+}
+
+// check runs every target at once, so one slow target doesn't eat the time the others have under ecs's timeout.
+func check(targets []target, all bool) (bool, string) {
+	errs := make([]error, len(targets))
+	var wait sync.WaitGroup
+	for i, t := range targets {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			errs[i] = t.check()
+		}()
+	}
+	wait.Wait()
+	passed := 0
+	results := make([]string, len(targets))
+	for i, t := range targets {
+		if errs[i] != nil {
+			// the output has to stay on one line
+			results[i] = t.name + " " + strings.Join(strings.Fields(errs[i].Error()), " ")
+			continue
+		}
+		passed++
+		results[i] = t.name + " ok"
+	}
+	healthy := passed == len(targets)
+	if !all {
+		healthy = passed > 0
+	}
+	return healthy, strings.Join(results, "; ")
+}
+
+func get(client *http.Client, u string) ([]byte, error) {
+	res, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 64<<10))
 	if err != nil {
-		fmt.Println("failed: ", err)
-		os.Exit(1)
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("returned %d: %s", res.StatusCode, body)
+	}
+	return body, nil
+}
+
+// slotNames splits -slot, expanding both.
+func slotNames(slots string) []string {
+	var names []string
+	for _, name := range strings.Split(slots, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "":
+		case "both":
+			names = append(names, hypatia.HealthLocal, hypatia.HealthRemote)
+		default:
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// slotHealth reads one of the server's healthchecks from /health/{name}.
+func slotHealth(client *http.Client, server, name string) error {
+	body, err := get(client, server+"/health/"+url.PathEscape(name))
+	if err != nil {
+		return err
+	}
+	var health hypatia.V1Health
+	if err := json.Unmarshal(body, &health); err != nil {
+		return err
+	}
+	if !health.Healthy {
+		if health.Reason != "" {
+			return errors.New("unhealthy: " + health.Reason)
+		}
+		return errors.New("unhealthy")
+	}
+	return nil
+}
+
+// inGrace records the first check and the first success in path, and reports whether a failure now should be
+// ignored. A grace file that can't be read starts the grace period over.
+func inGrace(path string, period time.Duration, healthy bool) (bool, time.Duration) {
+	var g grace
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &g)
+	}
+	now := time.Now().UTC()
+	changed := false
+	if g.FirstCheck.IsZero() {
+		g.FirstCheck, changed = now, true
+	}
+	if healthy && g.HealthyAt.IsZero() {
+		g.HealthyAt, changed = now, true
+	}
+	if changed {
+		data, _ := json.Marshal(&g)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			fmt.Fprintln(os.Stderr, "unable to track the grace period: ", err)
+		}
 	}
-	fmt.Println("succeeded")
+	left := g.FirstCheck.Add(period).Sub(now)
+	return !healthy && g.HealthyAt.IsZero() && left > 0, left
 }
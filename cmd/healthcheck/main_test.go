@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	slow := func(err error) func() error {
+		return func() error {
+			time.Sleep(100 * time.Millisecond)
+			return err
+		}
+	}
+	targets := []target{
+		{name: "up", check: slow(nil)},
+		{name: "down", check: slow(errors.New("returned 500:\n  {\"errors\": [\"nope\"]}"))},
+	}
+	start := time.Now()
+	healthy, line := check(targets, true)
+	if healthy {
+		t.Error("expected all to fail when one target does")
+	}
+	if took := time.Since(start); took > 190*time.Millisecond {
+		t.Errorf("expected targets to be checked at once, took %s", took)
+	}
+	if line != `up ok; down returned 500: {"errors": ["nope"]}` {
+		t.Errorf("expected one line for every target, got %q", line)
+	}
+	if healthy, _ := check(targets, false); !healthy {
+		t.Error("expected any to pass when one target does")
+	}
+	if healthy, _ := check(targets[1:], false); healthy {
+		t.Error("expected any to fail when every target does")
+	}
+}
+
+func TestInGrace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grace.json")
+	if starting, left := inGrace(path, time.Hour, false); !starting || left <= 59*time.Minute {
+		t.Errorf("expected the first failure to be in the grace period, got %t %s", starting, left)
+	}
+	if starting, _ := inGrace(path, time.Hour, false); !starting {
+		t.Error("expected failures to be ignored until the grace period ends")
+	}
+	if starting, _ := inGrace(path, time.Hour, true); starting {
+		t.Error("expected a success not to be starting")
+	}
+	if starting, _ := inGrace(path, time.Hour, false); starting {
+		t.Error("expected failures to count once the container has been healthy")
+	}
+
+	os.WriteFile(path, []byte(`{"firstCheck": "2020-01-01T00:00:00Z"}`), 0644)
+	if starting, _ := inGrace(path, time.Hour, false); starting {
+		t.Error("expected failures to count once the grace period is over")
+	}
+	os.WriteFile(path, []byte("garbage"), 0644)
+	if starting, _ := inGrace(path, time.Hour, false); !starting {
+		t.Error("expected an unreadable grace file to start the grace period over")
+	}
+}
+
+func TestSlotHealth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/health/readiness":
+			res.Write([]byte(`{"healthy": true}`))
+		case "/health/local":
+			res.Write([]byte(`{"healthy": false, "reason": "draining"}`))
+		default:
+			res.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	client := &http.Client{Timeout: time.Second}
+	if err := slotHealth(client, server.URL, "readiness"); err != nil {
+		t.Errorf("expected readiness to be healthy, got %v", err)
+	}
+	if err := slotHealth(client, server.URL, "local"); err == nil || !strings.Contains(err.Error(), "draining") {
+		t.Errorf("expected local to be unhealthy with its reason, got %v", err)
+	}
+	if err := slotHealth(client, server.URL, "nope"); err == nil {
+		t.Error("expected an unknown slot to fail")
+	}
+
+	if names := slotNames("ping, both,readiness,"); !slices.Equal(names, []string{"ping", "local", "remote", "readiness"}) {
+		t.Errorf("unexpected slots: %v", names)
+	}
+}
@@ -1,47 +1,288 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"flag"
-	"github.com/aws/aws-sdk-go-v2/aws"
+	"fmt"
 	"github.com/petderek/hypatia"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
+const shutdownTimeout = 10 * time.Second
+
 func main() {
-	localfile := flag.String("local", "local.status", "local file healthcheck")
-	remotefile := flag.String("remote", "remote.status", "remote file healthcheck")
-	address := flag.String("a", ":8000", "address to listen on")
-	shouldStub := flag.Bool("stub", false, "should stub task protection endpoint")
-	serviceName := flag.String("service", "", "the ecs service name to use")
-	clusterName := flag.String("cluster", "", "the ecs cluster name to use")
-	writable := flag.Bool("w", true, "accepts post requests")
+	if len(os.Args) > 1 && os.Args[1] == "gencert" {
+		gencert(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "fake-imds" {
+		fakeIMDS(os.Args[2:])
+		return
+	}
+	defaults := hypatia.DefaultConfig()
+	configFile := flag.String("config", os.Getenv("HYPATIA_CONFIG"), "yaml or json config file. also HYPATIA_CONFIG")
+	printConfig := flag.Bool("print-config", false, "print the merged config and exit")
+	flag.String("local", defaults.LocalHealth.File, "local file healthcheck")
+	flag.String("remote", defaults.RemoteHealth.File, "remote file healthcheck")
+	flag.String("health", "", "other named healthchecks, as comma separated name=file or name for name.status")
+	flag.String("ping", strings.Join(defaults.PingSlots, ","), "comma separated healthchecks /ping reports, all of which must be healthy")
+	flag.String("a", defaults.Address, "address to listen on")
+	flag.Bool("stub", false, "should stub task protection endpoint")
+	flag.String("service", "", "the ecs service name to use")
+	flag.String("cluster", "", "the ecs cluster name to use")
+	flag.Bool("w", defaults.Writeable, "accepts post requests")
+	flag.Duration("proxy-dial-timeout", 0, "timeout for connecting to a neighbor")
+	flag.Duration("proxy-header-timeout", 0, "timeout for a neighbor's response headers")
+	flag.Duration("proxy-timeout", 0, "overall timeout for a proxied request")
+	flag.Int("proxy-max-hops", 0, "number of proxies a request may pass through")
+	flag.String("balance", defaults.Balancer.Strategy, "how /any picks a task: round-robin, random, least-outstanding or hash")
+	flag.String("balance-hash-header", "", "request header to hash when -balance=hash")
+	flag.Duration("poll", 0, "how often to poll neighbors for /tasks?detail=true, 0 polls on request")
+	flag.String("auth-tokens", "", "file of bearer tokens accepted for writes, one per line")
+	flag.String("auth-hmac-secret", "", "file holding the hmac secret for signed writes")
+	flag.String("auth-cidrs", "", "comma separated networks allowed to write")
+	flag.String("tls-cert", "", "certificate to serve https with")
+	flag.String("tls-key", "", "key for -tls-cert")
+	flag.String("tls-client-ca", "", "ca bundle used to require and verify client certificates")
+	flag.Duration("tls-reload", time.Duration(defaults.TLS.ReloadInterval), "how often to check -tls-cert and -tls-key for changes")
+	flag.String("proxy-scheme", defaults.ServiceDiscovery.Scheme, "scheme used to reach neighbors: http or https")
+	flag.String("proxy-ca", "", "ca bundle used to verify https neighbors")
+	flag.Bool("proxy-insecure", false, "skip verifying https neighbors")
+	flag.String("events-file", "", "append every event to this jsonl file")
+	flag.String("state-dir", "", "directory for relative health, state and event files. defaults to the working directory")
+	flag.String("state-file", defaults.State.File, "file that saves health, protection and stress across restarts, empty to keep them in memory")
+	flag.Bool("fresh", false, "ignore and overwrite the saved state")
+	flag.String("imds-endpoint", "", "instance metadata endpoint, to use a fake")
+	flag.Duration("health-watch", time.Duration(defaults.HealthWatchInterval), "how often to check the health files for outside changes, 0 to not watch")
+	flag.Bool("spot", !defaults.Spot.Disabled, "react to spot interruption and rebalance notices")
+	flag.String("discovery-cache", "", "directory to keep discovery lookups in, shareable between sidecars on a host")
 	flag.Parse()
-	var tpClient hypatia.TaskProtectionIface
-	if *shouldStub {
-		tpClient = &hypatia.TaskProtectionStub{
-			Protection: &hypatia.Protection{
-				TaskArn: aws.String("arn:aws:ecs:us-west-2:0123456789:task/foo"),
-			},
+
+	cfg := hypatia.DefaultConfig()
+	if *configFile != "" {
+		if err := cfg.LoadFile(*configFile); err != nil {
+			log.Fatalln("unable to load config: ", err)
 		}
-	} else {
-		tpClient = &hypatia.TaskProtectionClient{}
+	}
+	if err := cfg.LoadEnv(os.LookupEnv); err != nil {
+		log.Fatalln("unable to load config from environment: ", err)
+	}
+	// only flags given on the command line override the file and environment
+	flag.Visit(func(f *flag.Flag) {
+		applyFlag(cfg, f)
+	})
+	if err := cfg.Validate(); err != nil {
+		log.Fatalln("invalid config: ", err)
+	}
+	if *printConfig {
+		data, _ := json.MarshalIndent(cfg.Redacted(), "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	srv, err := cfg.NewServer()
+	if err != nil {
+		log.Fatalln("unable to build server: ", err)
+	}
+	var reloader *hypatia.CertReloader
+	if cfg.TLS.Cert != "" {
+		if reloader, err = hypatia.NewCertReloader(cfg.TLS.Cert, cfg.TLS.Key); err != nil {
+			log.Fatalln("unable to load certificate: ", err)
+		}
+		go reloader.Watch(time.Duration(cfg.TLS.ReloadInterval), nil)
+		if srv.ProxyTLSConfig == nil {
+			srv.ProxyTLSConfig = &tls.Config{}
+		}
+		srv.ProxyTLSConfig.GetClientCertificate = reloader.GetClientCertificate
 	}
 	log.Println("starting server")
-	sd := &hypatia.ServiceDiscovery{}
-	if *serviceName != "" {
-		sd.ServiceName = *serviceName
-	}
-	if *clusterName != "" {
-		sd.ClusterName = *clusterName
-	}
-	srv := &hypatia.Server{
-		Protection:       tpClient,
-		Metadata:         tpClient,
-		LocalHealth:      hypatia.FileHealthcheck{Filepath: *localfile},
-		RemoteHealth:     hypatia.FileHealthcheck{Filepath: *remotefile},
-		ServiceDiscovery: sd,
-		Writeable:        *writable,
-	}
-	http.ListenAndServe(*address, srv)
+	// cancelling base ends long lived requests, like /events streams, so shutdown doesn't wait on them
+	base, cancel := context.WithCancel(context.Background())
+	server := &http.Server{
+		Addr:        cfg.Address,
+		Handler:     srv,
+		BaseContext: func(net.Listener) context.Context { return base },
+	}
+	stopped := handleSignals(srv, server, cancel, reloader)
+	go srv.PollNeighbors(base)
+	go srv.WatchSpot(base)
+	go srv.WatchHealth(base)
+	if reloader == nil {
+		err = server.ListenAndServe()
+	} else {
+		server.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+		if cfg.TLS.ClientCA != "" {
+			if server.TLSConfig.ClientCAs, err = hypatia.LoadCertPool(cfg.TLS.ClientCA); err != nil {
+				log.Fatalln("unable to load client ca: ", err)
+			}
+			server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		err = server.ListenAndServeTLS("", "")
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalln(err)
+	}
+	<-stopped
+	log.Println("server stopped")
+}
+
+func applyFlag(cfg *hypatia.Config, f *flag.Flag) {
+	value := f.Value.(flag.Getter).Get()
+	switch f.Name {
+	case "local":
+		cfg.LocalHealth.File = value.(string)
+	case "remote":
+		cfg.RemoteHealth.File = value.(string)
+	case "health":
+		if cfg.Health == nil {
+			cfg.Health = make(map[string]hypatia.HealthConfig)
+		}
+		for name, h := range hypatia.ParseHealthList(value.(string)) {
+			cfg.Health[name] = h
+		}
+	case "ping":
+		cfg.PingSlots = strings.Split(value.(string), ",")
+	case "a":
+		cfg.Address = value.(string)
+	case "stub":
+		cfg.TaskProtection.Stub = value.(bool)
+	case "service":
+		cfg.ServiceDiscovery.Service = value.(string)
+	case "cluster":
+		cfg.ServiceDiscovery.Cluster = value.(string)
+	case "w":
+		cfg.Writeable = value.(bool)
+	case "proxy-dial-timeout":
+		cfg.Proxy.DialTimeout = hypatia.Duration(value.(time.Duration))
+	case "proxy-header-timeout":
+		cfg.Proxy.ResponseHeaderTimeout = hypatia.Duration(value.(time.Duration))
+	case "proxy-timeout":
+		cfg.Proxy.Timeout = hypatia.Duration(value.(time.Duration))
+	case "proxy-max-hops":
+		cfg.Proxy.MaxHops = value.(int)
+	case "balance":
+		cfg.Balancer.Strategy = value.(string)
+	case "balance-hash-header":
+		cfg.Balancer.HashHeader = value.(string)
+	case "poll":
+		cfg.NeighborPollInterval = hypatia.Duration(value.(time.Duration))
+	case "auth-tokens":
+		cfg.Auth.TokensFile = value.(string)
+	case "auth-hmac-secret":
+		cfg.Auth.HMACSecretFile = value.(string)
+	case "auth-cidrs":
+		cfg.Auth.CIDRs = strings.Split(value.(string), ",")
+	case "tls-cert":
+		cfg.TLS.Cert = value.(string)
+	case "tls-key":
+		cfg.TLS.Key = value.(string)
+	case "tls-client-ca":
+		cfg.TLS.ClientCA = value.(string)
+	case "tls-reload":
+		cfg.TLS.ReloadInterval = hypatia.Duration(value.(time.Duration))
+	case "proxy-scheme":
+		cfg.ServiceDiscovery.Scheme = value.(string)
+	case "proxy-ca":
+		cfg.Proxy.CA = value.(string)
+	case "proxy-insecure":
+		cfg.Proxy.Insecure = value.(bool)
+	case "events-file":
+		cfg.Events.File = value.(string)
+	case "state-dir":
+		cfg.State.Dir = value.(string)
+	case "state-file":
+		cfg.State.File = value.(string)
+	case "fresh":
+		cfg.State.Fresh = value.(bool)
+	case "imds-endpoint":
+		cfg.Instance.Endpoint = value.(string)
+	case "discovery-cache":
+		cfg.ServiceDiscovery.CacheDir = value.(string)
+	case "health-watch":
+		cfg.HealthWatchInterval = hypatia.Duration(value.(time.Duration))
+	case "spot":
+		cfg.Spot.Disabled = !value.(bool)
+	}
+}
+
+// handleSignals records every signal as an event. SIGHUP reloads the certificate, and SIGINT or SIGTERM shut the
+// server down. The returned channel closes once shutdown is done.
+func handleSignals(srv *hypatia.Server, server *http.Server, cancel context.CancelFunc, reloader *hypatia.CertReloader) <-chan struct{} {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, recorded...)
+	stopped := make(chan struct{})
+	go func() {
+		for sig := range signals {
+			log.Println("received signal: ", sig)
+			srv.Events.Publish(hypatia.EventSignal, map[string]any{"signal": sig.String()})
+			switch sig {
+			case syscall.SIGHUP:
+				if reloader == nil {
+					continue
+				}
+				if err := reloader.Reload(); err != nil {
+					log.Println("unable to reload certificate: ", err)
+				} else {
+					log.Println("reloaded certificate on SIGHUP")
+				}
+			case syscall.SIGINT, syscall.SIGTERM:
+				signal.Stop(signals)
+				ctx, done := context.WithTimeout(context.Background(), shutdownTimeout)
+				cancel()
+				if err := server.Shutdown(ctx); err != nil {
+					log.Println("unable to shut down cleanly: ", err)
+				}
+				done()
+				close(stopped)
+				return
+			}
+		}
+	}()
+	return stopped
+}
+
+// gencert writes a self-signed certificate and key for local testing.
+func gencert(args []string) {
+	fs := flag.NewFlagSet("gencert", flag.ExitOnError)
+	out := fs.String("out", ".", "directory to write cert.pem and key.pem to")
+	hosts := fs.String("hosts", "localhost,127.0.0.1", "comma separated hostnames and ips the certificate is valid for")
+	validFor := fs.Duration("valid", 30*24*time.Hour, "how long the certificate is valid")
+	fs.Parse(args)
+	certPEM, keyPEM, err := hypatia.GenerateDevCert(strings.Split(*hosts, ","), *validFor)
+	if err != nil {
+		log.Fatalln("unable to generate certificate: ", err)
+	}
+	if err := os.WriteFile(filepath.Join(*out, "cert.pem"), certPEM, 0644); err != nil {
+		log.Fatalln(err)
+	}
+	if err := os.WriteFile(filepath.Join(*out, "key.pem"), keyPEM, 0600); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("wrote cert.pem and key.pem to ", *out)
+}
+
+// fakeIMDS serves a fake instance metadata service for local testing. Point -imds-endpoint at it, then inject spot
+// notices with POST /fake/spot/interrupt, POST /fake/spot/rebalance and DELETE /fake/spot.
+func fakeIMDS(args []string) {
+	fs := flag.NewFlagSet("fake-imds", flag.ExitOnError)
+	address := fs.String("a", "127.0.0.1:1338", "address to listen on")
+	spot := fs.Bool("spot", true, "fake a spot instance rather than on-demand")
+	fs.Parse(args)
+	fake := hypatia.NewFakeIMDS()
+	if *spot {
+		fake.Set("instance-life-cycle", "spot")
+	}
+	log.Println("serving fake imds on ", *address)
+	log.Fatalln(http.ListenAndServe(*address, fake))
 }
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// there are no user signals to record here
+var recorded = []os.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM}
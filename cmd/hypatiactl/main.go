@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/petderek/hypatia"
+	"github.com/petderek/hypatia/client"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `usage: hypatiactl [flags] <command>
+
+commands:
+  status                          show health, protection and instance for the task
+  ping                            check the task's remote health
+  health [<name> on|off]          list health checks, or flip local, remote or any other named one
+  protect on [-minutes N] | off   change task protection
+  tasks [-detail]                 list tasks in the service
+  events [-since N] [-type T,...] stream events from the task until interrupted
+  task <arn|id> <command>         run any command above against a neighbor
+  broadcast <command>             run a command against every task in the service
+
+flags:
+`
+
+type cli struct {
+	c      *client.Client
+	output string
+	out    io.Writer
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	addr := flag.String("addr", envOr("HYPATIA_ADDR", "http://localhost:8000"), "hypatia server address. also HYPATIA_ADDR")
+	output := flag.String("o", "table", "output format: table or json")
+	token := flag.String("token", os.Getenv("HYPATIA_TOKEN"), "bearer token for writes. also HYPATIA_TOKEN")
+	secret := flag.String("hmac-secret", os.Getenv("HYPATIA_HMAC_SECRET"), "secret to sign writes with. also HYPATIA_HMAC_SECRET")
+	timeout := flag.Duration("timeout", 10*time.Second, "timeout for each request")
+	watch := flag.Duration("watch", 0, "repeat the command at this interval")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *output != "table" && *output != "json" {
+		fmt.Fprintln(os.Stderr, "unknown output format: ", *output)
+		os.Exit(2)
+	}
+	c, err := client.New(*addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bad address: ", err)
+		os.Exit(2)
+	}
+	c.Token = *token
+	c.HMACSecret = []byte(*secret)
+	cmd := &cli{c: c, output: *output, out: os.Stdout}
+
+	for {
+		if *watch > 0 && *output == "table" {
+			fmt.Print("\033[H\033[2J")
+		}
+		err = cmd.runOnce(flag.Args(), *timeout)
+		if *watch <= 0 {
+			break
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: ", err)
+		}
+		time.Sleep(*watch)
+	}
+	if errors.Is(err, errUsage) {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: ", err)
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("invalid command")
+
+// runOnce runs a command under the timeout, or until interrupted for streams.
+func (cmd *cli) runOnce(args []string, timeout time.Duration) error {
+	if slices.Contains(args, "events") {
+		// streams run until interrupted
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+		return cmd.run(ctx, args)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return cmd.run(ctx, args)
+}
+
+func (cmd *cli) run(ctx context.Context, args []string) error {
+	switch args[0] {
+	case "status":
+		// partial failures, like no imds off of ec2, are part of the status rather than a failed command
+		status, err := cmd.c.Status(ctx)
+		var apiErr *client.APIError
+		if err != nil && !(errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusOK) {
+			return err
+		}
+		cmd.printStatus(status)
+		return nil
+	case "ping":
+		if err := cmd.c.Ping(ctx); err != nil {
+			return err
+		}
+		cmd.print(map[string]string{"ping": "ok"}, "ok")
+		return nil
+	case "health":
+		if len(args) == 1 {
+			health, err := cmd.c.Health(ctx)
+			if err != nil {
+				return err
+			}
+			cmd.printHealth(health)
+			return nil
+		}
+		if len(args) != 3 {
+			return fmt.Errorf("%w: health [<name> on|off]", errUsage)
+		}
+		healthy, err := onOff(args[2])
+		if err != nil {
+			return err
+		}
+		switch args[1] {
+		case "local":
+			err = cmd.c.SetLocalHealth(ctx, healthy)
+		case "remote":
+			err = cmd.c.SetRemoteHealth(ctx, healthy)
+		default:
+			_, err = cmd.c.SetHealth(ctx, args[1], healthy, "")
+		}
+		if err != nil {
+			return err
+		}
+		cmd.print(map[string]any{args[1] + "Health": healthy}, fmt.Sprintf("%s health set to %s", args[1], args[2]))
+		return nil
+	case "protect":
+		fs := flag.NewFlagSet("protect", flag.ContinueOnError)
+		minutes := fs.Int("minutes", 0, "minutes until protection expires, 0 uses the agent default")
+		if len(args) < 2 {
+			return fmt.Errorf("%w: protect on|off", errUsage)
+		}
+		enabled, err := onOff(args[1])
+		if err != nil {
+			return err
+		}
+		if err := fs.Parse(args[2:]); err != nil {
+			return fmt.Errorf("%w: %s", errUsage, err)
+		}
+		var m *int
+		if *minutes > 0 {
+			m = minutes
+		}
+		if err := cmd.c.SetProtection(ctx, enabled, m); err != nil {
+			return err
+		}
+		cmd.print(map[string]any{"taskProtectionEnabled": enabled}, "protection set to "+args[1])
+		return nil
+	case "tasks":
+		fs := flag.NewFlagSet("tasks", flag.ContinueOnError)
+		detail := fs.Bool("detail", false, "include each task's health and protection")
+		if err := fs.Parse(args[1:]); err != nil {
+			return fmt.Errorf("%w: %s", errUsage, err)
+		}
+		if *detail {
+			neighbors, err := cmd.c.NeighborDetail(ctx)
+			if err != nil {
+				return err
+			}
+			cmd.printNeighbors(neighbors)
+			return nil
+		}
+		tasks, err := cmd.c.Neighbors(ctx)
+		if err != nil {
+			return err
+		}
+		if cmd.output == "json" {
+			cmd.print(tasks, "")
+			return nil
+		}
+		for _, t := range tasks {
+			fmt.Fprintln(cmd.out, t)
+		}
+		return nil
+	case "events":
+		fs := flag.NewFlagSet("events", flag.ContinueOnError)
+		since := fs.Uint64("since", 0, "start after this event id, 0 replays everything the server remembers")
+		types := fs.String("type", "", "comma separated event types to show")
+		if err := fs.Parse(args[1:]); err != nil {
+			return fmt.Errorf("%w: %s", errUsage, err)
+		}
+		show := make(map[string]bool)
+		for _, t := range strings.Split(*types, ",") {
+			if t != "" {
+				show[t] = true
+			}
+		}
+		err := cmd.c.Events(ctx, *since, func(e hypatia.Event) error {
+			if len(show) > 0 && !show[e.Type] {
+				return nil
+			}
+			if cmd.output == "json" {
+				data, _ := json.Marshal(&e)
+				fmt.Fprintln(cmd.out, string(data))
+				return nil
+			}
+			data, _ := json.Marshal(e.Data)
+			fmt.Fprintf(cmd.out, "%d\t%s\t%s\t%s\n", e.ID, e.Time.Format(time.RFC3339Nano), e.Type, data)
+			return nil
+		})
+		if errors.Is(err, context.Canceled) {
+			return nil
+		}
+		return err
+	case "task":
+		if len(args) < 3 {
+			return fmt.Errorf("%w: task <arn|id> <command>", errUsage)
+		}
+		scoped := *cmd
+		scoped.c = cmd.c.ForTask(args[1])
+		return scoped.run(ctx, args[2:])
+	case "broadcast":
+		if len(args) < 2 || args[1] == "task" || args[1] == "broadcast" || args[1] == "tasks" || args[1] == "events" {
+			return fmt.Errorf("%w: broadcast <command>", errUsage)
+		}
+		return cmd.broadcast(ctx, args[1:])
+	}
+	return fmt.Errorf("%w: unknown command %q", errUsage, args[0])
+}
+
+// broadcast runs a command against every task and reports one line per task. Output from each task is discarded.
+func (cmd *cli) broadcast(ctx context.Context, args []string) error {
+	results, err := cmd.c.Broadcast(ctx, func(c *client.Client) error {
+		scoped := &cli{c: c, output: "json", out: io.Discard}
+		return scoped.run(ctx, args)
+	})
+	if err != nil {
+		return err
+	}
+	report := make(map[string]string, len(results))
+	var failed int
+	for task, err := range results {
+		report[task] = "ok"
+		if err != nil {
+			report[task] = err.Error()
+			failed++
+		}
+	}
+	if cmd.output == "json" {
+		cmd.print(report, "")
+	} else {
+		tasks := make([]string, 0, len(report))
+		for task := range report {
+			tasks = append(tasks, task)
+		}
+		sort.Strings(tasks)
+		w := tabwriter.NewWriter(cmd.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TASK\tRESULT")
+		for _, task := range tasks {
+			fmt.Fprintf(w, "%s\t%s\n", task, report[task])
+		}
+		w.Flush()
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tasks failed", failed, len(results))
+	}
+	return nil
+}
+
+func (cmd *cli) print(v any, text string) {
+	if cmd.output == "json" {
+		data, _ := json.MarshalIndent(v, "", "  ")
+		fmt.Fprintln(cmd.out, string(data))
+		return
+	}
+	fmt.Fprintln(cmd.out, text)
+}
+
+func (cmd *cli) printStatus(status *hypatia.RequestResponse) {
+	if cmd.output == "json" {
+		cmd.print(status, "")
+		return
+	}
+	w := tabwriter.NewWriter(cmd.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "task\t%s\n", safeS(status.TaskArn))
+	fmt.Fprintf(w, "local health\t%s\n", safeS(status.LocalHealth))
+	fmt.Fprintf(w, "remote health\t%s\n", safeS(status.RemoteHealth))
+	names := make([]string, 0, len(status.Health))
+	for name := range status.Health {
+		if name != hypatia.HealthLocal && name != hypatia.HealthRemote {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s health\t%s\n", name, healthyWord(status.Health[name]))
+	}
+	fmt.Fprintf(w, "protected\t%s\n", safeB(status.TaskProtectionEnabled))
+	fmt.Fprintf(w, "protection expiry\t%s\n", safeS(status.TaskProtectionExpiry))
+	fmt.Fprintf(w, "ec2 instance\t%s\n", safeS(status.EC2InstanceId))
+	for _, e := range status.Errors {
+		fmt.Fprintf(w, "error\t%s\n", e)
+	}
+	w.Flush()
+}
+
+func (cmd *cli) printHealth(health map[string]hypatia.V1Health) {
+	if cmd.output == "json" {
+		cmd.print(health, "")
+		return
+	}
+	names := make([]string, 0, len(health))
+	for name := range health {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(cmd.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tHEALTH\tREASON")
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", name, healthyWord(health[name].Healthy), health[name].Reason)
+	}
+	w.Flush()
+}
+
+// healthyWord matches how GET / reports local and remote health.
+func healthyWord(healthy bool) string {
+	if healthy {
+		return "Healthy"
+	}
+	return "Unhealthy"
+}
+
+func (cmd *cli) printNeighbors(neighbors []hypatia.Neighbor) {
+	if cmd.output == "json" {
+		cmd.print(neighbors, "")
+		return
+	}
+	w := tabwriter.NewWriter(cmd.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TASK\tADDRESS\tLOCAL\tREMOTE\tPROTECTED\tEXPIRY\tINSTANCE\tLAST SEEN\tERRORS")
+	for _, n := range neighbors {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\n", safeS(n.TaskArn), safeS(n.Address), safeS(n.LocalHealth),
+			safeS(n.RemoteHealth), safeB(n.TaskProtectionEnabled), safeS(n.TaskProtectionExpiry),
+			safeS(n.EC2InstanceId), safeS(n.LastSeen), len(n.Errors))
+	}
+	w.Flush()
+}
+
+func onOff(s string) (bool, error) {
+	switch s {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	if b, err := strconv.ParseBool(s); err == nil {
+		return b, nil
+	}
+	return false, fmt.Errorf("%w: expected on or off, got %q", errUsage, s)
+}
+
+func envOr(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fallback
+}
+
+func safeS(s *string) string {
+	if s == nil {
+		return "-"
+	}
+	return *s
+}
+
+func safeB(b *bool) string {
+	if b == nil {
+		return "-"
+	}
+	return strconv.FormatBool(*b)
+}
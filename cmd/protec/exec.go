@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/petderek/hypatia"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// minRenew keeps a failing agent, or a very short protection, from being retried in a tight loop.
+const minRenew = 30 * time.Second
+
+// execProtected runs args with protection on, renewing it halfway to each expiry, and turns protection off once the
+// command exits, however it exits. The command doesn't run if protection can't be turned on. It returns the
+// command's exit code, or 128 plus the signal that killed it, like a shell.
+func execProtected(args []string, minutes int) int {
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "error: ", fmt.Errorf("%w: exec needs a command", errUsage))
+		return exitUsage
+	}
+	var m *int
+	if minutes != 0 {
+		m = &minutes
+	}
+	r := &renewer{tp: newClient(), minutes: m}
+	protection, err := r.tp.Put(true, m)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: unable to turn protection on: ", err)
+		return exitCode(err)
+	}
+	r.protection = protection
+	log.Println("protected until ", deref(protection.ExpirationDate))
+
+	// caught before the command starts, so nothing is lost in between
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwarded...)
+	defer signal.Stop(signals)
+	code := supervise(args, signals, r.renew, renewAfter(protection))
+
+	if _, err := r.tp.Put(false, nil); err != nil {
+		fmt.Fprintln(os.Stderr, "error: unable to turn protection off: ", err)
+	}
+	return code
+}
+
+// renewer keeps protection on while the command runs.
+type renewer struct {
+	tp         *hypatia.TaskProtectionClient
+	minutes    *int
+	protection *hypatia.Protection
+	// lapsed is set once renewing has failed for long enough that protection expired
+	lapsed bool
+}
+
+// renew renews protection, and returns when to next. A failed renewal is retried; stdout belongs to the command, so
+// protection running out is warned about once on stderr.
+func (r *renewer) renew() time.Duration {
+	p, err := r.tp.Put(true, r.minutes)
+	if err == nil {
+		r.protection = p
+		if r.lapsed {
+			fmt.Fprintln(os.Stderr, "protection is back on until ", deref(p.ExpirationDate))
+			r.lapsed = false
+		}
+		log.Println("renewed protection until ", deref(p.ExpirationDate))
+		return renewAfter(p)
+	}
+	fmt.Fprintln(os.Stderr, "error: unable to renew protection: ", err)
+	if !r.lapsed && expiresIn(r.protection) == 0 {
+		fmt.Fprintln(os.Stderr, "warning: protection has lapsed, the task can be stopped while the command runs")
+		r.lapsed = true
+	}
+	return renewAfter(r.protection)
+}
+
+// supervise starts the command and waits for it, forwarding signals and calling renew when it's due.
+func supervise(args []string, signals <-chan os.Signal, renew func() time.Duration, first time.Duration) int {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, "error: ", err)
+		if errors.Is(err, exec.ErrNotFound) {
+			return 127
+		}
+		return 126
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	timer := time.NewTimer(first)
+	defer timer.Stop()
+	for {
+		select {
+		case sig := <-signals:
+			log.Println("forwarding ", sig)
+			cmd.Process.Signal(sig)
+		case <-timer.C:
+			timer.Reset(renew())
+		case err := <-done:
+			return exitStatus(err)
+		}
+	}
+}
+
+func exitStatus(err error) int {
+	var exitErr *exec.ExitError
+	if err == nil {
+		return 0
+	}
+	if !errors.As(err, &exitErr) {
+		fmt.Fprintln(os.Stderr, "error: ", err)
+		return exitFailed
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return exitErr.ExitCode()
+}
+
+// renewAfter is halfway to the protection's expiry.
+func renewAfter(p *hypatia.Protection) time.Duration {
+	left := expiresIn(p)
+	if left == forever {
+		return forever
+	}
+	return max(left/2, minRenew)
+}
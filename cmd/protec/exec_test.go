@@ -0,0 +1,128 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRenewAfter(t *testing.T) {
+	for name, tc := range map[string]struct {
+		expiry string
+		want   time.Duration
+	}{
+		"halfway":   {time.Now().Add(10 * time.Minute).UTC().Format(time.RFC3339), 5 * time.Minute},
+		"short":     {time.Now().Add(40 * time.Second).UTC().Format(time.RFC3339), minRenew},
+		"expired":   {time.Now().Add(-time.Minute).UTC().Format(time.RFC3339), minRenew},
+		"no expiry": {"", forever},
+	} {
+		got := renewAfter(protection(true, tc.expiry))
+		if got > tc.want || got < tc.want-2*time.Second {
+			t.Errorf("%s: expected about %s, got %s", name, tc.want, got)
+		}
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	for script, code := range map[string]int{
+		"exit 0":        0,
+		"exit 3":        3,
+		"kill -TERM $$": 128 + int(syscall.SIGTERM),
+		"kill -KILL $$": 128 + int(syscall.SIGKILL),
+	} {
+		if got := exitStatus(exec.Command("sh", "-c", script).Run()); got != code {
+			t.Errorf("%s: expected %d, got %d", script, code, got)
+		}
+	}
+}
+
+func TestSupervise(t *testing.T) {
+	never := func() time.Duration { return forever }
+	if code := supervise([]string{"hypatia-no-such-command"}, nil, never, forever); code != 127 {
+		t.Errorf("expected a missing command to exit 127, got %d", code)
+	}
+
+	ready := filepath.Join(t.TempDir(), "ready")
+	signals := make(chan os.Signal, 1)
+	go func() {
+		for {
+			if _, err := os.Stat(ready); err == nil {
+				signals <- syscall.SIGUSR1
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	script := `trap "exit 7" USR1; touch "$0"; while :; do sleep 0.01; done`
+	if code := supervise([]string{"sh", "-c", script, ready}, signals, never, forever); code != 7 {
+		t.Errorf("expected the signal to reach the command, got %d", code)
+	}
+
+	var renewed atomic.Int32
+	renew := func() time.Duration {
+		renewed.Add(1)
+		return 10 * time.Millisecond
+	}
+	if code := supervise([]string{"sleep", "0.2"}, nil, renew, 10*time.Millisecond); code != 0 || renewed.Load() < 2 {
+		t.Errorf("expected protection to be renewed while the command runs, got %d renewals and code %d", renewed.Load(), code)
+	}
+}
+
+func TestExecProtected(t *testing.T) {
+	agent := newFakeAgent(t)
+	if code := execProtected([]string{"--", "sh", "-c", "exit 3"}, 5); code != 3 {
+		t.Errorf("expected the command's exit code, got %d", code)
+	}
+	if on, puts := agent.lastPut(); on || puts != 2 {
+		t.Errorf("expected protection on and then off, got %d puts ending with %t", puts, on)
+	}
+	if code := execProtected([]string{"hypatia-no-such-command"}, 5); code != 127 {
+		t.Errorf("expected a missing command to exit 127, got %d", code)
+	}
+	if on, _ := agent.lastPut(); on {
+		t.Error("expected protection off after the command failed to start")
+	}
+	if code := execProtected(nil, 5); code != exitUsage {
+		t.Errorf("expected no command to be a usage error, got %d", code)
+	}
+
+	agent.m.Lock()
+	agent.failPut = true
+	agent.m.Unlock()
+	ran := filepath.Join(t.TempDir(), "ran")
+	if code := execProtected([]string{"touch", ran}, 5); code != exitFailed {
+		t.Errorf("expected a refused protection to fail, got %d", code)
+	}
+	if _, err := os.Stat(ran); err == nil {
+		t.Error("expected the command not to run without protection")
+	}
+}
+
+func TestRenewLapsed(t *testing.T) {
+	agent := newFakeAgent(t)
+	r := &renewer{tp: newClient(), protection: protection(true, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))}
+	agent.m.Lock()
+	agent.failPut = true
+	agent.m.Unlock()
+	if next := r.renew(); r.lapsed || next < time.Minute {
+		t.Errorf("expected a failed renewal to keep the old protection, got lapsed=%t next=%s", r.lapsed, next)
+	}
+
+	r.protection = protection(true, time.Now().Add(-time.Minute).UTC().Format(time.RFC3339))
+	if next := r.renew(); !r.lapsed || next != minRenew {
+		t.Errorf("expected protection to have lapsed and be retried, got lapsed=%t next=%s", r.lapsed, next)
+	}
+
+	agent.m.Lock()
+	agent.failPut = false
+	agent.m.Unlock()
+	if r.renew(); r.lapsed || expiresIn(r.protection) == 0 {
+		t.Errorf("expected protection to be back on, got %+v", r.protection)
+	}
+}
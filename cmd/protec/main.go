@@ -1,64 +1,230 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/petderek/hypatia"
 	"io"
 	"log"
+	"math"
+	"net/http"
 	"os"
+	"time"
 )
 
+const usage = `usage: protec [flags] [command]
+
+commands:
+  get               show task protection (the default)
+  on                turn task protection on, for -minutes if set
+  off               turn task protection off
+  wait-unprotected  block until protection is off or expires, for at most -timeout
+  expires-in        print the seconds until protection expires, 0 if unprotected and -1 if it never expires
+  exec -- cmd args  run a command with protection on, renewing it until the command exits and turning it off
+                    after. exits with the command's code
+
+exit codes:
+  0  success
+  1  the agent couldn't get or change protection
+  2  invalid input
+  3  the agent couldn't be reached
+  4  still protected when -timeout ran out
+
+flags:
+`
+
+const (
+	exitFailed      = 1
+	exitUsage       = 2
+	exitUnreachable = 3
+	exitTimeout     = 4
+
+	requestTimeout = 10 * time.Second
+	forever        = time.Duration(math.MaxInt64)
+)
+
+var (
+	errUsage   = errors.New("invalid input")
+	errTimeout = errors.New("still protected")
+)
+
+// result is what protec prints, as key=value pairs or json.
+type result struct {
+	ProtectionEnabled bool   `json:"protectionEnabled"`
+	ExpirationDate    string `json:"expirationDate,omitempty"`
+	ExpiresInSeconds  *int   `json:"expiresInSeconds,omitempty"`
+	TaskArn           string `json:"taskArn,omitempty"`
+	Error             string `json:"error,omitempty"`
+	ExitCode          int    `json:"exitCode,omitempty"`
+}
+
 func init() {
 	log.SetOutput(io.Discard)
 	log.SetFlags(0)
 }
+
 func main() {
-	flagMinutes := flag.Int("minutes", 0, "number of minutes to be protected")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flagMinutes := flag.Int("minutes", 0, "number of minutes to be protected. 0 uses the agent's default")
+	output := flag.String("o", "text", "output format: text or json")
+	timeout := flag.Duration("timeout", 0, "how long wait-unprotected waits. 0 waits forever")
+	interval := flag.Duration("interval", 5*time.Second, "how often wait-unprotected checks protection")
 	verbose := flag.Bool("v", false, "verbose logs")
 	flag.Parse()
 	if *verbose {
 		log.SetOutput(os.Stderr)
 	}
-	signal := flag.Arg(0)
-	log.Printf("using command [%s] with minutes [%d]. 0 minutes uses default\n", signal, flagMinutes)
-	tp := &hypatia.TaskProtectionClient{}
-	var protection *hypatia.Protection
+	command := flag.Arg(0)
+	log.Printf("using command [%s] with minutes [%d]. 0 minutes uses default\n", command, *flagMinutes)
+
+	var out result
 	var err error
+	switch {
+	case *output != "text" && *output != "json":
+		err = fmt.Errorf("%w: unknown output format %q", errUsage, *output)
+		*output = "text"
+	case flag.NArg() > 1 && command != "exec":
+		err = fmt.Errorf("%w: unexpected arguments %v", errUsage, flag.Args()[1:])
+	case *flagMinutes < 0:
+		err = fmt.Errorf("%w: -minutes must not be negative", errUsage)
+	case *interval <= 0:
+		err = fmt.Errorf("%w: -interval must be positive", errUsage)
+	case command == "exec":
+		os.Exit(execProtected(flag.Args()[1:], *flagMinutes))
+	default:
+		out, err = run(command, *flagMinutes, *timeout, *interval)
+	}
+	if err != nil {
+		out.Error = err.Error()
+		out.ExitCode = exitCode(err)
+	}
+	report(out, command, *output)
+	if errors.Is(err, errUsage) && *output == "text" {
+		flag.Usage()
+	}
+	os.Exit(out.ExitCode)
+}
 
-	switch signal {
+func run(command string, minutes int, timeout, interval time.Duration) (result, error) {
+	tp := newClient()
+	var protection *hypatia.Protection
+	var err error
+	switch command {
 	case "on":
-		var minutes *int
-		if *flagMinutes != 0 {
-			minutes = flagMinutes
+		var m *int
+		if minutes != 0 {
+			m = &minutes
 		}
-		protection, err = tp.Put(true, minutes)
+		protection, err = tp.Put(true, m)
 	case "off":
 		protection, err = tp.Put(false, nil)
-	default:
+	case "", "get", "expires-in":
 		protection, err = tp.Get()
+	case "wait-unprotected":
+		protection, err = waitUnprotected(tp, timeout, interval)
+	default:
+		return result{}, fmt.Errorf("%w: unknown command %q", errUsage, command)
 	}
+	if protection == nil {
+		return result{}, err
+	}
+	out := result{
+		ProtectionEnabled: protection.ProtectionEnabled != nil && *protection.ProtectionEnabled,
+		ExpirationDate:    deref(protection.ExpirationDate),
+		TaskArn:           deref(protection.TaskArn),
+	}
+	left := -1
+	if d := expiresIn(protection); d != forever {
+		left = int(d.Seconds())
+	}
+	out.ExpiresInSeconds = &left
+	return out, err
+}
+
+func newClient() *hypatia.TaskProtectionClient {
+	return &hypatia.TaskProtectionClient{Client: &http.Client{Timeout: requestTimeout}}
+}
+
+// waitUnprotected polls until protection is off or has expired. On timeout it returns the last protection it saw.
+func waitUnprotected(tp *hypatia.TaskProtectionClient, timeout, interval time.Duration) (*hypatia.Protection, error) {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+	for {
+		protection, err := tp.Get()
+		if err != nil || expiresIn(protection) == 0 {
+			return protection, err
+		}
+		log.Println("still protected until ", deref(protection.ExpirationDate))
+		wait := min(interval, expiresIn(protection))
+		select {
+		case <-deadline:
+			return protection, errTimeout
+		case <-time.After(wait):
+		}
+	}
+}
 
+// expiresIn is how long protection has left, zero if it's off or expired. Protection the agent gives no expiry
+// for counts as never expiring.
+func expiresIn(p *hypatia.Protection) time.Duration {
+	if p.ProtectionEnabled == nil || !*p.ProtectionEnabled {
+		return 0
+	}
+	if p.ExpirationDate == nil {
+		return forever
+	}
+	expiry, err := time.Parse(time.RFC3339, *p.ExpirationDate)
 	if err != nil {
-		fmt.Println("error: ", err)
-		os.Exit(1)
+		log.Println("unreadable expiration date: ", err)
+		return forever
 	}
-	fmt.Println("success: ", safeB(protection.ProtectionEnabled), safeS(protection.ExpirationDate), safeS(protection.TaskArn))
+	return max(time.Until(expiry), 0)
 }
 
-func safeS(s *string) string {
-	if s == nil {
-		return "<nil>"
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case errors.Is(err, hypatia.ErrAgentUnreachable):
+		return exitUnreachable
+	case errors.Is(err, errTimeout):
+		return exitTimeout
+	default:
+		return exitFailed
 	}
-	return *s
 }
 
-func safeB(b *bool) string {
-	if b == nil {
-		return "<nil>"
+// report writes the result to stdout. Text is key=value pairs on one line, except expires-in, which is just the
+// seconds. Errors go to stderr in text mode, and stay in the object in json mode.
+func report(out result, command, output string) {
+	if output == "json" {
+		data, _ := json.Marshal(&out)
+		fmt.Println(string(data))
+		return
+	}
+	if out.Error != "" {
+		fmt.Fprintln(os.Stderr, "error: ", out.Error)
+		if out.TaskArn == "" {
+			return
+		}
+	}
+	if command == "expires-in" {
+		fmt.Println(*out.ExpiresInSeconds)
+		return
 	}
-	if *b {
-		return "true"
+	fmt.Printf("enabled=%t expires=%s task=%s\n", out.ProtectionEnabled, out.ExpirationDate, out.TaskArn)
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
 	}
-	return "false"
+	return *s
 }
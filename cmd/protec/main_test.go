@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/petderek/hypatia"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAgent is the agent's task protection endpoint, remembering every PUT.
+type fakeAgent struct {
+	*httptest.Server
+	m       sync.Mutex
+	enabled bool
+	expiry  string
+	puts    []bool
+	failPut bool
+}
+
+func newFakeAgent(t *testing.T) *fakeAgent {
+	agent := &fakeAgent{}
+	agent.Server = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		agent.m.Lock()
+		defer agent.m.Unlock()
+		if req.Method == http.MethodPut {
+			var input hypatia.TaskProtectionRequest
+			json.NewDecoder(req.Body).Decode(&input)
+			agent.puts = append(agent.puts, *input.ProtectionEnabled)
+			if agent.failPut {
+				res.WriteHeader(http.StatusBadRequest)
+				res.Write([]byte(`{"failure":{"Arn":"arn","Reason":"TASK_NOT_VALID","Detail":"not in a service"}}`))
+				return
+			}
+			agent.enabled, agent.expiry = *input.ProtectionEnabled, ""
+			if agent.enabled {
+				minutes := 120
+				if input.ExpiresInMinutes != nil {
+					minutes = *input.ExpiresInMinutes
+				}
+				agent.expiry = time.Now().Add(time.Duration(minutes) * time.Minute).UTC().Format(time.RFC3339)
+			}
+		}
+		expiry := "null"
+		if agent.expiry != "" {
+			expiry = `"` + agent.expiry + `"`
+		}
+		fmt.Fprintf(res, `{"protection":{"ExpirationDate":%s,"ProtectionEnabled":%t,"TaskArn":"arn:aws:ecs:us-west-2:012:task/default/cafe"}}`, expiry, agent.enabled)
+	}))
+	t.Cleanup(agent.Close)
+	t.Setenv("ECS_AGENT_URI", agent.URL)
+	return agent
+}
+
+func (a *fakeAgent) set(enabled bool, expiry time.Time) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.enabled, a.expiry = enabled, expiry.UTC().Format(time.RFC3339)
+}
+
+func (a *fakeAgent) lastPut() (bool, int) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if len(a.puts) == 0 {
+		return false, 0
+	}
+	return a.puts[len(a.puts)-1], len(a.puts)
+}
+
+func protection(enabled bool, expiry string) *hypatia.Protection {
+	p := &hypatia.Protection{ProtectionEnabled: &enabled}
+	if expiry != "" {
+		p.ExpirationDate = &expiry
+	}
+	return p
+}
+
+func TestExpiresIn(t *testing.T) {
+	soon := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	for name, tc := range map[string]struct {
+		p        *hypatia.Protection
+		min, max time.Duration
+	}{
+		"off":        {protection(false, soon), 0, 0},
+		"unknown":    {&hypatia.Protection{}, 0, 0},
+		"expired":    {protection(true, past), 0, 0},
+		"no expiry":  {protection(true, ""), forever, forever},
+		"unreadable": {protection(true, "soon"), forever, forever},
+		"protected":  {protection(true, soon), 59 * time.Minute, time.Hour},
+	} {
+		if left := expiresIn(tc.p); left < tc.min || left > tc.max {
+			t.Errorf("%s: expected between %s and %s, got %s", name, tc.min, tc.max, left)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code int
+	}{
+		{fmt.Errorf("%w: nope", errUsage), exitUsage},
+		{fmt.Errorf("%w: refused", hypatia.ErrAgentUnreachable), exitUnreachable},
+		{errTimeout, exitTimeout},
+		{fmt.Errorf("%w: TASK_NOT_VALID", hypatia.ErrProtectionFailed), exitFailed},
+		{errors.New("anything else"), exitFailed},
+	} {
+		if got := exitCode(tc.err); got != tc.code {
+			t.Errorf("%v: expected exit code %d, got %d", tc.err, tc.code, got)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	agent := newFakeAgent(t)
+	out, err := run("on", 5, 0, time.Second)
+	if err != nil || !out.ProtectionEnabled || out.ExpiresInSeconds == nil || *out.ExpiresInSeconds < 290 {
+		t.Errorf("expected five minutes of protection, got %+v %v", out, err)
+	}
+	if on, _ := agent.lastPut(); !on {
+		t.Error("expected protection to be turned on")
+	}
+	if out, err := run("off", 0, 0, time.Second); err != nil || out.ProtectionEnabled || *out.ExpiresInSeconds != 0 {
+		t.Errorf("expected protection off, got %+v %v", out, err)
+	}
+	if _, err := run("nope", 0, 0, time.Second); exitCode(err) != exitUsage {
+		t.Errorf("expected an unknown command to be a usage error, got %v", err)
+	}
+
+	agent.m.Lock()
+	agent.failPut = true
+	agent.m.Unlock()
+	if _, err := run("on", 0, 0, time.Second); exitCode(err) != exitFailed {
+		t.Errorf("expected a refused change to fail, got %v", err)
+	}
+	agent.Close()
+	if _, err := run("get", 0, 0, time.Second); exitCode(err) != exitUnreachable {
+		t.Errorf("expected the agent to be unreachable, got %v", err)
+	}
+}
+
+func TestWaitUnprotected(t *testing.T) {
+	agent := newFakeAgent(t)
+	agent.set(true, time.Now().Add(time.Hour))
+	p, err := waitUnprotected(newClient(), 30*time.Millisecond, 5*time.Millisecond)
+	if !errors.Is(err, errTimeout) || p == nil || expiresIn(p) == 0 {
+		t.Errorf("expected to time out still protected, got %+v %v", p, err)
+	}
+
+	time.AfterFunc(20*time.Millisecond, func() { agent.set(false, time.Time{}) })
+	if p, err := waitUnprotected(newClient(), 0, 5*time.Millisecond); err != nil || expiresIn(p) != 0 {
+		t.Errorf("expected to wait until protection is off, got %+v %v", p, err)
+	}
+
+	// expiring counts as unprotected, without waiting for the next check
+	agent.set(true, time.Now().Add(time.Second))
+	start := time.Now()
+	if _, err := waitUnprotected(newClient(), 0, time.Hour); err != nil || time.Since(start) > 3*time.Second {
+		t.Errorf("expected to wait for protection to expire, got %v after %s", err, time.Since(start))
+	}
+
+	agent.Close()
+	if _, err := waitUnprotected(newClient(), 0, time.Millisecond); exitCode(err) != exitUnreachable {
+		t.Errorf("expected the agent to be unreachable, got %v", err)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// forwarded are the signals exec passes on to the command. Elsewhere only an interrupt can be.
+var forwarded = []os.Signal{os.Interrupt}
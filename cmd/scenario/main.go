@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/petderek/hypatia/client"
+	"github.com/petderek/hypatia/scenario"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const usage = `usage: scenario [flags] <plan.yaml>
+
+runs a deployment scenario plan against a hypatia server and prints a timeline report.
+exits 1 if any step failed and 2 if the plan is invalid.
+
+flags:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	addr := flag.String("addr", os.Getenv("HYPATIA_ADDR"), "hypatia server address, overrides the plan's endpoint. also HYPATIA_ADDR")
+	token := flag.String("token", os.Getenv("HYPATIA_TOKEN"), "bearer token for writes. also HYPATIA_TOKEN")
+	secret := flag.String("hmac-secret", os.Getenv("HYPATIA_HMAC_SECRET"), "secret to sign writes with. also HYPATIA_HMAC_SECRET")
+	output := flag.String("o", "markdown", "report format on stdout: markdown or json")
+	jsonOut := flag.String("json", "", "also write the json report to this file")
+	markdownOut := flag.String("markdown", "", "also write the markdown report to this file")
+	timeout := flag.Duration("timeout", 0, "give up on the whole scenario after this long, 0 runs until done")
+	requestTimeout := flag.Duration("request-timeout", 10*time.Second, "timeout for each request")
+	quiet := flag.Bool("q", false, "don't print progress as steps finish")
+	flag.Parse()
+	if flag.NArg() != 1 || (*output != "markdown" && *output != "json") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	plan, err := scenario.LoadPlan(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid plan: ", err)
+		os.Exit(2)
+	}
+	endpoint := plan.Endpoint
+	if *addr != "" {
+		endpoint = *addr
+	}
+	if endpoint == "" {
+		endpoint = "http://localhost:8000"
+	}
+	c, err := client.New(endpoint)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bad address: ", err)
+		os.Exit(2)
+	}
+	c.Token = *token
+	c.HMACSecret = []byte(*secret)
+	c.HTTPClient = &http.Client{Timeout: *requestTimeout}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	runner := &scenario.Runner{Client: c}
+	if !*quiet {
+		runner.Progress = func(s scenario.StepResult) {
+			result := "ok"
+			if !s.Passed() {
+				result = "FAILED"
+			}
+			fmt.Fprintf(os.Stderr, "step %d/%d %s: %s in %s\n", s.Index, len(plan.Steps), s.Name, result,
+				time.Duration(s.Duration).Truncate(time.Millisecond))
+		}
+	}
+	report, runErr := runner.Run(ctx, plan)
+
+	if *jsonOut != "" {
+		if err := writeFile(*jsonOut, report, writeJSON); err != nil {
+			fmt.Fprintln(os.Stderr, "unable to write json report: ", err)
+		}
+	}
+	if *markdownOut != "" {
+		if err := writeFile(*markdownOut, report, (*scenario.Report).WriteMarkdown); err != nil {
+			fmt.Fprintln(os.Stderr, "unable to write markdown report: ", err)
+		}
+	}
+	if *output == "json" {
+		writeJSON(report, os.Stdout)
+	} else {
+		report.WriteMarkdown(os.Stdout)
+	}
+	if runErr != nil {
+		fmt.Fprintln(os.Stderr, "error: ", runErr)
+		os.Exit(1)
+	}
+}
+
+func writeJSON(report *scenario.Report, w io.Writer) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+func writeFile(path string, report *scenario.Report, write func(*scenario.Report, io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(report, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,581 @@
+package hypatia
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"gopkg.in/yaml.v3"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const envPrefix = "HYPATIA_"
+
+// Duration is a time.Duration that reads and writes as a string like "5s" in json and yaml.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations must be strings like \"5s\": %s", data)
+	}
+	parsed, err := time.ParseDuration(s)
+	*d = Duration(parsed)
+	return err
+}
+
+// Config describes everything cmd/hypatia can set up. It is loaded from defaults, then a yaml or json file, then
+// HYPATIA_* environment variables, then flags. Environment variables are named after the json path, so
+// proxy.dialTimeout is HYPATIA_PROXY_DIAL_TIMEOUT. Lists are comma separated, and HYPATIA_HEALTH is a list of
+// name=file.
+type Config struct {
+	Address      string       `json:"address"`
+	Writeable    bool         `json:"writeable"`
+	LocalHealth  HealthConfig `json:"localHealth"`
+	RemoteHealth HealthConfig `json:"remoteHealth"`
+	// Health names any other healthchecks, like readiness or alb. A missing file defaults to {name}.status.
+	Health map[string]HealthConfig `json:"health,omitempty"`
+	// PingSlots are the healthchecks /ping reports, all of which have to be healthy.
+	PingSlots            []string               `json:"pingSlots"`
+	TaskProtection       TaskProtectionConfig   `json:"taskProtection"`
+	ServiceDiscovery     ServiceDiscoveryConfig `json:"serviceDiscovery"`
+	Proxy                ProxyConfig            `json:"proxy"`
+	Balancer             BalancerConfig         `json:"balancer"`
+	NeighborPollInterval Duration               `json:"neighborPollInterval"`
+	HealthWatchInterval  Duration               `json:"healthWatchInterval"`
+	Auth                 AuthConfig             `json:"auth"`
+	TLS                  TLSConfig              `json:"tls"`
+	Events               EventsConfig           `json:"events"`
+	State                StateConfig            `json:"state"`
+	Instance             InstanceConfig         `json:"instance"`
+	Spot                 SpotConfig             `json:"spot"`
+}
+
+type HealthConfig struct {
+	File string `json:"file"`
+	// MaxAge fails the check once the file hasn't been written for that long. Zero never expires.
+	MaxAge Duration `json:"maxAge"`
+	// Extended writes a status, reason and time into the file rather than only creating and removing it.
+	Extended bool `json:"extended"`
+}
+
+type TaskProtectionConfig struct {
+	// Stub fakes the agent endpoint in memory, for running outside of ecs.
+	Stub    bool     `json:"stub"`
+	StubArn string   `json:"stubArn"`
+	Timeout Duration `json:"timeout"`
+	// AgentURI overrides ECS_AGENT_URI.
+	AgentURI string `json:"agentUri"`
+}
+
+type ServiceDiscoveryConfig struct {
+	Disabled bool   `json:"disabled"`
+	Service  string `json:"service"`
+	Cluster  string `json:"cluster"`
+	Scheme   string `json:"scheme"`
+	// InstanceTTL, AddressTTL and NegativeTTL bound how long container instances, ec2 addresses and failed lookups
+	// are cached.
+	InstanceTTL Duration `json:"instanceTtl"`
+	AddressTTL  Duration `json:"addressTtl"`
+	NegativeTTL Duration `json:"negativeTtl"`
+	// CacheDir keeps lookups on disk. Sidecars on a host can share one through a mounted volume.
+	CacheDir string `json:"cacheDir"`
+}
+
+type ProxyConfig struct {
+	DialTimeout           Duration `json:"dialTimeout"`
+	ResponseHeaderTimeout Duration `json:"responseHeaderTimeout"`
+	Timeout               Duration `json:"timeout"`
+	MaxHops               int      `json:"maxHops"`
+	CA                    string   `json:"ca"`
+	Insecure              bool     `json:"insecure"`
+}
+
+type BalancerConfig struct {
+	Strategy   string   `json:"strategy"`
+	HashHeader string   `json:"hashHeader"`
+	HealthTTL  Duration `json:"healthTtl"`
+}
+
+type AuthConfig struct {
+	Tokens         []string `json:"tokens,omitempty"`
+	TokensFile     string   `json:"tokensFile"`
+	HMACSecret     string   `json:"hmacSecret,omitempty"`
+	HMACSecretFile string   `json:"hmacSecretFile"`
+	CIDRs          []string `json:"cidrs,omitempty"`
+}
+
+type TLSConfig struct {
+	Cert           string   `json:"cert"`
+	Key            string   `json:"key"`
+	ClientCA       string   `json:"clientCa"`
+	ReloadInterval Duration `json:"reloadInterval"`
+}
+
+type EventsConfig struct {
+	// History is how many events /events replays to a reconnecting client.
+	History int `json:"history"`
+	// File appends every event to a jsonl file.
+	File string `json:"file"`
+}
+
+type StateConfig struct {
+	// Dir is where relative health, state and event files live, so they don't depend on the working directory of
+	// whoever starts hypatia. Defaults to the working directory at startup.
+	Dir string `json:"dir"`
+	// File saves health, protection and stress across restarts. Empty keeps them in memory.
+	File string `json:"file"`
+	// Fresh ignores the saved state at startup and overwrites it.
+	Fresh bool `json:"fresh"`
+}
+
+type InstanceConfig struct {
+	// Endpoint overrides the IMDS endpoint, e.g. to point at a fake.
+	Endpoint string `json:"endpoint"`
+	// Refresh is how often the instance is read again.
+	Refresh Duration `json:"refresh"`
+}
+
+type SpotConfig struct {
+	// Disabled stops watching IMDS for spot notices. Off ec2 the watch costs nothing.
+	Disabled bool     `json:"disabled"`
+	Interval Duration `json:"interval"`
+	// Interruption and Rebalance are what to do about each notice, beyond publishing an event.
+	Interruption SpotReaction `json:"interruption"`
+	Rebalance    SpotReaction `json:"rebalance"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Address:             ":8000",
+		Writeable:           true,
+		LocalHealth:         HealthConfig{File: "local.status"},
+		RemoteHealth:        HealthConfig{File: "remote.status"},
+		HealthWatchInterval: Duration(2 * time.Second),
+		PingSlots:           []string{HealthRemote},
+		TaskProtection: TaskProtectionConfig{
+			StubArn: "arn:aws:ecs:us-west-2:0123456789:task/foo",
+		},
+		ServiceDiscovery: ServiceDiscoveryConfig{Scheme: "http"},
+		Balancer:         BalancerConfig{Strategy: BalanceRoundRobin},
+		TLS:              TLSConfig{ReloadInterval: Duration(time.Minute)},
+		Events:           EventsConfig{History: defaultEventHistory},
+		State:            StateConfig{File: "hypatia.state.json"},
+		Instance:         InstanceConfig{Refresh: Duration(defaultInstanceRefresh)},
+		Spot: SpotConfig{
+			Interval:     Duration(defaultSpotInterval),
+			Interruption: SpotReaction{RemoteUnhealthy: true, DropProtection: true},
+		},
+	}
+}
+
+// Path resolves file against state.dir, so every process agrees on where it is. Empty stays empty.
+func (c *Config) Path(file string) (string, error) {
+	if file == "" || filepath.IsAbs(file) {
+		return file, nil
+	}
+	return filepath.Abs(filepath.Join(c.State.Dir, file))
+}
+
+// LoadFile merges a yaml or json file into the config. Fields missing from the file are left alone, and unknown
+// fields are an error.
+func (c *Config) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		// yaml goes through json so both formats share the json tags
+		var raw any
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if data, err = json.Marshal(raw); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// LoadEnv merges HYPATIA_* variables from lookup, typically os.LookupEnv, into the config.
+func (c *Config) LoadEnv(lookup func(string) (string, bool)) error {
+	return loadEnv(reflect.ValueOf(c).Elem(), envPrefix, lookup)
+}
+
+func loadEnv(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		key := prefix + envName(name)
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			if err := loadEnv(fv, key+"_", lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		raw, ok := lookup(key)
+		if !ok {
+			continue
+		}
+		if err := setField(fv, raw); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// envName turns a json name like dialTimeout into DIAL_TIMEOUT.
+func envName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) && i > 0 && !unicode.IsUpper(rune(name[i-1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+func setField(fv reflect.Value, raw string) error {
+	switch fv.Interface().(type) {
+	case Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		fv.Set(reflect.ValueOf(Duration(d)))
+		return nil
+	case []string:
+		var list []string
+		for _, s := range strings.Split(raw, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+		fv.Set(reflect.ValueOf(list))
+		return nil
+	case map[string]HealthConfig:
+		if fv.IsNil() {
+			fv.Set(reflect.ValueOf(make(map[string]HealthConfig)))
+		}
+		for name, h := range ParseHealthList(raw) {
+			fv.SetMapIndex(reflect.ValueOf(name), reflect.ValueOf(h))
+		}
+		return nil
+	}
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(int64(n))
+	default:
+		return fmt.Errorf("unsupported type %s", fv.Type())
+	}
+	return nil
+}
+
+// ParseHealthList reads named healthchecks written as comma separated name=file, or name for name.status.
+func ParseHealthList(list string) map[string]HealthConfig {
+	health := make(map[string]HealthConfig)
+	for _, item := range strings.Split(list, ",") {
+		if name, file, _ := strings.Cut(strings.TrimSpace(item), "="); name != "" {
+			health[name] = HealthConfig{File: file}
+		}
+	}
+	return health
+}
+
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Address == "" {
+		errs = append(errs, errors.New("address is required"))
+	}
+	if !ValidBalanceStrategy(c.Balancer.Strategy) {
+		errs = append(errs, fmt.Errorf("balancer.strategy: unknown strategy %q", c.Balancer.Strategy))
+	}
+	if c.Balancer.Strategy == BalanceHash && c.Balancer.HashHeader == "" {
+		errs = append(errs, errors.New("balancer.hashHeader is required for the hash strategy"))
+	}
+	if s := c.ServiceDiscovery.Scheme; s != "" && s != "http" && s != "https" {
+		errs = append(errs, fmt.Errorf("serviceDiscovery.scheme: must be http or https, got %q", s))
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		errs = append(errs, errors.New("tls.cert and tls.key must be set together"))
+	}
+	if c.TLS.ClientCA != "" && c.TLS.Cert == "" {
+		errs = append(errs, errors.New("tls.clientCa requires tls.cert"))
+	}
+	if c.TaskProtection.AgentURI != "" {
+		if _, err := url.Parse(c.TaskProtection.AgentURI); err != nil {
+			errs = append(errs, fmt.Errorf("taskProtection.agentUri: %w", err))
+		}
+	}
+	if _, err := ParseCIDRs(strings.Join(c.Auth.CIDRs, ",")); err != nil {
+		errs = append(errs, fmt.Errorf("auth.cidrs: %w", err))
+	}
+	if c.Proxy.MaxHops < 0 {
+		errs = append(errs, errors.New("proxy.maxHops must not be negative"))
+	}
+	if c.Instance.Endpoint != "" {
+		if _, err := url.Parse(c.Instance.Endpoint); err != nil {
+			errs = append(errs, fmt.Errorf("instance.endpoint: %w", err))
+		}
+	}
+	for name := range c.Health {
+		switch {
+		case name == HealthLocal || name == HealthRemote:
+			errs = append(errs, fmt.Errorf("health.%s: use %sHealth instead", name, name))
+		case name == "" || strings.ContainsAny(name, "/?#% "):
+			errs = append(errs, fmt.Errorf("health: %q is not a usable name", name))
+		case c.Health[name].MaxAge < 0:
+			errs = append(errs, fmt.Errorf("health.%s.maxAge must not be negative", name))
+		}
+	}
+	for _, name := range c.PingSlots {
+		if _, ok := c.Health[name]; !ok && name != HealthLocal && name != HealthRemote {
+			errs = append(errs, fmt.Errorf("pingSlots: no healthcheck named %q", name))
+		}
+	}
+	if c.Events.History < 0 {
+		errs = append(errs, errors.New("events.history must not be negative"))
+	}
+	for name, d := range map[string]Duration{
+		"neighborPollInterval":         c.NeighborPollInterval,
+		"healthWatchInterval":          c.HealthWatchInterval,
+		"localHealth.maxAge":           c.LocalHealth.MaxAge,
+		"remoteHealth.maxAge":          c.RemoteHealth.MaxAge,
+		"proxy.dialTimeout":            c.Proxy.DialTimeout,
+		"proxy.responseHeaderTimeout":  c.Proxy.ResponseHeaderTimeout,
+		"proxy.timeout":                c.Proxy.Timeout,
+		"balancer.healthTtl":           c.Balancer.HealthTTL,
+		"taskProtection.timeout":       c.TaskProtection.Timeout,
+		"tls.reloadInterval":           c.TLS.ReloadInterval,
+		"serviceDiscovery.instanceTtl": c.ServiceDiscovery.InstanceTTL,
+		"serviceDiscovery.addressTtl":  c.ServiceDiscovery.AddressTTL,
+		"serviceDiscovery.negativeTtl": c.ServiceDiscovery.NegativeTTL,
+		"instance.refresh":             c.Instance.Refresh,
+		"spot.interval":                c.Spot.Interval,
+	} {
+		if d < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Redacted is a copy that is safe to print, with inline secrets masked.
+func (c *Config) Redacted() *Config {
+	out := *c
+	if len(c.Auth.Tokens) > 0 {
+		out.Auth.Tokens = make([]string, len(c.Auth.Tokens))
+		for i := range out.Auth.Tokens {
+			out.Auth.Tokens[i] = "***"
+		}
+	}
+	if c.Auth.HMACSecret != "" {
+		out.Auth.HMACSecret = "***"
+	}
+	return &out
+}
+
+// NewServer builds a Server from the config. Service discovery and task protection that can't be set up yet are
+// logged rather than failing startup.
+func (c *Config) NewServer() (*Server, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	auth, err := c.Auth.build()
+	if err != nil {
+		return nil, err
+	}
+
+	var tp TaskProtectionIface
+	if c.TaskProtection.Stub {
+		tp = &TaskProtectionStub{Protection: &Protection{TaskArn: aws.String(c.TaskProtection.StubArn)}}
+	} else {
+		client := &TaskProtectionClient{Client: &http.Client{Timeout: time.Duration(c.TaskProtection.Timeout)}}
+		if c.TaskProtection.AgentURI != "" {
+			client.Location, _ = url.Parse(c.TaskProtection.AgentURI + "/task-protection/v1/state")
+		}
+		if err := client.init(); err != nil {
+			log.Println("task protection not ready, will retry: ", err)
+		}
+		tp = client
+	}
+
+	var paths [5]string
+	for i, file := range []string{c.LocalHealth.File, c.RemoteHealth.File, c.State.File, c.Events.File, c.ServiceDiscovery.CacheDir} {
+		if paths[i], err = c.Path(file); err != nil {
+			return nil, err
+		}
+	}
+	local, remote, stateFile, eventsFile, cacheDir := paths[0], paths[1], paths[2], paths[3], paths[4]
+	log.Printf("local health %s, remote health %s, state %s\n", local, remote, stateFile)
+
+	srv := &Server{
+		Protection:                 tp,
+		Metadata:                   tp,
+		LocalHealth:                c.LocalHealth.build(local),
+		RemoteHealth:               c.RemoteHealth.build(remote),
+		Writeable:                  c.Writeable,
+		Auth:                       auth,
+		ProxyDialTimeout:           time.Duration(c.Proxy.DialTimeout),
+		ProxyResponseHeaderTimeout: time.Duration(c.Proxy.ResponseHeaderTimeout),
+		ProxyTimeout:               time.Duration(c.Proxy.Timeout),
+		MaxProxyHops:               c.Proxy.MaxHops,
+		Balancer: &Balancer{
+			Strategy:   c.Balancer.Strategy,
+			HashHeader: c.Balancer.HashHeader,
+			HealthTTL:  time.Duration(c.Balancer.HealthTTL),
+		},
+		PingSlots:            c.PingSlots,
+		NeighborPollInterval: time.Duration(c.NeighborPollInterval),
+		HealthWatchInterval:  time.Duration(c.HealthWatchInterval),
+		Events:               NewEventBus(c.Events.History),
+		Instance:             &InstanceContext{Endpoint: c.Instance.Endpoint, Refresh: time.Duration(c.Instance.Refresh)},
+	}
+	if !c.Spot.Disabled {
+		srv.Spot = &SpotWatch{
+			Interval:     time.Duration(c.Spot.Interval),
+			Interruption: c.Spot.Interruption,
+			Rebalance:    c.Spot.Rebalance,
+		}
+	}
+	for name, h := range c.Health {
+		if h.File == "" {
+			h.File = name + ".status"
+		}
+		path, err := c.Path(h.File)
+		if err != nil {
+			return nil, err
+		}
+		if srv.Health == nil {
+			srv.Health = make(map[string]HealthCheck)
+		}
+		hc := h.build(path)
+		srv.Health[name] = &hc
+		log.Printf("%s health %s\n", name, path)
+	}
+	if eventsFile != "" {
+		f, err := OpenEventLog(eventsFile)
+		if err != nil {
+			return nil, fmt.Errorf("events.file: %w", err)
+		}
+		srv.Events.Log = f
+	}
+	if c.Proxy.CA != "" || c.Proxy.Insecure {
+		srv.ProxyTLSConfig = &tls.Config{InsecureSkipVerify: c.Proxy.Insecure}
+		if c.Proxy.CA != "" {
+			if srv.ProxyTLSConfig.RootCAs, err = LoadCertPool(c.Proxy.CA); err != nil {
+				return nil, fmt.Errorf("proxy.ca: %w", err)
+			}
+		}
+	}
+	if stateFile != "" {
+		srv.State = &FileStateStore{Path: stateFile}
+	} else {
+		srv.State = &MemoryStateStore{}
+	}
+	if c.State.Fresh {
+		log.Println("ignoring saved state")
+		srv.ResetState()
+	} else if err := srv.RestoreState(); err != nil {
+		log.Println("unable to restore state: ", err)
+	}
+	if !c.ServiceDiscovery.Disabled {
+		if sd, err := NewServiceDiscovery(c.ServiceDiscovery.Service, c.ServiceDiscovery.Cluster); err == nil {
+			sd.Scheme = c.ServiceDiscovery.Scheme
+			sd.InstanceTTL = time.Duration(c.ServiceDiscovery.InstanceTTL)
+			sd.AddressTTL = time.Duration(c.ServiceDiscovery.AddressTTL)
+			sd.NegativeTTL = time.Duration(c.ServiceDiscovery.NegativeTTL)
+			sd.CacheDir = cacheDir
+			srv.ServiceDiscovery = sd
+		} else {
+			log.Println("service discovery disabled: ", err)
+		}
+	}
+	return srv, nil
+}
+
+func (h *HealthConfig) build(path string) FileHealthcheck {
+	return FileHealthcheck{Filepath: path, MaxAge: time.Duration(h.MaxAge), Extended: h.Extended}
+}
+
+// build requires the request to come from an allowed network, if any are set, and to carry any one of the configured
+// credentials.
+func (a *AuthConfig) build() (Authenticator, error) {
+	var credentials AnyOf
+	tokens := append([]string{}, a.Tokens...)
+	if a.TokensFile != "" {
+		t, err := LoadTokens(a.TokensFile)
+		if err != nil {
+			return nil, fmt.Errorf("auth.tokensFile: %w", err)
+		}
+		tokens = append(tokens, t...)
+	}
+	if len(tokens) > 0 {
+		credentials = append(credentials, &TokenAuth{Tokens: tokens})
+	}
+	secret := []byte(a.HMACSecret)
+	if a.HMACSecretFile != "" {
+		data, err := os.ReadFile(a.HMACSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("auth.hmacSecretFile: %w", err)
+		}
+		secret = bytes.TrimSpace(data)
+	}
+	if len(secret) > 0 {
+		credentials = append(credentials, &HMACAuth{Secret: secret})
+	}
+
+	var auth AllOf
+	if len(a.CIDRs) > 0 {
+		nets, err := ParseCIDRs(strings.Join(a.CIDRs, ","))
+		if err != nil {
+			return nil, fmt.Errorf("auth.cidrs: %w", err)
+		}
+		auth = append(auth, &CIDRAuth{Allowed: nets})
+	}
+	if len(credentials) > 0 {
+		auth = append(auth, credentials)
+	}
+	if len(auth) == 0 {
+		return nil, nil
+	}
+	return auth, nil
+}
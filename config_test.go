@@ -0,0 +1,112 @@
+package hypatia
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigLoad(t *testing.T) {
+	dir := t.TempDir()
+	yamlFile := filepath.Join(dir, "hypatia.yaml")
+	os.WriteFile(yamlFile, []byte("address: \":9000\"\nproxy:\n  dialTimeout: 3s\n  maxHops: 2\nauth:\n  tokens: [potat]\n"), 0644)
+	cfg := DefaultConfig()
+	if err := cfg.LoadFile(yamlFile); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Address != ":9000" || cfg.Proxy.DialTimeout != Duration(3*time.Second) || cfg.Proxy.MaxHops != 2 {
+		t.Errorf("yaml not applied: %+v", cfg)
+	}
+	if cfg.LocalHealth.File != "local.status" {
+		t.Errorf("expected defaults to survive a partial file, got %q", cfg.LocalHealth.File)
+	}
+
+	env := map[string]string{
+		"HYPATIA_ADDRESS":            ":9001",
+		"HYPATIA_WRITEABLE":          "false",
+		"HYPATIA_PROXY_DIAL_TIMEOUT": "5s",
+		"HYPATIA_AUTH_CIDRS":         "10.0.0.0/8, 192.168.0.0/16",
+		"HYPATIA_AUTH_HMAC_SECRET":   "secret",
+		"HYPATIA_TLS_CLIENT_CA":      "ca.pem",
+		"HYPATIA_HEALTH":             "readiness=ready.status, alb",
+	}
+	err := cfg.LoadEnv(func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Address != ":9001" || cfg.Writeable || cfg.Proxy.DialTimeout != Duration(5*time.Second) ||
+		len(cfg.Auth.CIDRs) != 2 || cfg.Auth.HMACSecret != "secret" || cfg.TLS.ClientCA != "ca.pem" {
+		t.Errorf("env not applied: %+v", cfg)
+	}
+	if len(cfg.Health) != 2 || cfg.Health["readiness"].File != "ready.status" || cfg.Health["alb"].File != "" {
+		t.Errorf("expected named healthchecks from the env, got %+v", cfg.Health)
+	}
+	if cfg.Redacted().Auth.HMACSecret == "secret" || cfg.Auth.HMACSecret != "secret" {
+		t.Error("expected redacted copy to mask the secret without touching the original")
+	}
+
+	jsonFile := filepath.Join(dir, "hypatia.json")
+	os.WriteFile(jsonFile, []byte(`{"adress": ":1"}`), 0644)
+	if err := DefaultConfig().LoadFile(jsonFile); err == nil {
+		t.Error("expected unknown field to fail")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Error("expected defaults to be valid: ", err)
+	}
+	bad := DefaultConfig()
+	bad.Balancer.Strategy = BalanceHash
+	bad.TLS.Cert = "cert.pem"
+	bad.ServiceDiscovery.Scheme = "ftp"
+	bad.Auth.CIDRs = []string{"nope"}
+	if err := bad.Validate(); err == nil {
+		t.Error("expected invalid config to fail")
+	} else {
+		t.Log(err)
+	}
+
+	health := DefaultConfig()
+	health.Health = map[string]HealthConfig{"readiness": {}, "remote": {}, "a/b": {}}
+	health.PingSlots = []string{"remote", "alb"}
+	err := health.Validate()
+	for _, want := range []string{"health.remote", `"a/b"`, `pingSlots: no healthcheck named "alb"`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %s to be invalid, got %v", want, err)
+		}
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	for in, expected := range map[string]string{
+		"dialTimeout": "DIAL_TIMEOUT",
+		"hmacSecret":  "HMAC_SECRET",
+		"clientCa":    "CLIENT_CA",
+		"address":     "ADDRESS",
+	} {
+		if got := envName(in); got != expected {
+			t.Errorf("%s: expected %s, got %s", in, expected, got)
+		}
+	}
+}
+
+func TestConfigPath(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.State.Dir = "/var/lib/hypatia"
+	if p, _ := cfg.Path("local.status"); p != "/var/lib/hypatia/local.status" {
+		t.Errorf("expected the file under state.dir, got %q", p)
+	}
+	if p, _ := cfg.Path("/tmp/remote.status"); p != "/tmp/remote.status" {
+		t.Errorf("expected absolute paths to be left alone, got %q", p)
+	}
+	cfg.State.Dir = ""
+	if p, _ := cfg.Path("local.status"); !filepath.IsAbs(p) {
+		t.Errorf("expected the working directory to be made absolute, got %q", p)
+	}
+}
@@ -0,0 +1,302 @@
+package hypatia
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// compactMinRecords keeps small files from being compacted over and over.
+const compactMinRecords = 1024
+
+// DiskCache is a Cache that is also kept in an append-only file, so it survives restarts and can be shared by every
+// sidecar on a host through a mounted volume. Processes pick up each other's changes when they miss, and the file is
+// compacted once most of it is stale. Keys and values must encode as json.
+type DiskCache[K comparable, V any] struct {
+	path string
+	ttl  time.Duration
+	mem  *lruCache[K, V]
+	// m serializes this process, and lock, held with flock where there is one, serializes processes
+	m    sync.Mutex
+	lock *os.File
+	file *os.File
+	// offset is how much of file has been read, and records how many records that was
+	offset  int64
+	records int
+}
+
+type diskRecord[K comparable, V any] struct {
+	Key     K     `json:"k"`
+	Value   V     `json:"v,omitempty"`
+	Missing bool  `json:"m,omitempty"`
+	Deleted bool  `json:"d,omitempty"`
+	Expires int64 `json:"x,omitempty"`
+}
+
+// OpenDiskCache loads the cache at path, creating it if needed. opts bounds the entries held in memory, and so the
+// entries kept by compaction. Shards is ignored: every process shards differently, so only a single shard replays
+// another process's file in least recently used order.
+func OpenDiskCache[K comparable, V any](path string, opts CacheOptions) (*DiskCache[K, V], error) {
+	opts.Shards = 1
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	c := &DiskCache[K, V]{
+		path: path,
+		ttl:  opts.TTL,
+		mem:  NewCacheWith[K, V](opts).(*lruCache[K, V]),
+		lock: lock,
+	}
+	if err := c.locked(false, c.catchUp); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// locked runs fn holding both locks, the file lock shared unless exclusive.
+func (c *DiskCache[K, V]) locked(exclusive bool, fn func() error) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if err := lockFile(c.lock, exclusive); err != nil {
+		return err
+	}
+	defer unlockFile(c.lock)
+	return fn()
+}
+
+// changed is a cheap check for whether another process has written since catchUp.
+func (c *DiskCache[K, V]) changed() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	info, err := os.Stat(c.path)
+	if err != nil || c.file == nil {
+		return true
+	}
+	current, err := c.file.Stat()
+	return err != nil || !os.SameFile(info, current) || info.Size() != c.offset
+}
+
+// catchUp applies whatever has been written since it last ran, starting over if the file was compacted. Starting over
+// drops everything in memory too, since compaction leaves out the invalidations this process may not have read yet.
+// The locks must be held.
+func (c *DiskCache[K, V]) catchUp() error {
+	info, err := os.Stat(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		info = nil
+	} else if err != nil {
+		return err
+	}
+	if c.file != nil {
+		current, err := c.file.Stat()
+		if info == nil || err != nil || !os.SameFile(info, current) {
+			c.file.Close()
+			c.file = nil
+			c.mem.clear()
+		}
+	}
+	if c.file == nil {
+		if c.file, err = os.OpenFile(c.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+			return err
+		}
+		c.offset, c.records = 0, 0
+	}
+	data, err := io.ReadAll(io.NewSectionReader(c.file, c.offset, 1<<62))
+	if err != nil {
+		return err
+	}
+	// only whole lines, in case a writer that doesn't lock is mid-record
+	end := bytes.LastIndexByte(data, '\n') + 1
+	for _, line := range bytes.Split(data[:end], []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var rec diskRecord[K, V]
+		if err := json.Unmarshal(line, &rec); err != nil {
+			log.Println("skipping bad cache record: ", err)
+			continue
+		}
+		c.apply(rec)
+		c.records++
+	}
+	c.offset += int64(end)
+	return nil
+}
+
+func (c *DiskCache[K, V]) apply(rec diskRecord[K, V]) {
+	if rec.Deleted {
+		c.mem.Invalidate(rec.Key)
+		return
+	}
+	var ttl time.Duration
+	if rec.Expires != 0 {
+		if ttl = time.Until(time.Unix(0, rec.Expires)); ttl <= 0 {
+			c.mem.Invalidate(rec.Key)
+			return
+		}
+	}
+	if rec.Missing {
+		c.mem.PutMissing(rec.Key, ttl)
+	} else {
+		c.mem.PutTTL(rec.Key, rec.Value, ttl)
+	}
+}
+
+// write applies a record and appends it. It's applied after catching up, so older records from other processes
+// can't push it out.
+func (c *DiskCache[K, V]) write(rec diskRecord[K, V]) {
+	applied := false
+	defer func() {
+		if !applied {
+			c.apply(rec)
+		}
+	}()
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Println("unable to encode cache record: ", err)
+		return
+	}
+	err = c.locked(true, func() error {
+		if err := c.catchUp(); err != nil {
+			return err
+		}
+		c.apply(rec)
+		applied = true
+		n, err := c.file.Write(append(line, '\n'))
+		c.offset += int64(n)
+		if err != nil {
+			return err
+		}
+		c.records++
+		if c.records > compactMinRecords && c.records > 2*c.mem.Stats().Size {
+			return c.compact()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("unable to write cache: ", err)
+	}
+}
+
+// Compact rewrites the file with only the live entries.
+func (c *DiskCache[K, V]) Compact() error {
+	return c.locked(true, func() error {
+		if err := c.catchUp(); err != nil {
+			return err
+		}
+		return c.compact()
+	})
+}
+
+func (c *DiskCache[K, V]) compact() error {
+	var buf bytes.Buffer
+	records := 0
+	for _, entry := range c.mem.entries() {
+		rec := diskRecord[K, V]{Key: entry.key, Value: entry.value, Missing: entry.missing}
+		if !entry.expires.IsZero() {
+			rec.Expires = entry.expires.UnixNano()
+		}
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+		records++
+	}
+	if err := writeFileAtomic(c.path, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(c.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	c.file.Close()
+	c.file, c.offset, c.records = file, int64(buf.Len()), records
+	return nil
+}
+
+func (c *DiskCache[K, V]) expiry(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixNano()
+}
+
+// refresh catches up with other processes if they've written anything.
+func (c *DiskCache[K, V]) refresh() bool {
+	if !c.changed() {
+		return false
+	}
+	if err := c.locked(false, c.catchUp); err != nil {
+		log.Println("unable to read cache: ", err)
+	}
+	return true
+}
+
+func (c *DiskCache[K, V]) Get(k K) (V, bool) {
+	v, ok := c.mem.Get(k)
+	if !ok && c.refresh() {
+		return c.mem.Get(k)
+	}
+	return v, ok
+}
+
+func (c *DiskCache[K, V]) Put(k K, v V) {
+	c.PutTTL(k, v, c.ttl)
+}
+
+func (c *DiskCache[K, V]) PutTTL(k K, v V, ttl time.Duration) {
+	c.write(diskRecord[K, V]{Key: k, Value: v, Expires: c.expiry(ttl)})
+}
+
+func (c *DiskCache[K, V]) PutMissing(k K, ttl time.Duration) {
+	c.write(diskRecord[K, V]{Key: k, Missing: true, Expires: c.expiry(ttl)})
+}
+
+func (c *DiskCache[K, V]) Missing(k K) bool {
+	if c.mem.Missing(k) {
+		return true
+	}
+	return c.refresh() && c.mem.Missing(k)
+}
+
+func (c *DiskCache[K, V]) Invalidate(k K) {
+	c.write(diskRecord[K, V]{Key: k, Deleted: true})
+}
+
+func (c *DiskCache[K, V]) GetOrLoad(k K, load func(K) (V, error)) (V, error) {
+	if v, ok := c.Get(k); ok {
+		return v, nil
+	}
+	return c.mem.GetOrLoad(k, func(k K) (V, error) {
+		v, err := load(k)
+		if err == nil {
+			c.write(diskRecord[K, V]{Key: k, Value: v, Expires: c.expiry(c.ttl)})
+		}
+		return v, err
+	})
+}
+
+func (c *DiskCache[K, V]) Stats() CacheStats {
+	return c.mem.Stats()
+}
+
+func (c *DiskCache[K, V]) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	var errs []error
+	if c.file != nil {
+		errs = append(errs, c.file.Close())
+	}
+	return errors.Join(append(errs, c.lock.Close())...)
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package hypatia
+
+import "os"
+
+// Without flock only one process can safely use a cache file; compaction by another process could lose its writes.
+
+func lockFile(*os.File, bool) error {
+	return nil
+}
+
+func unlockFile(*os.File) error {
+	return nil
+}
@@ -0,0 +1,112 @@
+package hypatia
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiskCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shared", "instances.cache")
+	a, err := OpenDiskCache[string, string](path, CacheOptions{Size: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	// a second sidecar on the same host
+	b, err := OpenDiskCache[string, string](path, CacheOptions{Size: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	a.Put("ci-1", "i-1")
+	a.PutTTL("ci-2", "i-2", time.Millisecond)
+	a.PutMissing("ci-3", time.Minute)
+	if v, ok := b.Get("ci-1"); !ok || v != "i-1" {
+		t.Errorf("expected the other sidecar's entry, got %q", v)
+	}
+	if !b.Missing("ci-3") {
+		t.Error("expected the other sidecar's negative entry")
+	}
+	b.Invalidate("ci-1")
+
+	time.Sleep(5 * time.Millisecond)
+	restarted, err := OpenDiskCache[string, string](path, CacheOptions{Size: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+	if _, ok := restarted.Get("ci-1"); ok {
+		t.Error("expected the invalidation to survive a restart")
+	}
+	if _, ok := restarted.Get("ci-2"); ok {
+		t.Error("expected the expired entry to stay expired")
+	}
+	if !restarted.Missing("ci-3") {
+		t.Error("expected the negative entry to survive a restart")
+	}
+}
+
+func TestDiskCacheCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "addresses.cache")
+	a, _ := OpenDiskCache[string, string](path, CacheOptions{Size: 10})
+	defer a.Close()
+	b, _ := OpenDiskCache[string, string](path, CacheOptions{Size: 10})
+	defer b.Close()
+
+	var wait sync.WaitGroup
+	for _, c := range []*DiskCache[string, string]{a, b} {
+		wait.Add(1)
+		go func(c *DiskCache[string, string]) {
+			defer wait.Done()
+			for i := 0; i < compactMinRecords; i++ {
+				c.Put("i-"+strconv.Itoa(i%20), "10.0.0."+strconv.Itoa(i))
+			}
+		}(c)
+	}
+	wait.Wait()
+	data, _ := os.ReadFile(path)
+	if lines := bytes.Count(data, []byte("\n")); lines >= 2*compactMinRecords {
+		t.Errorf("expected the file to have been compacted, got %d records", lines)
+	}
+
+	a.Put("i-new", "10.1.1.1")
+	if err := a.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	// b has to notice the file was replaced
+	if v, ok := b.Get("i-new"); !ok || v != "10.1.1.1" {
+		t.Errorf("expected the entry after compaction, got %q", v)
+	}
+	data, _ = os.ReadFile(path)
+	if lines := bytes.Count(data, []byte("\n")); lines > 10 {
+		t.Errorf("expected compaction to keep only live entries, got %d", lines)
+	}
+}
+
+func TestDiskCacheCompactedInvalidation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "instances.cache")
+	a, _ := OpenDiskCache[string, string](path, CacheOptions{Size: 10})
+	defer a.Close()
+	b, _ := OpenDiskCache[string, string](path, CacheOptions{Size: 10})
+	defer b.Close()
+
+	a.Put("ci-1", "i-1")
+	if _, ok := b.Get("ci-1"); !ok {
+		t.Fatal("expected the other sidecar's entry")
+	}
+	// the invalidation is compacted away before b reads it
+	a.Invalidate("ci-1")
+	if err := a.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	b.Get("ci-2")
+	if v, ok := b.Get("ci-1"); ok {
+		t.Errorf("expected the invalidation to reach b through the compacted file, got %q", v)
+	}
+}
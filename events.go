@@ -0,0 +1,262 @@
+package hypatia
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EventHealth     = "health"
+	EventProtection = "protection"
+	EventProxy      = "proxy"
+	EventDiscovery  = "discovery"
+	EventSignal     = "signal"
+	EventStress     = "stress"
+	EventSpot       = "spot"
+
+	defaultEventHistory = 1000
+	// subscriberBuffer is how far a stream can fall behind before it starts missing events
+	subscriberBuffer  = 256
+	eventKeepAlive    = 15 * time.Second
+	eventStreamHeader = "text/event-stream"
+)
+
+type Event struct {
+	// ID increases by one for every event published on the bus.
+	ID   uint64         `json:"id"`
+	Time time.Time      `json:"time"`
+	Type string         `json:"type"`
+	Data map[string]any `json:"data,omitempty"`
+}
+
+// EventBus keeps recent events in memory and fans them out to subscribers. The zero value keeps a default history, and
+// a nil *EventBus drops everything, so components can publish without checking.
+type EventBus struct {
+	// Log, if set, gets every event as a line of json.
+	Log     io.Writer
+	m       sync.Mutex
+	history []Event
+	size    int
+	lastID  uint64
+	subs    map[chan Event]struct{}
+}
+
+// NewEventBus keeps the last size events for replay. Zero uses a default.
+func NewEventBus(size int) *EventBus {
+	if size <= 0 {
+		size = defaultEventHistory
+	}
+	return &EventBus{size: size, subs: make(map[chan Event]struct{})}
+}
+
+// OpenEventLog opens a jsonl file for EventBus.Log, appending to anything already there.
+func OpenEventLog(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+}
+
+func (b *EventBus) Publish(eventType string, data map[string]any) {
+	if b == nil {
+		return
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.lastID++
+	e := Event{ID: b.lastID, Time: time.Now().UTC(), Type: eventType, Data: data}
+	b.history = append(b.history, e)
+	size := b.size
+	if size <= 0 {
+		size = defaultEventHistory
+	}
+	if len(b.history) > size {
+		b.history = b.history[len(b.history)-size:]
+	}
+	if b.Log != nil {
+		if line, err := json.Marshal(&e); err != nil {
+			log.Println("unable to json event: ", err)
+		} else if _, err := b.Log.Write(append(line, '\n')); err != nil {
+			log.Println("unable to write event log: ", err)
+		}
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			// a stuck subscriber shouldn't hold up the server
+		}
+	}
+}
+
+// Since returns the remembered events after id, oldest first.
+func (b *EventBus) Since(id uint64) []Event {
+	if b == nil {
+		return nil
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	i := sort.Search(len(b.history), func(i int) bool { return b.history[i].ID > id })
+	return append([]Event(nil), b.history[i:]...)
+}
+
+// Subscribe returns the events after id that are still remembered, and a channel of everything published from now
+// on. Call cancel when done. A nil *EventBus never sends anything.
+func (b *EventBus) Subscribe(id uint64) (backlog []Event, events <-chan Event, cancel func()) {
+	if b == nil {
+		return nil, nil, func() {}
+	}
+	ch := make(chan Event, subscriberBuffer)
+	b.m.Lock()
+	defer b.m.Unlock()
+	i := sort.Search(len(b.history), func(i int) bool { return b.history[i].ID > id })
+	backlog = append([]Event(nil), b.history[i:]...)
+	if b.subs == nil {
+		b.subs = make(map[chan Event]struct{})
+	}
+	b.subs[ch] = struct{}{}
+	return backlog, ch, func() {
+		b.m.Lock()
+		defer b.m.Unlock()
+		delete(b.subs, ch)
+	}
+}
+
+// ServeEvents streams events as server-sent events. Reconnecting clients resume from Last-Event-ID, or ?since=, and
+// ?type=health,proxy limits the stream to some types.
+func (hs *Server) ServeEvents(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		handleError(res, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	since := req.Header.Get("Last-Event-ID")
+	if q := req.URL.Query().Get("since"); q != "" {
+		since = q
+	}
+	var after uint64
+	if since != "" {
+		var err error
+		if after, err = strconv.ParseUint(since, 10, 64); err != nil {
+			handleError(res, http.StatusBadRequest, fmt.Errorf("invalid event id: %q", since))
+			return
+		}
+	}
+	var types map[string]bool
+	if q := req.URL.Query().Get("type"); q != "" {
+		types = make(map[string]bool)
+		for _, t := range strings.Split(q, ",") {
+			types[strings.TrimSpace(t)] = true
+		}
+	}
+
+	backlog, events, cancel := hs.Events.Subscribe(after)
+	defer cancel()
+	rc := http.NewResponseController(res)
+	res.Header().Set("Content-Type", eventStreamHeader)
+	res.Header().Set("Cache-Control", "no-cache")
+	// tell nginx not to buffer the stream
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+
+	write := func(e Event) error {
+		if types != nil && !types[e.Type] {
+			return nil
+		}
+		data, err := json.Marshal(&e)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(res, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+		return err
+	}
+	for _, e := range backlog {
+		if err := write(e); err != nil {
+			return
+		}
+	}
+	rc.Flush()
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e := <-events:
+			if err := write(e); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := io.WriteString(res, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// serviceMap gets the service map and publishes which tasks came and went since the last time it was looked at.
+func (hs *Server) serviceMap() (*ServiceMap, error) {
+	services, err := hs.ServiceDiscovery.GetServiceMap()
+	if err != nil {
+		return nil, err
+	}
+	hs.knownTasksM.Lock()
+	defer hs.knownTasksM.Unlock()
+	var added, removed []string
+	for taskArn := range services.Tasks {
+		if _, ok := hs.knownTasks[taskArn]; !ok {
+			added = append(added, taskArn)
+		}
+	}
+	for taskArn := range hs.knownTasks {
+		if _, ok := services.Tasks[taskArn]; !ok {
+			removed = append(removed, taskArn)
+		}
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		sort.Strings(added)
+		sort.Strings(removed)
+		hs.Events.Publish(EventDiscovery, map[string]any{"added": added, "removed": removed, "tasks": len(services.Tasks)})
+		hs.knownTasks = make(map[string]struct{}, len(services.Tasks))
+		for taskArn := range services.Tasks {
+			hs.knownTasks[taskArn] = struct{}{}
+		}
+	}
+	return services, nil
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func isEvents(req *http.Request) bool {
+	return strings.EqualFold(req.URL.Path, "/events")
+}
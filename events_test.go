@@ -0,0 +1,149 @@
+package hypatia
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventBus(t *testing.T) {
+	var log bytes.Buffer
+	bus := NewEventBus(2)
+	bus.Log = &log
+	backlog, events, cancel := bus.Subscribe(0)
+	defer cancel()
+	if len(backlog) != 0 {
+		t.Errorf("expected no backlog, got %v", backlog)
+	}
+	for i := 0; i < 3; i++ {
+		bus.Publish(EventHealth, map[string]any{"i": i})
+	}
+	if e := <-events; e.ID != 1 || e.Type != EventHealth {
+		t.Errorf("unexpected first event: %+v", e)
+	}
+	if since := bus.Since(0); len(since) != 2 || since[0].ID != 2 {
+		t.Errorf("expected only the last 2 events to be remembered: %+v", since)
+	}
+	if since := bus.Since(2); len(since) != 1 || since[0].ID != 3 {
+		t.Errorf("expected events after 2: %+v", since)
+	}
+	if lines := strings.Count(log.String(), "\n"); lines != 3 {
+		t.Errorf("expected 3 lines of jsonl, got %d: %s", lines, log.String())
+	}
+
+	var nilBus *EventBus
+	nilBus.Publish(EventHealth, nil)
+	_, _, stop := nilBus.Subscribe(0)
+	stop()
+
+	var zero EventBus
+	_, events, cancel = zero.Subscribe(0)
+	defer cancel()
+	zero.Publish(EventHealth, nil)
+	if e := <-events; e.ID != 1 || len(zero.Since(0)) != 1 {
+		t.Errorf("expected the zero value to keep and send events, got %+v", e)
+	}
+}
+
+// readEvents reads n events off of a server-sent event stream.
+func readEvents(t *testing.T, body *bufio.Reader, n int) []Event {
+	var out []Event
+	for len(out) < n {
+		line, err := body.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var e Event
+			if err := json.Unmarshal([]byte(data), &e); err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func TestServeEvents(t *testing.T) {
+	dir := t.TempDir()
+	srv := newProxyTestServer(nil)
+	srv.Writeable = true
+	srv.LocalHealth = FileHealthcheck{Filepath: filepath.Join(dir, "local")}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	post := func(body string) {
+		res, err := http.Post(ts.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	post(`{"setLocalHealth": true}`)
+	post(`{"taskProtectionEnabled": true}`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/events?type=health", nil)
+	req.Header.Set("Last-Event-ID", "0")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.Header.Get("Content-Type") != eventStreamHeader {
+		t.Errorf("unexpected content type: %s", res.Header.Get("Content-Type"))
+	}
+	body := bufio.NewReader(res.Body)
+	first := readEvents(t, body, 1)[0]
+	if first.Type != EventHealth || first.Data["slot"] != "local" || first.Data["changed"] != true {
+		t.Errorf("expected the replayed health change: %+v", first)
+	}
+
+	post(`{"setLocalHealth": true}`)
+	live := readEvents(t, body, 1)[0]
+	if live.ID != 3 || live.Data["changed"] != false {
+		t.Errorf("expected a live health event that didn't flip, skipping protection: %+v", live)
+	}
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/events?since=abc", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a bad event id to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestProxyAndDiscoveryEvents(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusTeapot)
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	sd := &staticDiscovery{tasks: map[string]*url.URL{testNeighborArn: u}}
+	srv := newProxyTestServer(sd)
+
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/task/cafe/ping", nil))
+	sd.tasks = map[string]*url.URL{testSelfArn: u}
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/tasks", nil))
+
+	events := srv.Events.Since(0)
+	if len(events) != 3 {
+		t.Fatalf("expected discovery, proxy and discovery events, got %+v", events)
+	}
+	if e := events[0]; e.Type != EventDiscovery || len(e.Data["added"].([]string)) != 1 {
+		t.Errorf("expected the neighbor to be discovered: %+v", e)
+	}
+	if e := events[1]; e.Type != EventProxy || e.Data["status"] != http.StatusTeapot || e.Data["path"] != "/ping" {
+		t.Errorf("unexpected proxy event: %+v", e)
+	}
+	if e := events[2]; e.Type != EventDiscovery || e.Data["removed"].([]string)[0] != testNeighborArn {
+		t.Errorf("expected the neighbor to be removed: %+v", e)
+	}
+}
@@ -0,0 +1,136 @@
+package hypatia
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spotActionPath = "spot/instance-action"
+	rebalancePath  = "events/recommendations/rebalance"
+)
+
+// FakeIMDS answers the IMDS calls InstanceContext makes, for testing off ec2. Point InstanceContext.Endpoint at it.
+// Spot notices can be injected by calling Interrupt and Rebalance, or over http:
+//
+//	POST   /fake/spot/interrupt?action=stop&in=2m
+//	POST   /fake/spot/rebalance
+//	DELETE /fake/spot
+type FakeIMDS struct {
+	m        sync.Mutex
+	identity imds.InstanceIdentityDocument
+	// metadata is keyed by the path under /latest/meta-data/
+	metadata map[string]string
+}
+
+// NewFakeIMDS fakes a running on-demand instance.
+func NewFakeIMDS() *FakeIMDS {
+	f := &FakeIMDS{
+		identity: imds.InstanceIdentityDocument{
+			InstanceID:       "i-0123456789abcdef0",
+			InstanceType:     "m5.large",
+			AccountID:        "0123456789",
+			Region:           "us-west-2",
+			AvailabilityZone: "us-west-2a",
+			ImageID:          "ami-0123456789abcdef0",
+			PrivateIP:        "10.0.0.10",
+		},
+	}
+	f.metadata = map[string]string{
+		"placement/availability-zone-id": "usw2-az1",
+		"local-ipv4":                     f.identity.PrivateIP,
+		"mac":                            "02:00:00:00:00:01",
+		"network/interfaces/macs/02:00:00:00:00:01/interface-id": "eni-0123456789abcdef0",
+		"instance-life-cycle": "on-demand",
+	}
+	return f
+}
+
+// Set changes what a metadata path returns. An empty value makes it 404, like a path the instance doesn't have.
+func (f *FakeIMDS) Set(path, value string) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if value == "" {
+		delete(f.metadata, path)
+		return
+	}
+	f.metadata[path] = value
+}
+
+// Interrupt schedules a spot interruption, which is "terminate", "stop" or "hibernate", and makes the instance spot.
+func (f *FakeIMDS) Interrupt(action string, at time.Time) {
+	data, _ := json.Marshal(SpotAction{Action: action, Time: at.UTC().Format(time.RFC3339)})
+	f.Set("instance-life-cycle", "spot")
+	f.Set(spotActionPath, string(data))
+}
+
+// Rebalance recommends moving off the instance, and makes the instance spot.
+func (f *FakeIMDS) Rebalance(at time.Time) {
+	data, _ := json.Marshal(Rebalance{NoticeTime: at.UTC().Format(time.RFC3339)})
+	f.Set("instance-life-cycle", "spot")
+	f.Set(rebalancePath, string(data))
+}
+
+// ClearSpot withdraws any spot notices.
+func (f *FakeIMDS) ClearSpot() {
+	f.Set(spotActionPath, "")
+	f.Set(rebalancePath, "")
+}
+
+// serveControl injects spot notices, returning false for anything that isn't a control request.
+func (f *FakeIMDS) serveControl(res http.ResponseWriter, req *http.Request) bool {
+	switch {
+	case req.Method == http.MethodPost && req.URL.Path == "/fake/spot/interrupt":
+		action := req.URL.Query().Get("action")
+		if action == "" {
+			action = "terminate"
+		}
+		in := 2 * time.Minute
+		if s := req.URL.Query().Get("in"); s != "" {
+			var err error
+			if in, err = time.ParseDuration(s); err != nil {
+				http.Error(res, err.Error(), http.StatusBadRequest)
+				return true
+			}
+		}
+		f.Interrupt(action, time.Now().Add(in))
+	case req.Method == http.MethodPost && req.URL.Path == "/fake/spot/rebalance":
+		f.Rebalance(time.Now())
+	case req.Method == http.MethodDelete && req.URL.Path == "/fake/spot":
+		f.ClearSpot()
+	default:
+		return false
+	}
+	res.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+func (f *FakeIMDS) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if f.serveControl(res, req) {
+		return
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	switch {
+	case req.Method == http.MethodPut && req.URL.Path == "/latest/api/token":
+		res.Header().Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", req.Header.Get("X-Aws-Ec2-Metadata-Token-Ttl-Seconds"))
+		res.Write([]byte("fake-token"))
+	case req.Method != http.MethodGet:
+		res.WriteHeader(http.StatusMethodNotAllowed)
+	case req.URL.Path == "/latest/dynamic/instance-identity/document":
+		writeJSON(res, f.identity)
+	case strings.HasPrefix(req.URL.Path, "/latest/meta-data/"):
+		value, ok := f.metadata[strings.TrimPrefix(req.URL.Path, "/latest/meta-data/")]
+		if !ok {
+			http.NotFound(res, req)
+			return
+		}
+		res.Write([]byte(value))
+	default:
+		http.NotFound(res, req)
+	}
+}
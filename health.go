@@ -0,0 +1,225 @@
+package hypatia
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	HealthLocal  = "local"
+	HealthRemote = "remote"
+	healthPrefix = "/health"
+)
+
+// HealthRequest sets a healthcheck through PUT /health/{name}.
+type HealthRequest struct {
+	Healthy *bool `json:"healthy"`
+	// Reason is written into extended file healthchecks, and shows up as the reason the check fails.
+	Reason string `json:"reason,omitempty"`
+}
+
+// healthChecks is every named healthcheck, local and remote included.
+func (hs *Server) healthChecks() map[string]HealthCheck {
+	checks := make(map[string]HealthCheck, len(hs.Health)+2)
+	for name, hc := range hs.Health {
+		checks[name] = hc
+	}
+	checks[HealthLocal] = &hs.LocalHealth
+	checks[HealthRemote] = &hs.RemoteHealth
+	return checks
+}
+
+func (hs *Server) healthCheck(name string) (HealthCheck, bool) {
+	switch name {
+	case HealthLocal:
+		return &hs.LocalHealth, true
+	case HealthRemote:
+		return &hs.RemoteHealth, true
+	}
+	hc, ok := hs.Health[name]
+	return hc, ok
+}
+
+// pingHealth is what /ping reports: every one of PingSlots has to be healthy.
+func (hs *Server) pingHealth() error {
+	slots := hs.PingSlots
+	if len(slots) == 0 {
+		slots = []string{HealthRemote}
+	}
+	var errs []error
+	for _, name := range slots {
+		hc, ok := hs.healthCheck(name)
+		if !ok {
+			errs = append(errs, fmt.Errorf("no healthcheck named %q", name))
+		} else if err := hc.GetHealth(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// setHealth sets a healthcheck and publishes the change, noting whether it actually flipped. A reason is always in the
+// event, but only extended file healthchecks keep it; others are only checked for existing.
+func (hs *Server) setHealth(name string, healthy bool, reason string) error {
+	hc, ok := hs.healthCheck(name)
+	if !ok {
+		return fmt.Errorf("no healthcheck named %q", name)
+	}
+	was := hc.GetHealth() == nil
+	fc, isFile := hc.(*FileHealthcheck)
+	var err error
+	if isFile && fc.Extended && reason != "" {
+		err = fc.SetStatus(healthy, reason)
+	} else {
+		err = hc.SetHealth(healthy)
+	}
+	if err != nil {
+		return err
+	}
+	data := map[string]any{"slot": name, "healthy": healthy, "changed": was != healthy}
+	if reason != "" {
+		data["reason"] = reason
+	}
+	hs.Events.Publish(EventHealth, data)
+	hs.updateState(func(s *State) {
+		if isFile {
+			hs.sawHealth(name, fc.current())
+		}
+		s.setHealthy(name, healthy)
+	})
+	return nil
+}
+
+// setHealths sets several healthchecks by name, as the request bodies' health maps do, in name order so the events
+// come out the same every time.
+func (hs *Server) setHealths(health map[string]bool) []error {
+	names := make([]string, 0, len(health))
+	for name := range health {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []error
+	for _, name := range names {
+		if err := hs.setHealth(name, health[name], ""); err != nil {
+			errs = append(errs, fmt.Errorf("health %s: %w", name, err))
+		}
+	}
+	return errs
+}
+
+// ServeHealth serves GET /health, and GET and PUT /health/{name}.
+func (hs *Server) ServeHealth(res http.ResponseWriter, req *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(req.URL.Path, healthPrefix), "/")
+	if name == "" {
+		if req.Method != http.MethodGet {
+			handleError(res, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+			return
+		}
+		writeJSON(res, hs.healthStatus())
+		return
+	}
+	hc, ok := hs.healthCheck(name)
+	if !ok {
+		handleError(res, http.StatusNotFound, fmt.Errorf("no healthcheck named %q", name))
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if !hs.authorizeWrite(res, req) {
+			return
+		}
+		var input HealthRequest
+		if err := decodeBody(req, &input); err != nil {
+			handleError(res, http.StatusBadRequest, err)
+			return
+		}
+		if input.Healthy == nil {
+			handleError(res, http.StatusBadRequest, errors.New("healthy is required"))
+			return
+		}
+		if err := hs.setHealth(name, *input.Healthy, input.Reason); err != nil {
+			handleError(res, http.StatusInternalServerError, err)
+			return
+		}
+	default:
+		handleError(res, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	writeJSON(res, v1Health(hc.GetHealth()))
+}
+
+// healthStatus is every healthcheck's health.
+func (hs *Server) healthStatus() map[string]V1Health {
+	status := make(map[string]V1Health)
+	for name, hc := range hs.healthChecks() {
+		status[name] = v1Health(hc.GetHealth())
+	}
+	return status
+}
+
+// WatchHealth publishes changes to the health files that the server didn't make until ctx is done, and saves them to
+// the state.
+func (hs *Server) WatchHealth(ctx context.Context) {
+	if hs.HealthWatchInterval <= 0 {
+		return
+	}
+	hs.initState()
+	var wait sync.WaitGroup
+	for name, hc := range hs.healthChecks() {
+		fc, ok := hc.(*FileHealthcheck)
+		if !ok {
+			continue
+		}
+		hs.updateState(func(*State) { hs.sawHealth(name, fc.current()) })
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			fc.Watch(ctx, hs.HealthWatchInterval, func(status FileStatus) {
+				hs.healthChanged(name, status)
+			})
+		}()
+	}
+	wait.Wait()
+}
+
+func (hs *Server) healthChanged(name string, status FileStatus) {
+	healthy := status.Status == StatusHealthy
+	var seen, was bool
+	hs.updateState(func(s *State) {
+		last, ok := hs.healthSeen[name]
+		seen = ok && last.Status == status.Status && last.Reason == status.Reason
+		was = last.Status == StatusHealthy
+		hs.sawHealth(name, status)
+		s.setHealthy(name, healthy)
+	})
+	if seen {
+		return
+	}
+	log.Printf("%s health file changed: %s %s\n", name, status.Status, status.Reason)
+	hs.Events.Publish(EventHealth, map[string]any{
+		"slot":    name,
+		"healthy": healthy,
+		"reason":  status.Reason,
+		"changed": was != healthy,
+		"source":  "file",
+	})
+}
+
+// sawHealth records a status as published. Call it with stateM held.
+func (hs *Server) sawHealth(name string, status FileStatus) {
+	if hs.healthSeen == nil {
+		hs.healthSeen = make(map[string]FileStatus)
+	}
+	hs.healthSeen[name] = status
+}
+
+func isHealth(req *http.Request) bool {
+	return req.URL.Path == healthPrefix || strings.HasPrefix(req.URL.Path, healthPrefix+"/")
+}
@@ -0,0 +1,189 @@
+package hypatia
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newHealthTestServer(t *testing.T) *Server {
+	srv := newV1TestServer(t)
+	srv.Health = map[string]HealthCheck{
+		"readiness": &FileHealthcheck{Filepath: filepath.Join(t.TempDir(), "readiness"), Extended: true},
+	}
+	return srv
+}
+
+func TestServeHealth(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	srv := newHealthTestServer(t)
+
+	rec := v1Do(srv, http.MethodGet, "/health", "")
+	var all map[string]V1Health
+	if err := json.Unmarshal(rec.Body.Bytes(), &all); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("expected every healthcheck, got %d %s", rec.Code, rec.Body.String())
+	}
+	for _, name := range []string{HealthLocal, HealthRemote, "readiness"} {
+		if h, ok := all[name]; !ok || h.Healthy {
+			t.Errorf("expected %s to be listed as unhealthy, got %+v", name, all)
+		}
+	}
+
+	for _, tc := range []struct {
+		method, path, body string
+		code               int
+		healthy            bool
+	}{
+		{http.MethodPut, "/health/readiness", `{"healthy": true}`, http.StatusOK, true},
+		{http.MethodGet, "/health/readiness", "", http.StatusOK, true},
+		{http.MethodPut, "/health/readiness", `{"healthy": false, "reason": "warming up"}`, http.StatusOK, false},
+		{http.MethodPut, "/health/readiness", `{"reason": "nope"}`, http.StatusBadRequest, false},
+		{http.MethodPut, "/health/liveness", `{"healthy": true}`, http.StatusNotFound, false},
+		{http.MethodDelete, "/health/readiness", "", http.StatusMethodNotAllowed, false},
+		{http.MethodPost, "/health", `{}`, http.StatusMethodNotAllowed, false},
+	} {
+		rec := v1Do(srv, tc.method, tc.path, tc.body)
+		if rec.Code != tc.code {
+			t.Errorf("%s %s: expected %d, got %d: %s", tc.method, tc.path, tc.code, rec.Code, rec.Body.String())
+			continue
+		}
+		var h V1Health
+		if tc.code == http.StatusOK && (json.Unmarshal(rec.Body.Bytes(), &h) != nil || h.Healthy != tc.healthy) {
+			t.Errorf("%s %s: expected healthy %v, got %s", tc.method, tc.path, tc.healthy, rec.Body.String())
+		}
+	}
+	if err := srv.Health["readiness"].GetHealth(); err == nil || !strings.Contains(err.Error(), "warming up") {
+		t.Errorf("expected the reason to be kept, got %v", err)
+	}
+
+	srv.Writeable = false
+	if rec := v1Do(srv, http.MethodPut, "/health/readiness", `{"healthy": true}`); rec.Code != http.StatusForbidden {
+		t.Errorf("expected a read only server to refuse, got %d", rec.Code)
+	}
+}
+
+func TestPingSlots(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	srv := newHealthTestServer(t)
+	srv.PingSlots = []string{HealthRemote, "readiness"}
+	ping := func() (int, int) {
+		return v1Do(srv, http.MethodGet, "/ping", "").Code, v1Do(srv, http.MethodGet, "/v1/ping", "").Code
+	}
+
+	srv.setHealth(HealthRemote, true, "")
+	if ping, v1 := ping(); ping == http.StatusOK || v1 == http.StatusOK {
+		t.Errorf("expected ping to fail until readiness is healthy, got %d %d", ping, v1)
+	}
+	srv.setHealth("readiness", true, "")
+	if ping, v1 := ping(); ping != http.StatusOK || v1 != http.StatusOK {
+		t.Errorf("expected ping to pass once every slot is healthy, got %d %d", ping, v1)
+	}
+	srv.setHealth(HealthRemote, false, "")
+	if ping, _ := ping(); ping == http.StatusOK {
+		t.Error("expected ping to fail when remote is unhealthy")
+	}
+}
+
+func TestHealthRequests(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	srv := newHealthTestServer(t)
+
+	rec := v1Do(srv, http.MethodPost, "/", `{"health": {"readiness": true}}`)
+	var res RequestResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || !res.Health["readiness"] {
+		t.Fatalf("expected the set health to be echoed, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = v1Do(srv, http.MethodGet, "/", "")
+	res = RequestResponse{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || !res.Health["readiness"] || res.Health[HealthLocal] {
+		t.Errorf("expected every slot in the status, got %s", rec.Body.String())
+	}
+
+	rec = v1Do(srv, http.MethodPatch, "/v1/state", `{"health": {"liveness": true}}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "health.liveness") {
+		t.Errorf("expected an unknown healthcheck to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = v1Do(srv, http.MethodPatch, "/v1/state", `{"health": {"readiness": false}}`)
+	var state V1State
+	if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", rec.Code, rec.Body.String())
+	}
+	if h, ok := state.Health["readiness"]; !ok || h.Healthy {
+		t.Errorf("expected readiness to be unhealthy in the state, got %+v", state.Health)
+	}
+}
+
+func TestRestoreHealth(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	store := &MemoryStateStore{}
+	before := newHealthTestServer(t)
+	before.State = store
+	if err := before.RestoreState(); err != nil {
+		t.Fatal(err)
+	}
+	if err := before.setHealth("readiness", true, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	after := newHealthTestServer(t)
+	after.State = store
+	if err := after.RestoreState(); err != nil {
+		t.Fatal(err)
+	}
+	defer after.stress.stop()
+	if err := after.Health["readiness"].GetHealth(); err != nil {
+		t.Errorf("expected readiness to be restored, got %v", err)
+	}
+
+	// a check that's no longer configured is dropped rather than failing the restore
+	gone := newV1TestServer(t)
+	gone.State = store
+	if err := gone.RestoreState(); err != nil {
+		t.Errorf("expected a removed healthcheck to be ignored, got %v", err)
+	}
+	defer gone.stress.stop()
+}
+
+func TestRestoreHealthFiles(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	store := &MemoryStateStore{}
+	dir := t.TempDir()
+	heartbeat := &FileHealthcheck{Filepath: filepath.Join(dir, "heartbeat"), MaxAge: time.Minute}
+	owned := &FileHealthcheck{Filepath: filepath.Join(dir, "owned"), Extended: true}
+	newServer := func() *Server {
+		srv := newV1TestServer(t)
+		srv.State = store
+		srv.Health = map[string]HealthCheck{"heartbeat": heartbeat, "owned": owned}
+		return srv
+	}
+	before := newServer()
+	if err := before.RestoreState(); err != nil {
+		t.Fatal(err)
+	}
+	before.setHealth("heartbeat", true, "")
+	before.setHealth("owned", true, "")
+
+	// while hypatia is down the heartbeat goes stale, and the app fails its own check
+	stale := time.Now().Add(-time.Hour)
+	os.Chtimes(heartbeat.Filepath, stale, stale)
+	owned.SetStatus(false, "migrating")
+
+	after := newServer()
+	if err := after.RestoreState(); err != nil {
+		t.Fatal(err)
+	}
+	defer after.stress.stop()
+	if err := heartbeat.GetHealth(); err == nil {
+		t.Error("expected a stale heartbeat to stay unhealthy")
+	}
+	if err := owned.GetHealth(); err == nil || !strings.Contains(err.Error(), "migrating") {
+		t.Errorf("expected the app's status to be kept, got %v", err)
+	}
+	if saved, _ := store.Load(); saved.Health["heartbeat"] || saved.Health["owned"] {
+		t.Errorf("expected the state to follow the files, got %+v", saved.Health)
+	}
+}
@@ -1,19 +1,19 @@
 package hypatia
 
 import (
-	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/arn"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"strings"
 	"sync"
+	"time"
 )
 
 type TaskProtectionIface interface {
@@ -26,79 +26,118 @@ type TaskMetadataIface interface {
 	Self() (*TaskMetadata, error)
 }
 
+type ServiceDiscoveryIface interface {
+	GetServiceMap() (*ServiceMap, error)
+}
+
+var (
+	errNoServiceDiscovery = errors.New("service discovery not configured")
+	errNoMetadata         = errors.New("task metadata not configured")
+)
+
 type Server struct {
-	Protection       TaskProtectionIface
-	Metadata         TaskMetadataIface
-	LocalHealth      FileHealthcheck
-	RemoteHealth     FileHealthcheck
-	ServiceDiscovery *ServiceDiscovery
+	Protection   TaskProtectionIface
+	Metadata     TaskMetadataIface
+	LocalHealth  FileHealthcheck
+	RemoteHealth FileHealthcheck
+	// Health names any other healthchecks, like readiness or alb. local and remote are always there, and can't be
+	// replaced here.
+	Health map[string]HealthCheck
+	// PingSlots are the healthchecks /ping reports, all of which have to be healthy. Defaults to remote.
+	PingSlots        []string
+	ServiceDiscovery ServiceDiscoveryIface
 	Writeable        bool
-	proxy            *httputil.ReverseProxy
-	imdsClient       *imds.Client
-	once             sync.Once
+	// Auth guards mutating requests, including ones proxied to neighbors. Nil accepts any writer.
+	Auth Authenticator
+	// ProxyDialTimeout, ProxyResponseHeaderTimeout and ProxyTimeout bound calls to neighbors. Zero uses defaults.
+	ProxyDialTimeout           time.Duration
+	ProxyResponseHeaderTimeout time.Duration
+	ProxyTimeout               time.Duration
+	// ProxyTLSConfig verifies https neighbors, and presents a client certificate to neighbors that require one.
+	ProxyTLSConfig *tls.Config
+	// MaxProxyHops is how many hypatia proxies a request may pass through before it's rejected as a loop.
+	MaxProxyHops int
+	// Balancer spreads requests to /any across the service. Defaults to round-robin.
+	Balancer *Balancer
+	// NeighborPollInterval is how often PollNeighbors polls every task's GET / for /tasks?detail=true. Zero polls on
+	// demand.
+	NeighborPollInterval time.Duration
+	// Exit ends the process for /crash. Defaults to os.Exit.
+	Exit func(code int)
+	// Events records what happens to the task for /events. Defaults to an in-memory bus.
+	Events *EventBus
+	// Instance describes the ec2 instance the task runs on. Defaults to reading IMDS.
+	Instance *InstanceContext
+	// HealthWatchInterval polls the health files for changes made outside the server, like by cmd/healthcheck or a
+	// heartbeat going stale, while WatchHealth runs. Zero doesn't watch.
+	HealthWatchInterval time.Duration
+	// Spot reacts to spot interruption and rebalance notices while WatchSpot runs. Nil ignores them.
+	Spot *SpotWatch
+	// State saves health, protection and stress so they survive a restart. Nil saves nothing.
+	State     StateStore
+	state     State
+	stateM    sync.Mutex
+	stateOnce sync.Once
+	// healthSeen is the last status of each health file that was published, guarded by stateM
+	healthSeen  map[string]FileStatus
+	stress      stressor
+	neighborsM  sync.RWMutex
+	neighbors   map[string]*Neighbor
+	knownTasksM sync.Mutex
+	knownTasks  map[string]struct{}
+	proxy       *httputil.ReverseProxy
+	once        sync.Once
 }
 
 type Neighbor struct {
-	TaskArn *string `json:"taskArn,omitempty"`
-	Address *string `json:"address,omitempty"`
-}
-type RequestResponse struct {
 	TaskArn               *string  `json:"taskArn,omitempty"`
-	TaskProtectionEnabled *bool    `json:"taskProtectionEnabled,omitempty"`
-	TaskProtectionExpiry  *string  `json:"taskProtectionExpiry,omitempty"`
-	SetLocalHealth        *bool    `json:"setLocalHealth,omitempty"`
-	SetRemoteHealth       *bool    `json:"setRemoteHealth,omitempty"`
+	Address               *string  `json:"address,omitempty"`
 	LocalHealth           *string  `json:"localHealth,omitempty"`
 	RemoteHealth          *string  `json:"remoteHealth,omitempty"`
-	ExpiresInMinutes      *int     `json:"expiresInMinutes,omitempty"`
+	TaskProtectionEnabled *bool    `json:"taskProtectionEnabled,omitempty"`
+	TaskProtectionExpiry  *string  `json:"taskProtectionExpiry,omitempty"`
 	EC2InstanceId         *string  `json:"ec2Instance,omitempty"`
-	Tasks                 []string `json:"tasks,omitempty"`
+	LastSeen              *string  `json:"lastSeen,omitempty"`
 	Errors                []string `json:"errors,omitempty"`
 }
+type RequestResponse struct {
+	TaskArn               *string         `json:"taskArn,omitempty"`
+	TaskProtectionEnabled *bool           `json:"taskProtectionEnabled,omitempty"`
+	TaskProtectionExpiry  *string         `json:"taskProtectionExpiry,omitempty"`
+	SetLocalHealth        *bool           `json:"setLocalHealth,omitempty"`
+	SetRemoteHealth       *bool           `json:"setRemoteHealth,omitempty"`
+	LocalHealth           *string         `json:"localHealth,omitempty"`
+	RemoteHealth          *string         `json:"remoteHealth,omitempty"`
+	ExpiresInMinutes      *int            `json:"expiresInMinutes,omitempty"`
+	Health                map[string]bool `json:"health,omitempty"`
+	EC2InstanceId         *string         `json:"ec2Instance,omitempty"`
+	Instance              *Instance       `json:"instance,omitempty"`
+	Tasks                 []string        `json:"tasks,omitempty"`
+	Neighbors             []Neighbor      `json:"neighbors,omitempty"`
+	Errors                []string        `json:"errors,omitempty"`
+}
 
 func (hs *Server) initServer() {
+	hs.initState()
 	hs.once.Do(func() {
-		hs.proxy = &httputil.ReverseProxy{
-			Director: func(req *http.Request) {
-				if err := hs.doRewrite(req); err != nil {
-					log.Println(err)
-				}
-			},
+		hs.proxy = hs.newProxy()
+		if hs.Balancer == nil {
+			hs.Balancer = &Balancer{}
+		}
+		if hs.Balancer.Client == nil {
+			hs.Balancer.Client = &http.Client{Transport: hs.proxy.Transport, Timeout: 2 * time.Second}
 		}
-		if cfg, err := config.LoadDefaultConfig(context.Background()); err == nil {
-			hs.imdsClient = imds.NewFromConfig(cfg)
-		} else {
-			log.Println("error starting imds: ", err)
+		if hs.Instance == nil {
+			hs.Instance = &InstanceContext{}
 		}
+		// warm up, so the first request doesn't wait on imds
+		go hs.Instance.Get()
 	})
 }
 
-func (hs *Server) ServeProxy(res http.ResponseWriter, req *http.Request) {
-	hs.proxy.ServeHTTP(res, req)
-}
-
-func (hs *Server) doRewrite(in *http.Request) error {
-	taskArn := extractArn(in)
-	if taskArn == "" {
-		return fmt.Errorf("unable to extract arn: %s", in.URL)
-	}
-	services, err := hs.ServiceDiscovery.GetServiceMap()
-	if err != nil {
-		return fmt.Errorf("error getting data from proxy: %s", err)
-	}
-	addr, ok := services.Tasks[taskArn]
-	if !ok {
-		return fmt.Errorf("address not found in map: %s", taskArn)
-	} else {
-		in.URL.Scheme = addr.Scheme
-		in.URL.Host = addr.Host
-	}
-	return nil
-}
-
 func (hs *Server) ServePing(res http.ResponseWriter, _ *http.Request) {
 	var message []byte
-	if err := hs.RemoteHealth.GetHealth(); err != nil {
+	if err := hs.pingHealth(); err != nil {
 		res.WriteHeader(http.StatusInternalServerError)
 		message = []byte(err.Error())
 	} else {
@@ -107,40 +146,56 @@ func (hs *Server) ServePing(res http.ResponseWriter, _ *http.Request) {
 	writeResponse(res, message)
 }
 
-func (hs *Server) ServeNeighbors(res http.ResponseWriter, _ *http.Request) {
-	var output RequestResponse
-	if hs.ServiceDiscovery == nil {
-		log.Println("no sd configured")
-		handleISE(res)
+func (hs *Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	hs.initServer()
+	hs.checkSignedPath(req)
+	if proxy, err := hs.isProxy(req); err != nil {
+		log.Println("unable to route request: ", err)
+		handleUnavailable(res, err)
 		return
-	}
-	services, err := hs.ServiceDiscovery.GetServiceMap()
-	if err != nil {
-		log.Println("unable to get sd data: ", err)
-		handleISE(res)
+	} else if proxy {
+		if isWrite(req) && !hs.authenticate(res, req) {
+			return
+		}
+		hs.ServeProxy(res, req)
 		return
+	} else if ref, rest := extractTask(req); ref != "" {
+		// addressed to this task, so route the remainder locally
+		keepSignedPath(req)
+		req.URL.Path = rest
+		req.URL.RawPath = ""
 	}
-	for k, _ := range services.Tasks {
-		output.Tasks = append(output.Tasks, k)
-	}
-	data, err := json.Marshal(&output)
-	if err != nil {
-		log.Println("unable to json things: ", err)
-		handleISE(res)
+
+	if isV1(req) {
+		hs.ServeV1(res, req)
 		return
 	}
-	writeResponse(res, data)
-}
 
-func (hs *Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
-	hs.initServer()
 	if isTasks(req) {
 		hs.ServeNeighbors(res, req)
 		return
 	}
 
-	if hs.isProxy(req) {
-		hs.ServeProxy(res, req)
+	if isEvents(req) {
+		hs.ServeEvents(res, req)
+		return
+	}
+
+	if isUI(req) {
+		hs.ServeUI(res, req)
+		return
+	}
+
+	if isAny(req) {
+		if isWrite(req) && !hs.authenticate(res, req) {
+			return
+		}
+		hs.ServeAny(res, req)
+		return
+	}
+
+	if isBalancer(req) {
+		hs.ServeBalancer(res, req)
 		return
 	}
 
@@ -149,14 +204,33 @@ func (hs *Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if isHealth(req) {
+		hs.ServeHealth(res, req)
+		return
+	}
+
+	if isStress(req) {
+		if isWrite(req) && !hs.authorizeWrite(res, req) {
+			return
+		}
+		hs.ServeStress(res, req)
+		return
+	}
+
+	if isCrash(req) {
+		if !hs.authorizeWrite(res, req) {
+			return
+		}
+		hs.ServeCrash(res, req)
+		return
+	}
+
 	var errors []error
 	var output RequestResponse
 
 	switch req.Method {
 	case http.MethodPost:
-		if !hs.Writeable {
-			log.Println("not authorized for writes")
-			handleUnauth(res)
+		if !hs.authorizeWrite(res, req) {
 			return
 		}
 		var input RequestResponse
@@ -174,70 +248,42 @@ func (hs *Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 			return
 		}
 		if input.TaskProtectionEnabled != nil {
-			if _, err := hs.Protection.Put(*input.TaskProtectionEnabled, input.ExpiresInMinutes); err != nil {
+			if err := hs.putProtection(*input.TaskProtectionEnabled, input.ExpiresInMinutes); err != nil {
 				errors = append(errors, err)
 			} else {
 				output.TaskProtectionEnabled = input.TaskProtectionEnabled
-				output.TaskProtectionEnabled = input.TaskProtectionEnabled
 			}
 		}
 		if input.SetRemoteHealth != nil {
-			if err := hs.RemoteHealth.SetHealth(*input.SetRemoteHealth); err != nil {
+			if err := hs.setHealth(HealthRemote, *input.SetRemoteHealth, ""); err != nil {
 				errors = append(errors, err)
 			} else {
 				output.SetRemoteHealth = input.SetRemoteHealth
 			}
 		}
 		if input.SetLocalHealth != nil {
-			if err := hs.LocalHealth.SetHealth(*input.SetLocalHealth); err != nil {
+			if err := hs.setHealth(HealthLocal, *input.SetLocalHealth, ""); err != nil {
 				errors = append(errors, err)
 			} else {
 				output.SetLocalHealth = input.SetLocalHealth
 			}
 		}
-	case http.MethodGet:
-		protectionStatus, psErr := hs.Protection.Get()
-		if psErr != nil {
-			errors = append(errors, psErr)
-		} else {
-			output.TaskArn = protectionStatus.TaskArn
-			output.TaskProtectionExpiry = protectionStatus.ExpirationDate
-			output.TaskProtectionEnabled = protectionStatus.ProtectionEnabled
-		}
-
-		self, selfErr := hs.Metadata.Self()
-		if selfErr != nil {
-			errors = append(errors, selfErr)
-		} else {
-			output.TaskArn = self.TaskARN
-		}
-		if hs.imdsClient != nil {
-			if mt, err := hs.imdsClient.GetInstanceIdentityDocument(context.Background(), &imds.GetInstanceIdentityDocumentInput{}); err == nil {
-				log.Println("setting IMDS: ", mt)
-				output.EC2InstanceId = aws.String(mt.InstanceID)
-			} else {
-				errors = append(errors, err)
+		if len(input.Health) > 0 {
+			if errs := hs.setHealths(input.Health); len(errs) > 0 {
+				errors = append(errors, errs...)
+			}
+			// like the fields above, only what was set is echoed back
+			output.Health = make(map[string]bool)
+			for name, healthy := range input.Health {
+				if hc, ok := hs.healthCheck(name); ok && (hc.GetHealth() == nil) == healthy {
+					output.Health[name] = healthy
+				}
 			}
-		} else {
-			log.Println("imds is null DELETE ME")
-		}
-
-		localHealthStatus := hs.LocalHealth.GetHealth()
-		if localHealthStatus != nil {
-			errors = append(errors, localHealthStatus)
-			output.LocalHealth = aws.String("Unhealthy")
-		} else {
-			output.LocalHealth = aws.String("Healthy")
-		}
-		remoteHealthStatus := hs.RemoteHealth.GetHealth()
-		if remoteHealthStatus != nil {
-			errors = append(errors, remoteHealthStatus)
-			output.RemoteHealth = aws.String("Unhealthy")
-		} else {
-			output.RemoteHealth = aws.String("Healthy")
 		}
+	case http.MethodGet:
+		output, errors = hs.status()
 	default:
-		handleUnauth(res)
+		handleError(res, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
 		return
 	}
 
@@ -257,10 +303,64 @@ func (hs *Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	return
 }
 
+// status is what GET / reports. Errors, like imds being unavailable off of ec2, are reported alongside it.
+func (hs *Server) status() (RequestResponse, []error) {
+	var errors []error
+	var output RequestResponse
+	protectionStatus, psErr := hs.Protection.Get()
+	if psErr != nil {
+		errors = append(errors, psErr)
+	} else {
+		output.TaskArn = protectionStatus.TaskArn
+		output.TaskProtectionExpiry = protectionStatus.ExpirationDate
+		output.TaskProtectionEnabled = protectionStatus.ProtectionEnabled
+	}
+
+	self, selfErr := hs.Metadata.Self()
+	if selfErr != nil {
+		errors = append(errors, selfErr)
+	} else {
+		output.TaskArn = self.TaskARN
+	}
+	// off ec2 there's no instance, which isn't an error
+	if instance, err := hs.Instance.Get(); err == nil {
+		output.EC2InstanceId = aws.String(instance.InstanceID)
+		output.Instance = instance
+	}
+
+	localHealthStatus := hs.LocalHealth.GetHealth()
+	if localHealthStatus != nil {
+		errors = append(errors, localHealthStatus)
+		output.LocalHealth = aws.String("Unhealthy")
+	} else {
+		output.LocalHealth = aws.String("Healthy")
+	}
+	remoteHealthStatus := hs.RemoteHealth.GetHealth()
+	if remoteHealthStatus != nil {
+		errors = append(errors, remoteHealthStatus)
+		output.RemoteHealth = aws.String("Unhealthy")
+	} else {
+		output.RemoteHealth = aws.String("Healthy")
+	}
+	output.Health = make(map[string]bool)
+	for name, hc := range hs.healthChecks() {
+		output.Health[name] = hc.GetHealth() == nil
+	}
+	return output, errors
+}
+
 func isTasks(req *http.Request) bool {
 	return strings.EqualFold(req.URL.Path, "/tasks")
 }
 
+func isAny(req *http.Request) bool {
+	return req.URL.Path == "/any" || strings.HasPrefix(req.URL.Path, "/any/")
+}
+
+func isBalancer(req *http.Request) bool {
+	return strings.EqualFold(req.URL.Path, "/balancer")
+}
+
 func isPing(req *http.Request) bool {
 	var found bool
 	for _, s := range []string{"/ping", "/ping/"} {
@@ -272,51 +372,98 @@ func isPing(req *http.Request) bool {
 	return found
 }
 
-func extractArn(req *http.Request) string {
-	p := req.URL.Path
-	if !strings.HasPrefix(p, "/task/") {
-		return ""
+// extractTask splits /task/{task}/{rest...} into the task reference and the path to forward. The reference is either
+// a task arn or a bare task id. Arns with a trailing path must use the long format that includes the cluster name.
+func extractTask(req *http.Request) (string, string) {
+	return splitTaskPath(req.URL.Path)
+}
+
+func splitTaskPath(path string) (string, string) {
+	p, ok := strings.CutPrefix(path, "/task/")
+	if !ok || p == "" {
+		return "", ""
 	}
-	tokens := strings.SplitN(p, "/task/", 2)
-	if len(tokens) < 2 {
-		return ""
+	if !strings.HasPrefix(p, "arn:") {
+		id, rest, _ := strings.Cut(p, "/")
+		if id == "" {
+			return "", ""
+		}
+		return id, "/" + rest
 	}
-	a, err := arn.Parse(tokens[1])
+	a, err := arn.Parse(p)
 	if err != nil {
-		return ""
+		return "", ""
 	}
+	parts := strings.SplitN(a.Resource, "/", 4)
+	if len(parts) < 2 || !strings.EqualFold("task", parts[0]) || (len(parts) < 4 && parts[len(parts)-1] == "") {
+		return "", ""
+	}
+	rest := "/"
+	if len(parts) == 4 {
+		rest += parts[3]
+		parts = parts[:3]
+	}
+	return strings.TrimSuffix(p, a.Resource) + strings.Join(parts, "/"), rest
+}
 
-	if parts := strings.SplitN(a.Resource, "/", 5); len(parts) < 2 {
-		return ""
-	} else if !strings.EqualFold("task", parts[0]) {
-		return ""
-	} else if len(parts) > 3 {
-		return ""
+// matchTask reports whether a task reference from extractTask names the given arn.
+func matchTask(ref, taskArn string) bool {
+	if ref == taskArn {
+		return true
 	}
-	return tokens[1]
+	return !strings.HasPrefix(ref, "arn:") && strings.HasSuffix(taskArn, "/"+ref)
 }
 
-func (hs *Server) isProxy(req *http.Request) bool {
-	// 'can you extract a task arn from the request'
-	arn := extractArn(req)
-	if arn == "" {
-		return false
+func (hs *Server) isProxy(req *http.Request) (bool, error) {
+	// 'can you extract a task from the request'
+	ref, _ := extractTask(req)
+	if ref == "" {
+		return false, nil
 	}
 
 	// 'is it me'
-	x, err := hs.Metadata.Self()
+	if hs.Metadata == nil {
+		return false, errNoMetadata
+	}
+	self, err := hs.isSelf(ref)
 	if err != nil {
-		panic("error retrieving metadata: " + err.Error())
+		return false, err
 	}
-	if x.TaskARN == nil || *x.TaskARN == arn {
-		return false
+	if self {
+		return false, nil
+	}
+	if hs.ServiceDiscovery == nil {
+		return false, errNoServiceDiscovery
 	}
-	return true
+	return true, nil
 }
 
-func handleUnauth(res http.ResponseWriter) {
-	res.WriteHeader(http.StatusUnauthorized)
-	writeResponse(res, []byte("{}"))
+// isSelf reports whether a task reference names this task. Without a task arn every task is this one.
+func (hs *Server) isSelf(ref string) (bool, error) {
+	if hs.Metadata == nil {
+		return false, errNoMetadata
+	}
+	x, err := hs.Metadata.Self()
+	if err != nil {
+		return false, fmt.Errorf("error retrieving metadata: %w", err)
+	}
+	return x.TaskARN == nil || matchTask(ref, *x.TaskARN), nil
+}
+
+// handleUnavailable reports a dependency (metadata, discovery) that isn't ready yet. Callers can retry.
+func handleUnavailable(res http.ResponseWriter, err error) {
+	handleError(res, http.StatusServiceUnavailable, err)
+}
+
+func handleError(res http.ResponseWriter, status int, err error) {
+	data, merr := json.Marshal(&RequestResponse{Errors: []string{err.Error()}})
+	if merr != nil {
+		log.Println("error: ", merr)
+		data = []byte("{}")
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	writeResponse(res, data)
 }
 
 func handleISE(res http.ResponseWriter) {
@@ -1,30 +1,66 @@
 package hypatia
 
 import (
+	"encoding/json"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"testing"
 )
 
 func TestArn(t *testing.T) {
-	happyCases := []string{
-		"http://localhost/task/arn:aws:ecs:us-west-2:012:task/default/cafe",
-		"http://localhost/task/arn:aws:ecs:us-west-2:012:task/cafe",
+	happyCases := map[string][2]string{
+		"http://localhost/task/arn:aws:ecs:us-west-2:012:task/default/cafe":           {"arn:aws:ecs:us-west-2:012:task/default/cafe", "/"},
+		"http://localhost/task/arn:aws:ecs:us-west-2:012:task/cafe":                   {"arn:aws:ecs:us-west-2:012:task/cafe", "/"},
+		"http://localhost/task/arn:aws:ecs:us-west-2:012:task/cafe/cafe/cafe":         {"arn:aws:ecs:us-west-2:012:task/cafe/cafe", "/cafe"},
+		"http://localhost/task/arn:aws:ecs:us-west-2:012:task/default/cafe/stats/a/b": {"arn:aws:ecs:us-west-2:012:task/default/cafe", "/stats/a/b"},
+		"http://localhost/task/cafe":                                                  {"cafe", "/"},
+		"http://localhost/task/cafe/ping":                                             {"cafe", "/ping"},
 	}
 	sadCases := []string{
 		"http://localhost/task/arn:cafe",
 		"http://localhost/task/arn:aws:ecs:us-west-2:012:task",
-		"http://localhost/task/arn:aws:ecs:us-west-2:012:task/cafe/cafe/cafe",
+		"http://localhost/task/arn:aws:ecs:us-west-2:012:task/",
+		"http://localhost/task/",
+		"http://localhost/tasks",
 	}
-	for i, v := range happyCases {
+	for v, expected := range happyCases {
 		r, _ := http.NewRequest("GET", v, nil)
-		if extractArn(r) == "" {
-			t.Errorf("trial %d failed with url %s: ", i, v)
+		if ref, rest := extractTask(r); ref != expected[0] || rest != expected[1] {
+			t.Errorf("url %s: got %s %s", v, ref, rest)
 		}
 	}
 	for i, v := range sadCases {
 		r, _ := http.NewRequest("GET", v, nil)
-		if extractArn(r) != "" {
+		if ref, _ := extractTask(r); ref != "" {
 			t.Errorf("trial %d failed with url %s: ", i, v)
 		}
 	}
 }
+
+func TestProxyWithoutMetadata(t *testing.T) {
+	t.Setenv("ECS_CONTAINER_METADATA_URI_V4", "")
+	os.Unsetenv("ECS_CONTAINER_METADATA_URI_V4")
+	srv := &Server{
+		Protection:       &TaskProtectionStub{Protection: &Protection{}},
+		Metadata:         &TaskProtectionStub{Protection: &Protection{}},
+		ServiceDiscovery: &ServiceDiscovery{},
+	}
+	for _, path := range []string{"/task/arn:aws:ecs:us-west-2:012:task/default/cafe", "/tasks"} {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: expected 503, got %d", path, rec.Code)
+		}
+		var output RequestResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &output); err != nil || len(output.Errors) != 1 {
+			t.Errorf("%s: expected one error in body, got %s", path, rec.Body.String())
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ping", nil))
+	if rec.Code == http.StatusServiceUnavailable {
+		t.Error("expected ping to be unaffected by metadata")
+	}
+}
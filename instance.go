@@ -0,0 +1,187 @@
+package hypatia
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInstanceRefresh = 5 * time.Minute
+	imdsTimeout            = 2 * time.Second
+)
+
+// ErrNoInstance means IMDS can't be reached, as on fargate or outside of aws. It isn't worth reporting as a failure.
+var ErrNoInstance = errors.New("no ec2 instance metadata")
+
+// Instance is the ec2 instance a task runs on, as IMDS describes it.
+type Instance struct {
+	InstanceID         string      `json:"instanceId"`
+	InstanceType       string      `json:"instanceType,omitempty"`
+	AccountID          string      `json:"accountId,omitempty"`
+	Region             string      `json:"region,omitempty"`
+	AvailabilityZone   string      `json:"availabilityZone,omitempty"`
+	AvailabilityZoneID string      `json:"availabilityZoneId,omitempty"`
+	ImageID            string      `json:"imageId,omitempty"`
+	LocalIPv4          string      `json:"localIpv4,omitempty"`
+	PublicIPv4         string      `json:"publicIpv4,omitempty"`
+	MAC                string      `json:"mac,omitempty"`
+	InterfaceID        string      `json:"interfaceId,omitempty"`
+	Lifecycle          string      `json:"lifecycle,omitempty" doc:"spot or on-demand"`
+	SpotAction         *SpotAction `json:"spotAction,omitempty" doc:"set once the spot instance is scheduled to be interrupted"`
+	Rebalance          *Rebalance  `json:"rebalance,omitempty" doc:"set once ec2 recommends moving off the spot instance"`
+	UpdatedAt          time.Time   `json:"updatedAt"`
+}
+
+type SpotAction struct {
+	Action string `json:"action"`
+	Time   string `json:"time"`
+}
+
+type Rebalance struct {
+	NoticeTime string `json:"noticeTime"`
+}
+
+// InstanceContext reads the instance from IMDS once, then keeps it fresh in the background.
+type InstanceContext struct {
+	// Endpoint overrides the IMDS endpoint, for testing against a fake. Defaults to the sdk's, which honors
+	// AWS_EC2_METADATA_SERVICE_ENDPOINT and AWS_EC2_METADATA_DISABLED.
+	Endpoint string
+	// Refresh is how often the instance is read again. Defaults to 5 minutes.
+	Refresh  time.Duration
+	client   *imds.Client
+	m        sync.RWMutex
+	instance *Instance
+	err      error
+	once     sync.Once
+}
+
+// Get returns the instance, reading it the first time it's called. The error is always ErrNoInstance, wrapping why.
+func (ic *InstanceContext) Get() (*Instance, error) {
+	ic.once.Do(func() {
+		if ic.Refresh <= 0 {
+			ic.Refresh = defaultInstanceRefresh
+		}
+		cfg, err := config.LoadDefaultConfig(context.Background())
+		if err != nil {
+			ic.err = fmt.Errorf("%w: %w", ErrNoInstance, err)
+			return
+		}
+		ic.client = imds.NewFromConfig(cfg, func(o *imds.Options) {
+			if ic.Endpoint != "" {
+				o.Endpoint = ic.Endpoint
+			}
+		})
+		ic.refresh()
+		if ic.err != nil {
+			log.Println("not reporting the ec2 instance: ", ic.err)
+		}
+		go func() {
+			for range time.Tick(ic.Refresh) {
+				ic.refresh()
+			}
+		}()
+	})
+	ic.m.RLock()
+	defer ic.m.RUnlock()
+	return ic.instance, ic.err
+}
+
+func (ic *InstanceContext) refresh() {
+	instance, err := ic.fetch()
+	ic.m.Lock()
+	defer ic.m.Unlock()
+	if err != nil {
+		ic.instance, ic.err = nil, fmt.Errorf("%w: %w", ErrNoInstance, err)
+		return
+	}
+	ic.instance, ic.err = instance, nil
+}
+
+// fetch reads everything at once. Only the identity document is required; anything else the instance doesn't have,
+// like a public address, is left empty.
+func (ic *InstanceContext) fetch() (*Instance, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), imdsTimeout)
+	defer cancel()
+	doc, err := ic.client.GetInstanceIdentityDocument(ctx, &imds.GetInstanceIdentityDocumentInput{})
+	if err != nil {
+		return nil, err
+	}
+	instance := &Instance{
+		InstanceID:       doc.InstanceID,
+		InstanceType:     doc.InstanceType,
+		AccountID:        doc.AccountID,
+		Region:           doc.Region,
+		AvailabilityZone: doc.AvailabilityZone,
+		ImageID:          doc.ImageID,
+		LocalIPv4:        doc.PrivateIP,
+		UpdatedAt:        time.Now().UTC(),
+	}
+	for path, field := range map[string]*string{
+		"placement/availability-zone-id": &instance.AvailabilityZoneID,
+		"local-ipv4":                     &instance.LocalIPv4,
+		"public-ipv4":                    &instance.PublicIPv4,
+		"mac":                            &instance.MAC,
+		"instance-life-cycle":            &instance.Lifecycle,
+	} {
+		if value, err := ic.metadata(ctx, path); err == nil {
+			*field = value
+		}
+	}
+	if instance.MAC != "" {
+		instance.InterfaceID, _ = ic.metadata(ctx, "network/interfaces/macs/"+instance.MAC+"/interface-id")
+	}
+	instance.SpotAction, instance.Rebalance = ic.spotNotices(ctx)
+	return instance, nil
+}
+
+// spotNotices reads the spot notices, which IMDS only has once ec2 sends them.
+func (ic *InstanceContext) spotNotices(ctx context.Context) (*SpotAction, *Rebalance) {
+	var action *SpotAction
+	var rebalance *Rebalance
+	if raw, err := ic.metadata(ctx, "spot/instance-action"); err == nil {
+		json.Unmarshal([]byte(raw), &action)
+	}
+	if raw, err := ic.metadata(ctx, "events/recommendations/rebalance"); err == nil {
+		json.Unmarshal([]byte(raw), &rebalance)
+	}
+	return action, rebalance
+}
+
+// SpotNotices checks for spot notices now, rather than waiting for the next refresh, and updates the instance with
+// them. Off ec2 it returns ErrNoInstance without calling IMDS.
+func (ic *InstanceContext) SpotNotices() (*SpotAction, *Rebalance, error) {
+	if _, err := ic.Get(); err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), imdsTimeout)
+	defer cancel()
+	action, rebalance := ic.spotNotices(ctx)
+	ic.m.Lock()
+	defer ic.m.Unlock()
+	if ic.instance != nil {
+		// callers may still hold the old instance, so it's replaced rather than changed
+		updated := *ic.instance
+		updated.SpotAction, updated.Rebalance = action, rebalance
+		ic.instance = &updated
+	}
+	return action, rebalance, nil
+}
+
+func (ic *InstanceContext) metadata(ctx context.Context, path string) (string, error) {
+	out, err := ic.client.GetMetadata(ctx, &imds.GetMetadataInput{Path: path})
+	if err != nil {
+		return "", err
+	}
+	defer out.Content.Close()
+	data, err := io.ReadAll(out.Content)
+	return strings.TrimSpace(string(data)), err
+}
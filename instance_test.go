@@ -0,0 +1,74 @@
+package hypatia
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInstanceContext(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "false")
+	fake := NewFakeIMDS()
+	fake.Set("spot/instance-action", `{"action": "terminate", "time": "2030-01-01T00:00:00Z"}`)
+	fake.Set("instance-life-cycle", "spot")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	ic := &InstanceContext{Endpoint: server.URL, Refresh: 20 * time.Millisecond}
+	instance, err := ic.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Instance{
+		InstanceID:         "i-0123456789abcdef0",
+		InstanceType:       "m5.large",
+		AccountID:          "0123456789",
+		Region:             "us-west-2",
+		AvailabilityZone:   "us-west-2a",
+		AvailabilityZoneID: "usw2-az1",
+		ImageID:            "ami-0123456789abcdef0",
+		LocalIPv4:          "10.0.0.10",
+		MAC:                "02:00:00:00:00:01",
+		InterfaceID:        "eni-0123456789abcdef0",
+		Lifecycle:          "spot",
+		SpotAction:         &SpotAction{Action: "terminate", Time: "2030-01-01T00:00:00Z"},
+		UpdatedAt:          instance.UpdatedAt,
+	}
+	if instance.SpotAction == nil || *instance.SpotAction != *want.SpotAction {
+		t.Errorf("expected the spot action, got %+v", instance.SpotAction)
+	}
+	instance.SpotAction, want.SpotAction = nil, nil
+	if *instance != want {
+		t.Errorf("expected\n%+v\ngot\n%+v", want, *instance)
+	}
+
+	fake.Set("public-ipv4", "54.0.0.1")
+	time.Sleep(100 * time.Millisecond)
+	if instance, _ := ic.Get(); instance.PublicIPv4 != "54.0.0.1" {
+		t.Errorf("expected a refresh to pick up the public address, got %+v", instance)
+	}
+}
+
+func TestInstanceContextOffEC2(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	srv := newProxyTestServer(nil)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	var out RequestResponse
+	json.Unmarshal(rec.Body.Bytes(), &out)
+	if out.Instance != nil || out.EC2InstanceId != nil {
+		t.Errorf("expected no instance: %s", rec.Body.String())
+	}
+	for _, e := range out.Errors {
+		if strings.Contains(e, "IMDS") {
+			t.Errorf("expected a missing instance not to be an error: %s", e)
+		}
+	}
+	if _, err := srv.Instance.Get(); !errors.Is(err, ErrNoInstance) {
+		t.Errorf("expected ErrNoInstance, got %v", err)
+	}
+}
@@ -1,8 +1,15 @@
 package hypatia
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"os"
+	"strings"
+	"time"
 )
 
 // Example
@@ -12,37 +19,119 @@ type HealthCheck interface {
 	SetHealth(bool) error
 }
 
+const (
+	StatusHealthy   = "healthy"
+	StatusUnhealthy = "unhealthy"
+)
+
 // FileHealthcheck is a healthcheck that fails if the filepath requested doesn't exist, and succeeds if a file does
 // exist at that location. Default location is 'health.status'
+//
+// The file can also say what its status is, either as json like {"status": "unhealthy", "reason": "draining"} or as
+// a line like "unhealthy: draining". Empty or other content is healthy, so plain files keep working.
 type FileHealthcheck struct {
 	Filepath string
+	// MaxAge fails the check once the file hasn't been written for that long, so whatever keeps it healthy has to
+	// keep touching it, like a heartbeat. Zero never expires.
+	MaxAge time.Duration
+	// Extended writes the status into the file instead of removing it when unhealthy, so the reason is kept.
+	Extended bool
+}
+
+// FileStatus is what a health file says, and when it was last written.
+type FileStatus struct {
+	Status    string    `json:"status"`
+	Reason    string    `json:"reason,omitempty"`
+	Time      time.Time `json:"time"`
+	UpdatedAt time.Time `json:"-"`
 }
 
 func (hc *FileHealthcheck) GetHealth() error {
-	if _, err := os.Stat(hc.filename()); err != nil {
-		return errors.New("file [" + hc.filename() + "] not found")
+	status, err := hc.Status()
+	if err != nil {
+		return err
+	}
+	if status.Status != StatusHealthy {
+		if status.Reason == "" {
+			return errors.New("file [" + hc.filename() + "] is unhealthy")
+		}
+		return errors.New("file [" + hc.filename() + "] is unhealthy: " + status.Reason)
 	}
 	return nil
 }
 
+// Status reads the file. A file older than MaxAge is unhealthy, whatever it says.
+func (hc *FileHealthcheck) Status() (*FileStatus, error) {
+	// one open file, so the content and time match even if it's replaced meanwhile
+	f, err := os.Open(hc.filename())
+	if err != nil {
+		return nil, errors.New("file [" + hc.filename() + "] not found")
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	status := parseFileStatus(data)
+	status.UpdatedAt = info.ModTime()
+	if hc.MaxAge > 0 && time.Since(info.ModTime()) > hc.MaxAge {
+		// the reason doesn't say exactly how old, so it doesn't change while the file stays stale
+		status.Status = StatusUnhealthy
+		status.Reason = fmt.Sprintf("not updated for over %s", hc.MaxAge)
+	}
+	return status, nil
+}
+
+func parseFileStatus(data []byte) *FileStatus {
+	data = bytes.TrimSpace(data)
+	var status FileStatus
+	if len(data) > 0 && data[0] == '{' && json.Unmarshal(data, &status) == nil {
+		status.Status = strings.ToLower(status.Status)
+		if status.Status != StatusUnhealthy {
+			status.Status = StatusHealthy
+		}
+		return &status
+	}
+	word, reason, _ := strings.Cut(string(data), ":")
+	if strings.EqualFold(strings.TrimSpace(word), StatusUnhealthy) {
+		return &FileStatus{Status: StatusUnhealthy, Reason: strings.TrimSpace(reason)}
+	}
+	if strings.EqualFold(strings.TrimSpace(word), StatusHealthy) {
+		return &FileStatus{Status: StatusHealthy, Reason: strings.TrimSpace(reason)}
+	}
+	return &FileStatus{Status: StatusHealthy}
+}
+
 func (hc *FileHealthcheck) SetHealth(status bool) error {
+	if hc.Extended {
+		return hc.SetStatus(status, "")
+	}
 	if status {
 		return hc.enable()
 	}
 	return hc.disable()
 }
 
-func (hc *FileHealthcheck) enable() error {
-	f, err := os.Stat(hc.filename())
-	if err == nil && f.Name() != "" {
-		// file already exists
-		return nil
+// SetStatus writes the status, reason and time into the file. Writes are atomic, so a checker never reads half of one.
+func (hc *FileHealthcheck) SetStatus(healthy bool, reason string) error {
+	status := FileStatus{Status: StatusUnhealthy, Reason: reason, Time: time.Now().UTC()}
+	if healthy {
+		status.Status = StatusHealthy
 	}
-	c, err := os.Create(hc.filename())
+	data, err := json.Marshal(&status)
 	if err != nil {
 		return err
 	}
-	return c.Close()
+	return writeFileAtomic(hc.filename(), append(data, '\n'), 0644)
+}
+
+// enable writes an empty file even if one exists, which keeps a MaxAge fresh.
+func (hc *FileHealthcheck) enable() error {
+	return writeFileAtomic(hc.filename(), nil, 0644)
 }
 
 func (hc *FileHealthcheck) disable() error {
@@ -54,6 +143,34 @@ func (hc *FileHealthcheck) disable() error {
 	return os.Remove(hc.filename())
 }
 
+// Watch polls the file every interval and calls changed whenever its health or reason changes, including when it
+// goes stale, until ctx is done. A missing file is reported as unhealthy.
+func (hc *FileHealthcheck) Watch(ctx context.Context, interval time.Duration, changed func(FileStatus)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := hc.current()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		status := hc.current()
+		if status.Status != last.Status || status.Reason != last.Reason {
+			changed(status)
+		}
+		last = status
+	}
+}
+
+func (hc *FileHealthcheck) current() FileStatus {
+	status, err := hc.Status()
+	if err != nil {
+		return FileStatus{Status: StatusUnhealthy, Reason: err.Error()}
+	}
+	return *status
+}
+
 const defaultHealthFile = "health.status"
 
 func (hc *FileHealthcheck) filename() string {
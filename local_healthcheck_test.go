@@ -1,8 +1,13 @@
 package hypatia
 
 import (
+	"context"
+	"net/http"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLocalHealthCheck(t *testing.T) {
@@ -27,3 +32,124 @@ func TestLocalHealthCheck(t *testing.T) {
 		t.Fatal("expected test to fail final healthcheck: ", err)
 	}
 }
+
+func TestFileHealthcheckContent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test")
+	hc := FileHealthcheck{Filepath: path}
+	for _, tc := range []struct {
+		content, reason string
+		healthy         bool
+	}{
+		{"", "", true},
+		{"ok\n", "", true},
+		{"healthy: warm", "warm", true},
+		{"Unhealthy: draining\n", "draining", false},
+		{`{"status": "unhealthy", "reason": "db down", "time": "2030-01-01T00:00:00Z"}`, "db down", false},
+		{`{"status": "healthy"}`, "", true},
+	} {
+		if err := os.WriteFile(path, []byte(tc.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		status, err := hc.Status()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (status.Status == StatusHealthy) != tc.healthy || status.Reason != tc.reason {
+			t.Errorf("%q: expected healthy %t with reason %q, got %+v", tc.content, tc.healthy, tc.reason, status)
+		}
+		if err := hc.GetHealth(); (err == nil) != tc.healthy {
+			t.Errorf("%q: unexpected health %v", tc.content, err)
+		}
+	}
+
+	extended := FileHealthcheck{Filepath: path, Extended: true}
+	if err := extended.SetHealth(false); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := extended.Status(); err != nil || status.Status != StatusUnhealthy || status.Time.IsZero() {
+		t.Errorf("expected an unhealthy file with a time, got %+v %v", status, err)
+	}
+	if err := extended.SetStatus(false, "draining"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hc.GetHealth(); err == nil || !strings.Contains(err.Error(), "draining") {
+		t.Errorf("expected the reason, got %v", err)
+	}
+}
+
+func TestFileHealthcheckMaxAge(t *testing.T) {
+	hc := FileHealthcheck{Filepath: filepath.Join(t.TempDir(), "test"), MaxAge: time.Minute}
+	if err := hc.SetHealth(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := hc.GetHealth(); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Minute)
+	os.Chtimes(hc.Filepath, old, old)
+	if err := hc.GetHealth(); err == nil || !strings.Contains(err.Error(), "not updated") {
+		t.Errorf("expected a stale file to be unhealthy, got %v", err)
+	}
+	// the heartbeat
+	if err := hc.SetHealth(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := hc.GetHealth(); err != nil {
+		t.Errorf("expected setting health to refresh the file, got %v", err)
+	}
+}
+
+func TestWatchHealth(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	srv := newV1TestServer(t)
+	srv.HealthWatchInterval = 10 * time.Millisecond
+	srv.initState()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		srv.WatchHealth(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	fileEvents := func() []Event {
+		var found []Event
+		for _, e := range srv.Events.Since(0) {
+			if e.Type == EventHealth && e.Data["source"] == "file" {
+				found = append(found, e)
+			}
+		}
+		return found
+	}
+	waitFor := func(n int) []Event {
+		t.Helper()
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			if events := fileEvents(); len(events) >= n {
+				return events
+			}
+		}
+		t.Fatalf("expected %d file events, got %v", n, fileEvents())
+		return nil
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// as cmd/healthcheck would
+	outside := FileHealthcheck{Filepath: srv.RemoteHealth.Filepath}
+	if err := outside.SetStatus(true, "warm"); err != nil {
+		t.Fatal(err)
+	}
+	if events := waitFor(1); events[0].Data["slot"] != "remote" || events[0].Data["healthy"] != true || events[0].Data["reason"] != "warm" {
+		t.Errorf("unexpected event: %v", events[0])
+	}
+
+	// changes the server makes are already published
+	if rec := v1Do(srv, http.MethodPatch, "/v1/state", `{"localHealthy": true}`); rec.Code != http.StatusOK {
+		t.Fatal(rec.Body.String())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if events := fileEvents(); len(events) != 1 {
+		t.Errorf("expected the server's own change not to be published again, got %v", events)
+	}
+}
@@ -0,0 +1,174 @@
+package hypatia
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func (hs *Server) ServeNeighbors(res http.ResponseWriter, req *http.Request) {
+	var output RequestResponse
+	if hs.ServiceDiscovery == nil {
+		log.Println("no sd configured")
+		handleUnavailable(res, errNoServiceDiscovery)
+		return
+	}
+	services, err := hs.serviceMap()
+	if err != nil {
+		log.Println("unable to get sd data: ", err)
+		handleUnavailable(res, err)
+		return
+	}
+	for k, _ := range services.Tasks {
+		output.Tasks = append(output.Tasks, k)
+	}
+	sort.Strings(output.Tasks)
+	if detail, _ := strconv.ParseBool(req.URL.Query().Get("detail")); detail {
+		output.Neighbors = hs.neighborDetail(services)
+	}
+	data, err := json.Marshal(&output)
+	if err != nil {
+		log.Println("unable to json things: ", err)
+		handleISE(res)
+		return
+	}
+	writeResponse(res, data)
+}
+
+// neighborDetail returns the last polled state of every task in the service, polling now if nothing is running in
+// the background.
+func (hs *Server) neighborDetail(services *ServiceMap) []Neighbor {
+	if hs.NeighborPollInterval <= 0 {
+		hs.pollOnce(services)
+	}
+	hs.neighborsM.RLock()
+	defer hs.neighborsM.RUnlock()
+	output := make([]Neighbor, 0, len(services.Tasks))
+	for taskArn, u := range services.Tasks {
+		if n, ok := hs.neighbors[taskArn]; ok {
+			output = append(output, *n)
+			continue
+		}
+		taskArn, address := taskArn, u.Host
+		output = append(output, Neighbor{TaskArn: &taskArn, Address: &address})
+	}
+	sort.Slice(output, func(i, j int) bool {
+		return *output[i].TaskArn < *output[j].TaskArn
+	})
+	return output
+}
+
+// PollNeighbors polls every task in the service every NeighborPollInterval until ctx is done. Without an interval
+// or service discovery, /tasks?detail=true polls on demand instead and this does nothing.
+func (hs *Server) PollNeighbors(ctx context.Context) {
+	if hs.NeighborPollInterval <= 0 || hs.ServiceDiscovery == nil {
+		return
+	}
+	hs.initServer()
+	ticker := time.NewTicker(hs.NeighborPollInterval)
+	defer ticker.Stop()
+	for {
+		if services, err := hs.serviceMap(); err == nil {
+			hs.pollOnce(services)
+		} else {
+			log.Println("unable to poll neighbors: ", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pollOnce gets the status of every task and records what it sees. A failed poll keeps the task's
+// last known state and records the error.
+func (hs *Server) pollOnce(services *ServiceMap) {
+	var wait sync.WaitGroup
+	results := make(map[string]*Neighbor, len(services.Tasks))
+	var m sync.Mutex
+	for taskArn, u := range services.Tasks {
+		wait.Add(1)
+		go func(taskArn string, u *url.URL) {
+			defer wait.Done()
+			n := hs.pollNeighbor(taskArn, u)
+			m.Lock()
+			results[taskArn] = n
+			m.Unlock()
+		}(taskArn, u)
+	}
+	wait.Wait()
+
+	hs.neighborsM.Lock()
+	defer hs.neighborsM.Unlock()
+	previous := hs.neighbors
+	hs.neighbors = results
+	for taskArn, n := range results {
+		if n.LastSeen == nil && previous[taskArn] != nil {
+			last := *previous[taskArn]
+			last.Errors = n.Errors
+			hs.neighbors[taskArn] = &last
+		}
+	}
+}
+
+// pollNeighbor reads this task's status directly, and calls GET / on any other task.
+func (hs *Server) pollNeighbor(taskArn string, u *url.URL) *Neighbor {
+	address := u.Host
+	n := &Neighbor{TaskArn: &taskArn, Address: &address}
+	var output RequestResponse
+	if self, err := hs.isSelf(taskArn); err == nil && self {
+		var errs []error
+		output, errs = hs.status()
+		for _, err := range errs {
+			output.Errors = append(output.Errors, err.Error())
+		}
+	} else if code, err := hs.getStatus(u, &output); err != nil {
+		n.Errors = []string{err.Error()}
+		return n
+	} else if code != http.StatusOK {
+		n.Errors = output.Errors
+		return n
+	}
+	lastSeen := time.Now().UTC().Format(time.RFC3339)
+	n.Errors = output.Errors
+	n.LocalHealth = output.LocalHealth
+	n.RemoteHealth = output.RemoteHealth
+	n.TaskProtectionEnabled = output.TaskProtectionEnabled
+	n.TaskProtectionExpiry = output.TaskProtectionExpiry
+	n.EC2InstanceId = output.EC2InstanceId
+	n.LastSeen = &lastSeen
+	return n
+}
+
+// getStatus calls GET / on a neighbor, as one hop, with the same transport the proxy uses.
+func (hs *Server) getStatus(u *url.URL, output *RequestResponse) (int, error) {
+	target := *u
+	target.Path = "/"
+	req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set(HeaderHops, "1")
+	res, err := hs.Balancer.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal(body, output); err != nil {
+		return 0, fmt.Errorf("unexpected response (%d): %s", res.StatusCode, err)
+	}
+	return res.StatusCode, nil
+}
@@ -0,0 +1,88 @@
+package hypatia
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestNeighborDetail(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	healthy := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(`{"localHealth":"Healthy","remoteHealth":"Unhealthy","taskProtectionEnabled":true,"ec2Instance":"i-cafe"}`))
+	}))
+	defer healthy.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	hu, _ := url.Parse(healthy.URL)
+	bu, _ := url.Parse(broken.URL)
+	srv := newProxyTestServer(&staticDiscovery{tasks: map[string]*url.URL{
+		"arn:aws:ecs:us-west-2:012:task/default/a": hu,
+		"arn:aws:ecs:us-west-2:012:task/default/b": bu,
+		// this task is read directly rather than over the network
+		testSelfArn: {Scheme: "http", Host: "127.0.0.1:1"},
+	}})
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/tasks?detail=true", nil))
+	var output RequestResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &output); err != nil {
+		t.Fatal(err)
+	}
+	if len(output.Tasks) != 3 || len(output.Neighbors) != 3 {
+		t.Fatalf("expected three tasks with detail, got %s", rec.Body.String())
+	}
+	a, b, self := output.Neighbors[0], output.Neighbors[1], output.Neighbors[2]
+	if a.RemoteHealth == nil || *a.RemoteHealth != "Unhealthy" || a.EC2InstanceId == nil || a.LastSeen == nil {
+		t.Errorf("expected detail for healthy neighbor: %s", rec.Body.String())
+	}
+	if *a.Address != hu.Host {
+		t.Errorf("expected address %s, got %s", hu.Host, *a.Address)
+	}
+	if b.LastSeen != nil || len(b.Errors) == 0 {
+		t.Errorf("expected errors for broken neighbor: %s", rec.Body.String())
+	}
+	if self.LastSeen == nil || self.LocalHealth == nil {
+		t.Errorf("expected detail for this task: %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/tasks", nil))
+	output = RequestResponse{}
+	json.Unmarshal(rec.Body.Bytes(), &output)
+	if len(output.Neighbors) != 0 {
+		t.Errorf("expected no detail without the query parameter")
+	}
+}
+
+func TestPollNeighbors(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	polled := make(chan struct{}, 100)
+	neighbor := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		polled <- struct{}{}
+		res.Write([]byte(`{"localHealth":"Healthy"}`))
+	}))
+	defer neighbor.Close()
+	u, _ := url.Parse(neighbor.URL)
+	srv := newProxyTestServer(&staticDiscovery{tasks: map[string]*url.URL{testNeighborArn: u}})
+	srv.NeighborPollInterval = time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	srv.PollNeighbors(ctx)
+	if len(polled) < 2 {
+		t.Errorf("expected the neighbor to be polled repeatedly, got %d", len(polled))
+	}
+	srv.neighborsM.RLock()
+	n := srv.neighbors[testNeighborArn]
+	srv.neighborsM.RUnlock()
+	if n == nil || n.LastSeen == nil {
+		t.Errorf("expected the polled detail to be kept, got %+v", n)
+	}
+}
@@ -0,0 +1,187 @@
+package hypatia
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const openAPIVersion = "3.0.3"
+
+func (hs *Server) ServeOpenAPI(res http.ResponseWriter, _ *http.Request) {
+	writeJSON(res, OpenAPI())
+}
+
+// OpenAPI describes the /v1 api. Schemas are generated from the go types the handlers use, so the document always
+// matches what the server accepts and returns. Field descriptions and limits come from doc, minimum and maximum struct
+// tags.
+func OpenAPI() map[string]any {
+	b := &schemaBuilder{components: map[string]any{}}
+	errorResponse := map[string]any{
+		"description": "the request failed",
+		"content":     jsonContent(b.schema(reflect.TypeOf(V1Error{}))),
+	}
+	paths := map[string]any{}
+	for _, route := range v1Routes() {
+		op := map[string]any{
+			"summary":     route.summary,
+			"operationId": operationID(route),
+			"responses": map[string]any{
+				"200": map[string]any{
+					"description": "ok",
+					"content":     jsonContent(b.schema(reflect.TypeOf(route.response))),
+				},
+				"default": errorResponse,
+			},
+		}
+		if route.request != nil {
+			t := reflect.TypeOf(route.request)
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content":  jsonContent(b.schema(t)),
+			}
+			// requests are decoded strictly, while responses may grow new fields
+			b.components[t.Name()].(map[string]any)["additionalProperties"] = false
+		}
+		if isWrite(&http.Request{Method: route.method}) {
+			op["security"] = []any{map[string]any{}, map[string]any{"bearer": []any{}}}
+		}
+		var params []any
+		for _, p := range route.query {
+			params = append(params, map[string]any{
+				"name":        p.name,
+				"in":          "query",
+				"description": p.doc,
+				"schema":      map[string]any{"type": p.kind},
+			})
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+		item, _ := paths[route.path].(map[string]any)
+		if item == nil {
+			item = map[string]any{}
+			paths[route.path] = item
+		}
+		item[strings.ToLower(route.method)] = op
+	}
+	return map[string]any{
+		"openapi": openAPIVersion,
+		"info": map[string]any{
+			"title":       "hypatia",
+			"version":     "1",
+			"description": "Inspect and change an ecs task's health checks and task protection, and reach the other tasks in its service through /task/{arn}/v1/...",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": b.components,
+			"securitySchemes": map[string]any{
+				"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func operationID(route v1Route) string {
+	name := strings.TrimSuffix(strings.TrimPrefix(route.path, v1Prefix+"/"), ".json")
+	return strings.ToLower(route.method) + strings.ToUpper(name[:1]) + name[1:]
+}
+
+func jsonContent(schema map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+type schemaBuilder struct {
+	components map[string]any
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schema describes t, adding named structs to the components and referring to them by name.
+func (b *schemaBuilder) schema(t reflect.Type) map[string]any {
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(Duration(0)):
+		return map[string]any{"type": "string", "example": "5s"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if _, ok := b.components[t.Name()]; !ok {
+			// claim the name first so recursive types terminate
+			b.components[t.Name()] = nil
+			b.components[t.Name()] = b.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+func (b *schemaBuilder) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, omitempty, ok := jsonField(f)
+		if !ok {
+			continue
+		}
+		s := b.schema(f.Type)
+		if doc := f.Tag.Get("doc"); doc != "" || f.Tag.Get("minimum") != "" || f.Tag.Get("maximum") != "" {
+			if ref, isRef := s["$ref"]; isRef {
+				// siblings of $ref are ignored in openapi 3.0
+				s = map[string]any{"allOf": []any{map[string]any{"$ref": ref}}}
+			}
+			if doc != "" {
+				s["description"] = doc
+			}
+			for _, limit := range []string{"minimum", "maximum"} {
+				if v, err := strconv.Atoi(f.Tag.Get(limit)); err == nil {
+					s[limit] = v
+				}
+			}
+		}
+		properties[name] = s
+		if !omitempty && f.Type.Kind() != reflect.Pointer {
+			required = append(required, name)
+		}
+	}
+	out := map[string]any{"type": "object", "properties": properties}
+	if required != nil {
+		out["required"] = required
+	}
+	return out
+}
+
+// jsonField reads a field's json name the way encoding/json does.
+func jsonField(f reflect.StructField) (name string, omitempty bool, ok bool) {
+	if !f.IsExported() {
+		return "", false, false
+	}
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", false, false
+	}
+	name, opts, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = f.Name
+	}
+	return name, strings.Contains(","+opts+",", ",omitempty,"), true
+}
@@ -0,0 +1,85 @@
+package hypatia
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPI(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newProxyTestServer(nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var doc struct {
+		OpenAPI    string                                `json:"openapi"`
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties           map[string]json.RawMessage `json:"properties"`
+				Required             []string                   `json:"required"`
+				AdditionalProperties *bool                      `json:"additionalProperties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenAPI != openAPIVersion {
+		t.Errorf("unexpected version %q", doc.OpenAPI)
+	}
+	for _, route := range v1Routes() {
+		if _, ok := doc.Paths[route.path][strings.ToLower(route.method)]; !ok {
+			t.Errorf("%s %s is missing from the document", route.method, route.path)
+		}
+	}
+
+	// every schema matches the json encoding of its go type
+	for _, v := range []any{V1StateRequest{}, V1State{}, V1Health{}, V1Protection{}, V1Tasks{}, V1Ping{}, V1Error{}, Neighbor{}, Instance{}, SpotAction{}, Rebalance{}} {
+		typ := reflect.TypeOf(v)
+		schema, ok := doc.Components.Schemas[typ.Name()]
+		if !ok {
+			t.Errorf("%s is missing from the document", typ.Name())
+			continue
+		}
+		var fields, required []string
+		for i := 0; i < typ.NumField(); i++ {
+			name, omitempty, ok := jsonField(typ.Field(i))
+			if !ok {
+				continue
+			}
+			fields = append(fields, name)
+			if !omitempty && typ.Field(i).Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+		var properties []string
+		for name := range schema.Properties {
+			properties = append(properties, name)
+		}
+		sort.Strings(fields)
+		sort.Strings(properties)
+		if !reflect.DeepEqual(fields, properties) {
+			t.Errorf("%s: expected properties %v, got %v", typ.Name(), fields, properties)
+		}
+		if !reflect.DeepEqual(required, schema.Required) {
+			t.Errorf("%s: expected required %v, got %v", typ.Name(), required, schema.Required)
+		}
+	}
+	if p := doc.Components.Schemas["V1StateRequest"].AdditionalProperties; p == nil || *p {
+		t.Error("expected requests to reject additional properties")
+	}
+
+	// every reference resolves
+	for _, ref := range strings.Split(rec.Body.String(), `"$ref":"#/components/schemas/`)[1:] {
+		name, _, _ := strings.Cut(ref, `"`)
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			t.Errorf("dangling reference to %s", name)
+		}
+	}
+}
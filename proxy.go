@@ -0,0 +1,220 @@
+package hypatia
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderTargetTask    = "X-Hypatia-Target-Task"
+	HeaderTargetAddress = "X-Hypatia-Target-Address"
+	HeaderHops          = "X-Hypatia-Hops"
+
+	defaultProxyDialTimeout           = 2 * time.Second
+	defaultProxyResponseHeaderTimeout = 10 * time.Second
+	defaultProxyTimeout               = 30 * time.Second
+	defaultMaxProxyHops               = 4
+)
+
+var errTaskNotFound = errors.New("task not found in service")
+
+type proxyTargetKey struct{}
+
+type proxyTarget struct {
+	taskArn string
+	url     *url.URL
+	path    string
+	err     error
+}
+
+func (hs *Server) newProxy() *httputil.ReverseProxy {
+	dialTimeout := hs.ProxyDialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = defaultProxyDialTimeout
+	}
+	headerTimeout := hs.ProxyResponseHeaderTimeout
+	if headerTimeout == 0 {
+		headerTimeout = defaultProxyResponseHeaderTimeout
+	}
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			// ServeProxy resolves the target up front so a bad arn never reaches the transport
+			if target, ok := req.Context().Value(proxyTargetKey{}).(*proxyTarget); ok {
+				req.URL.Scheme = target.url.Scheme
+				req.URL.Host = target.url.Host
+				req.URL.Path = target.path
+				req.URL.RawPath = ""
+			}
+		},
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: dialTimeout}).DialContext,
+			ResponseHeaderTimeout: headerTimeout,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSClientConfig:       hs.ProxyTLSConfig,
+		},
+		ErrorHandler: func(res http.ResponseWriter, req *http.Request, err error) {
+			log.Println("proxy error: ", err)
+			if target, ok := req.Context().Value(proxyTargetKey{}).(*proxyTarget); ok {
+				target.err = err
+			}
+			status := http.StatusBadGateway
+			if errors.Is(err, context.DeadlineExceeded) {
+				status = http.StatusGatewayTimeout
+			}
+			handleError(res, status, err)
+		},
+	}
+}
+
+func (hs *Server) ServeProxy(res http.ResponseWriter, req *http.Request) {
+	hops, ok := hs.checkHops(res, req)
+	if !ok {
+		return
+	}
+	ref, rest := extractTask(req)
+	taskArn, target, err := hs.resolveTarget(ref)
+	if err != nil {
+		log.Println("unable to proxy: ", err)
+		if errors.Is(err, errTaskNotFound) {
+			handleError(res, http.StatusNotFound, err)
+		} else {
+			handleUnavailable(res, err)
+		}
+		return
+	}
+	hs.forward(res, req, hops, &proxyTarget{taskArn: taskArn, url: target, path: rest})
+}
+
+// ServeAny proxies /any/{rest...} to /{rest} on a task chosen by the Balancer.
+func (hs *Server) ServeAny(res http.ResponseWriter, req *http.Request) {
+	hops, ok := hs.checkHops(res, req)
+	if !ok {
+		return
+	}
+	if hs.ServiceDiscovery == nil {
+		handleUnavailable(res, errNoServiceDiscovery)
+		return
+	}
+	services, err := hs.serviceMap()
+	if err != nil {
+		log.Println("unable to get sd data: ", err)
+		handleUnavailable(res, err)
+		return
+	}
+	taskArn, target, err := hs.Balancer.Pick(services, req)
+	if err != nil {
+		handleUnavailable(res, err)
+		return
+	}
+	pt := &proxyTarget{taskArn: taskArn, url: target, path: "/" + strings.TrimPrefix(req.URL.Path[len("/any"):], "/")}
+	// deferred, since the proxy panics with http.ErrAbortHandler when the response is cut off
+	defer func() { hs.Balancer.Done(taskArn, target, pt.err) }()
+	hs.forward(res, req, hops, pt)
+}
+
+func (hs *Server) ServeBalancer(res http.ResponseWriter, _ *http.Request) {
+	data, err := json.Marshal(hs.Balancer.Stats())
+	if err != nil {
+		log.Println("unable to json things: ", err)
+		handleISE(res)
+		return
+	}
+	writeResponse(res, data)
+}
+
+// checkHops reads the hop count off an incoming request, writing an error and returning false if it can't be proxied.
+func (hs *Server) checkHops(res http.ResponseWriter, req *http.Request) (int, bool) {
+	hops, err := proxyHops(req)
+	if err != nil {
+		handleError(res, http.StatusBadRequest, err)
+		return 0, false
+	}
+	maxHops := hs.MaxProxyHops
+	if maxHops == 0 {
+		maxHops = defaultMaxProxyHops
+	}
+	if hops >= maxHops {
+		handleError(res, http.StatusLoopDetected, fmt.Errorf("request has passed through %d proxies", hops))
+		return 0, false
+	}
+	return hops, true
+}
+
+// forward sends req to a resolved neighbor. target.err is set if the neighbor couldn't be reached.
+func (hs *Server) forward(res http.ResponseWriter, req *http.Request, hops int, target *proxyTarget) {
+	res.Header().Set(HeaderTargetTask, target.taskArn)
+	res.Header().Set(HeaderTargetAddress, target.url.Host)
+
+	timeout := hs.ProxyTimeout
+	if timeout == 0 {
+		timeout = defaultProxyTimeout
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	out := req.WithContext(context.WithValue(ctx, proxyTargetKey{}, target))
+	out.Header = req.Header.Clone()
+	out.Header.Set(HeaderHops, strconv.Itoa(hops+1))
+	keepSignedPath(out)
+	start := time.Now()
+	recorder := &statusRecorder{ResponseWriter: res}
+	hs.proxy.ServeHTTP(recorder, out)
+	data := map[string]any{
+		"task":       target.taskArn,
+		"method":     req.Method,
+		"path":       target.path,
+		"status":     recorder.status,
+		"durationMs": time.Since(start).Milliseconds(),
+	}
+	if target.err != nil {
+		data["error"] = target.err.Error()
+	}
+	hs.Events.Publish(EventProxy, data)
+}
+
+// resolveTarget looks up a task's arn and address by arn or task id. Unknown tasks wrap errTaskNotFound; anything else
+// is a discovery failure.
+func (hs *Server) resolveTarget(ref string) (string, *url.URL, error) {
+	if ref == "" {
+		return "", nil, fmt.Errorf("unable to extract arn: %w", errTaskNotFound)
+	}
+	if hs.ServiceDiscovery == nil {
+		return "", nil, errNoServiceDiscovery
+	}
+	services, err := hs.serviceMap()
+	if err != nil {
+		return "", nil, fmt.Errorf("error getting data from proxy: %w", err)
+	}
+	if addr, ok := services.Tasks[ref]; ok {
+		return ref, addr, nil
+	}
+	for taskArn, addr := range services.Tasks {
+		if matchTask(ref, taskArn) {
+			return taskArn, addr, nil
+		}
+	}
+	return "", nil, fmt.Errorf("%w: %s", errTaskNotFound, ref)
+}
+
+func proxyHops(req *http.Request) (int, error) {
+	raw := req.Header.Get(HeaderHops)
+	if raw == "" {
+		return 0, nil
+	}
+	hops, err := strconv.Atoi(raw)
+	if err != nil || hops < 0 {
+		return 0, fmt.Errorf("invalid %s header: %q", HeaderHops, raw)
+	}
+	return hops, nil
+}
@@ -0,0 +1,143 @@
+package hypatia
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	testSelfArn     = "arn:aws:ecs:us-west-2:012:task/default/self"
+	testNeighborArn = "arn:aws:ecs:us-west-2:012:task/default/cafe"
+)
+
+type staticDiscovery struct {
+	tasks map[string]*url.URL
+	err   error
+}
+
+func (s *staticDiscovery) GetServiceMap() (*ServiceMap, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &ServiceMap{Tasks: s.tasks}, nil
+}
+
+type staticMetadata string
+
+func (s staticMetadata) Self() (*TaskMetadata, error) {
+	arn := string(s)
+	return &TaskMetadata{TaskARN: &arn}, nil
+}
+
+func newProxyTestServer(sd ServiceDiscoveryIface) *Server {
+	return &Server{
+		Protection:       &TaskProtectionStub{Protection: &Protection{}},
+		Metadata:         staticMetadata(testSelfArn),
+		ServiceDiscovery: sd,
+	}
+}
+
+func TestProxy(t *testing.T) {
+	var hops string
+	upstream := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		hops = req.Header.Get(HeaderHops)
+		res.Write([]byte("neighbor"))
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	srv := newProxyTestServer(&staticDiscovery{tasks: map[string]*url.URL{testNeighborArn: u}})
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/task/"+testNeighborArn, nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "neighbor" {
+		t.Fatalf("expected neighbor response, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if hops != "1" {
+		t.Errorf("expected hop count of 1, got %q", hops)
+	}
+	if rec.Header().Get(HeaderTargetTask) != testNeighborArn || rec.Header().Get(HeaderTargetAddress) != u.Host {
+		t.Errorf("missing target headers: %v", rec.Header())
+	}
+}
+
+func TestProxyPath(t *testing.T) {
+	var got string
+	upstream := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		got = req.Method + " " + req.URL.RequestURI()
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	srv := newProxyTestServer(&staticDiscovery{tasks: map[string]*url.URL{testNeighborArn: u}})
+
+	cases := map[string]string{
+		"/task/" + testNeighborArn + "/ping":          "GET /ping",
+		"/task/" + testNeighborArn + "/stats?x=1&y=2": "GET /stats?x=1&y=2",
+		"/task/cafe/ping":                             "GET /ping",
+		"/task/cafe?debug=true":                       "GET /?debug=true",
+	}
+	for path, expected := range cases {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK || got != expected {
+			t.Errorf("%s: expected %q, got %d %q", path, expected, rec.Code, got)
+		}
+		if rec.Header().Get(HeaderTargetTask) != testNeighborArn {
+			t.Errorf("%s: expected target header with full arn, got %v", path, rec.Header())
+		}
+	}
+}
+
+func TestProxySelf(t *testing.T) {
+	srv := newProxyTestServer(nil)
+	srv.RemoteHealth = FileHealthcheck{Filepath: filepath.Join(t.TempDir(), "remote")}
+	srv.RemoteHealth.SetHealth(true)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/task/self/ping", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "woof" {
+		t.Errorf("expected local ping, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestProxySelfTasks(t *testing.T) {
+	u, _ := url.Parse("http://127.0.0.1:1")
+	srv := newProxyTestServer(&staticDiscovery{tasks: map[string]*url.URL{testNeighborArn: u}})
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/task/self/tasks", nil))
+	var output RequestResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &output); err != nil || len(output.Tasks) != 1 || output.Tasks[0] != testNeighborArn {
+		t.Errorf("expected the task list, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestProxyErrors(t *testing.T) {
+	dead, _ := url.Parse("http://127.0.0.1:1")
+	cases := []struct {
+		name   string
+		sd     *staticDiscovery
+		hops   string
+		status int
+	}{
+		{"unknown task", &staticDiscovery{tasks: map[string]*url.URL{}}, "", http.StatusNotFound},
+		{"discovery failure", &staticDiscovery{err: errors.New("boom")}, "", http.StatusServiceUnavailable},
+		{"loop", &staticDiscovery{tasks: map[string]*url.URL{testNeighborArn: dead}}, "4", http.StatusLoopDetected},
+		{"bad hops", &staticDiscovery{tasks: map[string]*url.URL{testNeighborArn: dead}}, "x", http.StatusBadRequest},
+		{"unreachable", &staticDiscovery{tasks: map[string]*url.URL{testNeighborArn: dead}}, "", http.StatusBadGateway},
+	}
+	for _, c := range cases {
+		srv := newProxyTestServer(c.sd)
+		req := httptest.NewRequest(http.MethodGet, "/task/"+testNeighborArn, nil)
+		if c.hops != "" {
+			req.Header.Set(HeaderHops, c.hops)
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		if rec.Code != c.status {
+			t.Errorf("%s: expected %d, got %d: %s", c.name, c.status, rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package scenario
+
+import (
+	"fmt"
+	"github.com/petderek/hypatia"
+	"io"
+	"strings"
+	"time"
+)
+
+// selfTask is how the report names the endpoint's own task when a step has no targets.
+const selfTask = "self"
+
+// Report is the timeline of a plan run.
+type Report struct {
+	Plan     string           `json:"plan"`
+	Passed   bool             `json:"passed"`
+	Started  time.Time        `json:"started"`
+	Finished time.Time        `json:"finished"`
+	Duration hypatia.Duration `json:"duration"`
+	Steps    []StepResult     `json:"steps"`
+}
+
+type StepResult struct {
+	Index    int              `json:"index"`
+	Name     string           `json:"name"`
+	Action   string           `json:"action"`
+	Started  time.Time        `json:"started"`
+	Duration hypatia.Duration `json:"duration"`
+	Targets  []TargetResult   `json:"targets,omitempty"`
+	// Error is set when the step couldn't run at all, like when tasks couldn't be listed.
+	Error string `json:"error,omitempty"`
+}
+
+type TargetResult struct {
+	Task  string `json:"task"`
+	Error string `json:"error,omitempty"`
+}
+
+func targetResult(task string, err error) TargetResult {
+	if task == "" {
+		task = selfTask
+	}
+	result := TargetResult{Task: task}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func (s *StepResult) Passed() bool {
+	if s.Error != "" {
+		return false
+	}
+	for _, t := range s.Targets {
+		if t.Error != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *StepResult) failures() int {
+	var failed int
+	for _, t := range s.Targets {
+		if t.Error != "" {
+			failed++
+		}
+	}
+	return failed
+}
+
+// WriteMarkdown renders the report as a summary table followed by the details of anything that failed.
+func (r *Report) WriteMarkdown(w io.Writer) error {
+	result := "passed"
+	if !r.Passed {
+		result = "failed"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Scenario: %s\n\n", r.Plan)
+	fmt.Fprintf(&b, "**%s** in %s, started %s\n\n", result, r.Duration, r.Started.Format(time.RFC3339))
+	b.WriteString("| # | Step | Action | Offset | Duration | Targets | Result |\n")
+	b.WriteString("|---|------|--------|--------|----------|---------|--------|\n")
+	for _, s := range r.Steps {
+		status := "ok"
+		if !s.Passed() {
+			status = "FAILED"
+		}
+		if n := s.failures(); n > 0 {
+			status = fmt.Sprintf("FAILED (%d of %d)", n, len(s.Targets))
+		}
+		offset := hypatia.Duration(s.Started.Sub(r.Started).Truncate(time.Millisecond))
+		fmt.Fprintf(&b, "| %d | %s | %s | +%s | %s | %d | %s |\n", s.Index, escape(s.Name), s.Action, offset,
+			hypatia.Duration(time.Duration(s.Duration).Truncate(time.Millisecond)), len(s.Targets), status)
+	}
+	for _, s := range r.Steps {
+		if s.Passed() {
+			continue
+		}
+		fmt.Fprintf(&b, "\n## Step %d: %s\n\n", s.Index, s.Name)
+		if s.Error != "" {
+			fmt.Fprintf(&b, "%s\n", s.Error)
+		}
+		for _, t := range s.Targets {
+			if t.Error != "" {
+				fmt.Fprintf(&b, "- `%s`: %s\n", t.Task, escape(t.Error))
+			}
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// escape keeps text from breaking out of a markdown table cell.
+func escape(s string) string {
+	return strings.NewReplacer("|", `\|`, "\n", " ").Replace(s)
+}
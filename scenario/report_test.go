@@ -0,0 +1,42 @@
+package scenario
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReportMarkdown(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	report := &Report{
+		Plan:    "demo",
+		Started: start,
+		Steps: []StepResult{
+			{Index: 1, Name: "flip", Action: ActionSetHealth, Started: start, Targets: []TargetResult{{Task: "a"}, {Task: "b", Error: "nope | bad"}}},
+			{Index: 2, Name: "nap", Action: ActionWait, Started: start.Add(1500 * time.Millisecond)},
+		},
+	}
+	var b strings.Builder
+	if err := report.WriteMarkdown(&b); err != nil {
+		t.Fatal(err)
+	}
+	md := b.String()
+	for _, want := range []string{
+		"# Scenario: demo",
+		"**failed**",
+		"| 1 | flip | set-health | +0s | 0s | 2 | FAILED (1 of 2) |",
+		"| 2 | nap | wait | +1.5s | 0s | 0 | ok |",
+		"## Step 1: flip",
+		"- `b`: nope \\| bad",
+	} {
+		if !strings.Contains(md, want) {
+			t.Errorf("expected %q in:\n%s", want, md)
+		}
+	}
+
+	data, _ := json.Marshal(report)
+	if !strings.Contains(string(data), `"duration":"0s"`) || !strings.Contains(string(data), `"error":"nope | bad"`) {
+		t.Errorf("unexpected json: %s", data)
+	}
+}
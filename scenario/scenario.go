@@ -0,0 +1,437 @@
+// Package scenario runs declarative deployment experiments, like flipping health on a share of a service's tasks,
+// against the hypatia api and records what happened as a timeline.
+package scenario
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/petderek/hypatia"
+	"github.com/petderek/hypatia/client"
+	"gopkg.in/yaml.v3"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ActionSetHealth   = "set-health"
+	ActionProtect     = "protect"
+	ActionBroadcast   = "broadcast"
+	ActionWait        = "wait"
+	ActionStress      = "stress"
+	ActionCrash       = "crash"
+	ActionAssertState = "assert-state"
+
+	defaultPollInterval = 500 * time.Millisecond
+)
+
+type Plan struct {
+	Name string `json:"name"`
+	// Endpoint is the hypatia server the plan runs through. The command line can override it.
+	Endpoint string `json:"endpoint,omitempty"`
+	// ContinueOnError keeps running steps after one fails. The report still fails.
+	ContinueOnError bool   `json:"continueOnError,omitempty"`
+	Steps           []Step `json:"steps"`
+}
+
+type Step struct {
+	Name   string `json:"name,omitempty"`
+	Action string `json:"action"`
+	// Targets picks the tasks the step runs against. Without it the step runs against the endpoint's own task.
+	Targets *Targets `json:"targets,omitempty"`
+
+	// Slot is local or remote, for set-health.
+	Slot    string `json:"slot,omitempty"`
+	Healthy *bool  `json:"healthy,omitempty"`
+
+	// Enabled and Minutes are for protect. Minutes defaults to the agent's expiry.
+	Enabled *bool `json:"enabled,omitempty"`
+	Minutes *int  `json:"minutes,omitempty"`
+
+	// Duration is how long to wait, or how long to stress.
+	Duration hypatia.Duration `json:"duration,omitempty"`
+	CPU      int              `json:"cpu,omitempty"`
+	MemoryMB int              `json:"memoryMb,omitempty"`
+	// Stop ends any stress instead of starting it.
+	Stop bool `json:"stop,omitempty"`
+
+	ExitCode int `json:"exitCode,omitempty"`
+
+	Expect *Expect `json:"expect,omitempty"`
+	// RetryFor keeps checking an assert-state until it passes or this much time has gone by.
+	RetryFor hypatia.Duration `json:"retryFor,omitempty"`
+
+	// Step is what a broadcast runs against every task in the service.
+	Step *Step `json:"step,omitempty"`
+}
+
+// Targets selects tasks from the service, sorted by arn. Selections are combined.
+type Targets struct {
+	All bool `json:"all,omitempty"`
+	// Percent takes the first percent of tasks, rounded up.
+	Percent float64 `json:"percent,omitempty"`
+	Indexes []int   `json:"indexes,omitempty"`
+	// Arns accepts full arns or task ids.
+	Arns []string `json:"arns,omitempty"`
+}
+
+type Expect struct {
+	LocalHealthy  *bool `json:"localHealthy,omitempty"`
+	RemoteHealthy *bool `json:"remoteHealthy,omitempty"`
+	Protected     *bool `json:"protected,omitempty"`
+}
+
+// LoadPlan reads a yaml or json plan. Unknown fields are an error so typos don't quietly skip a step.
+func LoadPlan(path string) (*Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := ParsePlan(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return plan, nil
+}
+
+// ParsePlan reads a yaml plan. Json is yaml, so it works for both.
+func ParsePlan(data []byte) (*Plan, error) {
+	// yaml goes through json so both formats share the json tags
+	var raw any
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var plan Plan
+	if err := decoder.Decode(&plan); err != nil {
+		return nil, err
+	}
+	return &plan, plan.Validate()
+}
+
+func (p *Plan) Validate() error {
+	if len(p.Steps) == 0 {
+		return errors.New("plan has no steps")
+	}
+	var errs []error
+	for i := range p.Steps {
+		if err := p.Steps[i].validate(); err != nil {
+			errs = append(errs, fmt.Errorf("step %d (%s): %w", i+1, p.Steps[i].title(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Step) validate() error {
+	if s.Targets != nil {
+		if err := s.Targets.validate(); err != nil {
+			return err
+		}
+	}
+	switch s.Action {
+	case ActionSetHealth:
+		if s.Slot != "local" && s.Slot != "remote" {
+			return fmt.Errorf("slot must be local or remote, got %q", s.Slot)
+		}
+		if s.Healthy == nil {
+			return errors.New("healthy is required")
+		}
+	case ActionProtect:
+		if s.Enabled == nil {
+			return errors.New("enabled is required")
+		}
+		if s.Minutes != nil && (*s.Minutes <= 0 || !*s.Enabled) {
+			return errors.New("minutes must be positive and only set when enabling protection")
+		}
+	case ActionWait:
+		if s.Duration <= 0 {
+			return errors.New("duration is required")
+		}
+		if s.Targets != nil {
+			return errors.New("wait does not take targets")
+		}
+	case ActionStress:
+		if err := (&hypatia.StressRequest{CPU: s.CPU, MemoryMB: s.MemoryMB}).Validate(); err != nil {
+			return err
+		}
+		if !s.Stop && s.CPU == 0 && s.MemoryMB == 0 {
+			return errors.New("cpu or memoryMb is required unless stopping")
+		}
+	case ActionCrash:
+	case ActionAssertState:
+		if s.Expect == nil {
+			return errors.New("expect is required")
+		}
+	case ActionBroadcast:
+		if s.Targets != nil {
+			return errors.New("broadcast always runs against every task, use targets on a regular step instead")
+		}
+		if s.Step == nil {
+			return errors.New("step is required")
+		}
+		if s.Step.Action == ActionBroadcast || s.Step.Action == ActionWait {
+			return fmt.Errorf("can not broadcast %s", s.Step.Action)
+		}
+		if s.Step.Targets != nil {
+			return errors.New("a broadcast step does not take targets")
+		}
+		return s.Step.validate()
+	default:
+		return fmt.Errorf("unknown action %q", s.Action)
+	}
+	return nil
+}
+
+func (t *Targets) validate() error {
+	if t.Percent < 0 || t.Percent > 100 {
+		return fmt.Errorf("percent must be between 0 and 100, got %v", t.Percent)
+	}
+	for _, i := range t.Indexes {
+		if i < 0 {
+			return fmt.Errorf("index must not be negative, got %d", i)
+		}
+	}
+	if !t.All && t.Percent == 0 && len(t.Indexes) == 0 && len(t.Arns) == 0 {
+		return errors.New("targets selects no tasks")
+	}
+	return nil
+}
+
+func (s *Step) title() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.Action
+}
+
+// Runner runs plans through a hypatia server.
+type Runner struct {
+	Client *client.Client
+	// PollInterval is how often a retrying assert-state checks again. Defaults to half a second.
+	PollInterval time.Duration
+	// Progress, if set, is called as each step finishes.
+	Progress func(StepResult)
+}
+
+// Run executes every step in order and returns the timeline. The error is non-nil if any step failed.
+func (r *Runner) Run(ctx context.Context, plan *Plan) (*Report, error) {
+	report := &Report{Plan: plan.Name, Started: time.Now().UTC(), Passed: true}
+	for i := range plan.Steps {
+		if ctx.Err() != nil {
+			break
+		}
+		step := &plan.Steps[i]
+		result := r.runStep(ctx, i+1, step)
+		report.Steps = append(report.Steps, result)
+		if r.Progress != nil {
+			r.Progress(result)
+		}
+		if !result.Passed() {
+			report.Passed = false
+			if !plan.ContinueOnError {
+				break
+			}
+		}
+	}
+	report.Finished = time.Now().UTC()
+	report.Duration = hypatia.Duration(report.Finished.Sub(report.Started))
+	if !report.Passed {
+		return report, errors.New("scenario failed")
+	}
+	if err := ctx.Err(); err != nil {
+		report.Passed = false
+		return report, err
+	}
+	return report, nil
+}
+
+func (r *Runner) runStep(ctx context.Context, index int, step *Step) (result StepResult) {
+	result = StepResult{Index: index, Name: step.title(), Action: step.Action, Started: time.Now().UTC()}
+	defer func() {
+		result.Duration = hypatia.Duration(time.Since(result.Started))
+	}()
+	switch step.Action {
+	case ActionWait:
+		select {
+		case <-time.After(time.Duration(step.Duration)):
+		case <-ctx.Done():
+			result.Error = ctx.Err().Error()
+		}
+		return result
+	case ActionBroadcast:
+		errs, err := r.Client.Broadcast(ctx, func(c *client.Client) error {
+			return r.apply(ctx, c, step.Step)
+		})
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		for task, err := range errs {
+			result.Targets = append(result.Targets, targetResult(task, err))
+		}
+		sort.Slice(result.Targets, func(i, j int) bool { return result.Targets[i].Task < result.Targets[j].Task })
+		return result
+	}
+
+	clients := []*client.Client{r.Client}
+	if step.Targets != nil {
+		tasks, err := r.resolve(ctx, step.Targets)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		clients = clients[:0]
+		for _, task := range tasks {
+			clients = append(clients, r.Client.ForTask(task))
+		}
+	}
+	result.Targets = make([]TargetResult, len(clients))
+	var wait sync.WaitGroup
+	for i, c := range clients {
+		wait.Add(1)
+		go func(i int, c *client.Client) {
+			defer wait.Done()
+			result.Targets[i] = targetResult(c.Task(), r.apply(ctx, c, step))
+		}(i, c)
+	}
+	wait.Wait()
+	return result
+}
+
+// resolve turns a selection into task arns, in the order the service lists them.
+func (r *Runner) resolve(ctx context.Context, t *Targets) ([]string, error) {
+	tasks, err := r.Client.Neighbors(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tasks: %w", err)
+	}
+	sort.Strings(tasks)
+	picked := make(map[string]bool)
+	if t.All {
+		for _, task := range tasks {
+			picked[task] = true
+		}
+	}
+	count := int(math.Ceil(float64(len(tasks)) * t.Percent / 100))
+	for _, task := range tasks[:count] {
+		picked[task] = true
+	}
+	for _, i := range t.Indexes {
+		if i >= len(tasks) {
+			return nil, fmt.Errorf("index %d is out of range, the service has %d tasks", i, len(tasks))
+		}
+		picked[tasks[i]] = true
+	}
+	var extra []string
+	for _, ref := range t.Arns {
+		found := false
+		for _, task := range tasks {
+			if task == ref || strings.HasSuffix(task, "/"+ref) {
+				picked[task] = true
+				found = true
+			}
+		}
+		if !found {
+			// not listed yet, the proxy will say if it really doesn't exist
+			extra = append(extra, ref)
+		}
+	}
+	var out []string
+	for _, task := range tasks {
+		if picked[task] {
+			out = append(out, task)
+		}
+	}
+	return append(out, extra...), nil
+}
+
+// apply runs a single step against the task c is scoped to.
+func (r *Runner) apply(ctx context.Context, c *client.Client, step *Step) error {
+	switch step.Action {
+	case ActionSetHealth:
+		if step.Slot == "local" {
+			return c.SetLocalHealth(ctx, *step.Healthy)
+		}
+		return c.SetRemoteHealth(ctx, *step.Healthy)
+	case ActionProtect:
+		return c.SetProtection(ctx, *step.Enabled, step.Minutes)
+	case ActionStress:
+		if step.Stop {
+			return c.StopStress(ctx)
+		}
+		_, err := c.Stress(ctx, hypatia.StressRequest{CPU: step.CPU, MemoryMB: step.MemoryMB, Duration: step.Duration})
+		return err
+	case ActionCrash:
+		return c.Crash(ctx, step.ExitCode, 0)
+	case ActionAssertState:
+		return r.assert(ctx, c, step)
+	}
+	return fmt.Errorf("unknown action %q", step.Action)
+}
+
+func (r *Runner) assert(ctx context.Context, c *client.Client, step *Step) error {
+	interval := r.PollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	deadline := time.Now().Add(time.Duration(step.RetryFor))
+	for {
+		err := check(ctx, c, step.Expect)
+		if err == nil || !time.Now().Before(deadline) {
+			return err
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func check(ctx context.Context, c *client.Client, expect *Expect) error {
+	status, err := c.Status(ctx)
+	var apiErr *client.APIError
+	// errors reported alongside a 200, like no imds off of ec2, don't stop us from checking the state
+	if err != nil && !(errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusOK) {
+		return err
+	}
+	var errs []error
+	if expect.LocalHealthy != nil {
+		errs = append(errs, compareHealth("localHealth", status.LocalHealth, *expect.LocalHealthy))
+	}
+	if expect.RemoteHealthy != nil {
+		errs = append(errs, compareHealth("remoteHealth", status.RemoteHealth, *expect.RemoteHealthy))
+	}
+	if expect.Protected != nil {
+		actual := status.TaskProtectionEnabled != nil && *status.TaskProtectionEnabled
+		if actual != *expect.Protected {
+			errs = append(errs, fmt.Errorf("expected protected to be %t, got %t", *expect.Protected, actual))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func compareHealth(name string, actual *string, healthy bool) error {
+	expected := "Unhealthy"
+	if healthy {
+		expected = "Healthy"
+	}
+	if actual == nil {
+		return fmt.Errorf("expected %s to be %s, got nothing", name, expected)
+	}
+	if *actual != expected {
+		return fmt.Errorf("expected %s to be %s, got %s", name, expected, *actual)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package scenario
+
+import (
+	"context"
+	"fmt"
+	"github.com/petderek/hypatia"
+	"github.com/petderek/hypatia/client"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type staticDiscovery map[string]*url.URL
+
+func (s staticDiscovery) GetServiceMap() (*hypatia.ServiceMap, error) {
+	return &hypatia.ServiceMap{Tasks: s}, nil
+}
+
+type staticMetadata string
+
+func (s staticMetadata) Self() (*hypatia.TaskMetadata, error) {
+	arn := string(s)
+	return &hypatia.TaskMetadata{TaskARN: &arn}, nil
+}
+
+func taskArn(i int) string {
+	return fmt.Sprintf("arn:aws:ecs:us-west-2:012:task/default/task%d", i)
+}
+
+// newService starts n tasks that can all reach each other and returns a client for the first one.
+func newService(t *testing.T, n int) *client.Client {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	tasks := staticDiscovery{}
+	var first string
+	for i := 0; i < n; i++ {
+		arn := taskArn(i)
+		dir := t.TempDir()
+		local := hypatia.FileHealthcheck{Filepath: filepath.Join(dir, "local")}
+		remote := hypatia.FileHealthcheck{Filepath: filepath.Join(dir, "remote")}
+		local.SetHealth(true)
+		remote.SetHealth(true)
+		srv := httptest.NewServer(&hypatia.Server{
+			Protection:       &hypatia.TaskProtectionStub{Protection: &hypatia.Protection{TaskArn: &arn}},
+			Metadata:         staticMetadata(arn),
+			LocalHealth:      local,
+			RemoteHealth:     remote,
+			ServiceDiscovery: tasks,
+			Writeable:        true,
+			Exit:             func(int) {},
+		})
+		t.Cleanup(srv.Close)
+		tasks[arn], _ = url.Parse(srv.URL)
+		if first == "" {
+			first = srv.URL
+		}
+	}
+	c, err := client.New(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func run(t *testing.T, c *client.Client, yaml string) (*Report, error) {
+	plan, err := ParsePlan([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := &Runner{Client: c, PollInterval: 10 * time.Millisecond}
+	return runner.Run(context.Background(), plan)
+}
+
+func TestRunPlan(t *testing.T) {
+	c := newService(t, 4)
+	report, err := run(t, c, `
+name: flip some health
+steps:
+  - name: fail 30 percent
+    action: set-health
+    slot: remote
+    healthy: false
+    targets: {percent: 30}
+  - action: protect
+    enabled: true
+    minutes: 5
+    targets: {indexes: [3], arns: [task2]}
+  - action: wait
+    duration: 10ms
+  - name: first two failing
+    action: assert-state
+    expect: {remoteHealthy: false}
+    targets: {indexes: [0, 1]}
+  - action: assert-state
+    expect: {remoteHealthy: true, protected: true}
+    targets: {indexes: [2, 3]}
+  - action: broadcast
+    step: {action: set-health, slot: remote, healthy: true}
+  - action: assert-state
+    expect: {remoteHealthy: true}
+    targets: {all: true}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Passed || len(report.Steps) != 7 {
+		t.Fatalf("expected all 7 steps to pass: %+v", report)
+	}
+	if targets := report.Steps[0].Targets; len(targets) != 2 || targets[0].Task != taskArn(0) || targets[1].Task != taskArn(1) {
+		t.Errorf("expected 30 percent of 4 tasks to round up to the first 2: %+v", targets)
+	}
+	if targets := report.Steps[1].Targets; len(targets) != 2 || targets[0].Task != taskArn(2) || targets[1].Task != taskArn(3) {
+		t.Errorf("expected index and arn targets in service order: %+v", targets)
+	}
+	if len(report.Steps[5].Targets) != 4 {
+		t.Errorf("expected broadcast to reach every task: %+v", report.Steps[5])
+	}
+}
+
+func TestRunPlanFailure(t *testing.T) {
+	c := newService(t, 2)
+	report, err := run(t, c, `
+name: expect the wrong thing
+steps:
+  - action: assert-state
+    expect: {localHealthy: false}
+    retryFor: 30ms
+  - action: crash
+`)
+	if err == nil || report.Passed {
+		t.Fatal("expected the scenario to fail")
+	}
+	if len(report.Steps) != 1 {
+		t.Errorf("expected to stop after the failed step, ran %d", len(report.Steps))
+	}
+	if e := report.Steps[0].Targets[0]; e.Task != selfTask || !strings.Contains(e.Error, "expected localHealth to be Unhealthy") {
+		t.Errorf("unexpected result: %+v", e)
+	}
+
+	report, _ = run(t, c, `
+name: keep going
+continueOnError: true
+steps:
+  - action: set-health
+    slot: local
+    healthy: false
+    targets: {indexes: [5]}
+  - action: stress
+    cpu: 1
+    duration: 10ms
+`)
+	if report.Passed || len(report.Steps) != 2 || !report.Steps[1].Passed() {
+		t.Errorf("expected the second step to run and pass: %+v", report)
+	}
+	if !strings.Contains(report.Steps[0].Error, "out of range") {
+		t.Errorf("expected an out of range index: %+v", report.Steps[0])
+	}
+}
+
+func TestParsePlan(t *testing.T) {
+	bad := map[string]string{
+		"unknown field":   "steps: [{action: wait, duration: 1s, sleep: 1s}]",
+		"unknown action":  "steps: [{action: nap}]",
+		"no steps":        "name: empty",
+		"no slot":         "steps: [{action: set-health, healthy: true}]",
+		"bad percent":     "steps: [{action: crash, targets: {percent: 120}}]",
+		"empty targets":   "steps: [{action: crash, targets: {}}]",
+		"minutes off":     "steps: [{action: protect, enabled: false, minutes: 5}]",
+		"nested":          "steps: [{action: broadcast, step: {action: broadcast}}]",
+		"bad duration":    "steps: [{action: wait, duration: 5}]",
+		"missing expect":  "steps: [{action: assert-state}]",
+		"wait on targets": "steps: [{action: wait, duration: 1s, targets: {all: true}}]",
+		"too much memory": "steps: [{action: stress, memoryMb: 100000000}]",
+		"too much cpu":    "steps: [{action: stress, cpu: 1000000}]",
+	}
+	for name, plan := range bad {
+		if _, err := ParsePlan([]byte(plan)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	plan, err := ParsePlan([]byte(`{"name": "json", "steps": [{"action": "wait", "duration": "2s"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Steps[0].Duration != hypatia.Duration(2*time.Second) {
+		t.Errorf("expected json plans to parse, got %+v", plan)
+	}
+}
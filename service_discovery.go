@@ -2,86 +2,130 @@ package hypatia
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
-	"io"
 	"log"
 	"net/http"
 	"net/url"
-	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"time"
+)
+
+const (
+	defaultInstanceTTL = time.Hour
+	defaultAddressTTL  = 10 * time.Minute
+	defaultNegativeTTL = 30 * time.Second
 )
 
 type ServiceMap struct {
 	Tasks map[string]*url.URL
 }
 type ServiceDiscovery struct {
-	ServiceName                         string
-	ClusterName                         string
-	ECSClient                           *ecs.Client
-	EC2Client                           *ec2.Client
-	once                                sync.Once
-	containerInstanceArnToEC2InstanceId Cache
-	ec2InstancesToAddress               Cache
+	ServiceName string
+	ClusterName string
+	// Scheme is used for every task url. Defaults to http.
+	Scheme    string
+	ECSClient *ecs.Client
+	EC2Client *ec2.Client
+	// InstanceTTL is how long a container instance's ec2 instance id is trusted, AddressTTL how long an ec2 instance's
+	// address is, and NegativeTTL how long an id that failed lookup is skipped. Zero uses defaults.
+	InstanceTTL time.Duration
+	AddressTTL  time.Duration
+	NegativeTTL time.Duration
+	// CacheDir keeps lookups on disk, so restarts and other sidecars on the host that share the directory start warm.
+	// Empty caches in memory only.
+	CacheDir                            string
+	m                                   sync.Mutex
+	ready                               bool
+	containerInstanceArnToEC2InstanceId Cache[string, string]
+	ec2InstancesToAddress               Cache[string, string]
+	// addressOwners is the last ec2 instance seen with each address
+	addressOwners map[string]string
+}
+
+// NewServiceDiscovery builds a ServiceDiscovery with ECS and EC2 clients from the default aws config. An empty
+// service or cluster name is resolved lazily from the task metadata endpoint on first use.
+func NewServiceDiscovery(serviceName, clusterName string) (*ServiceDiscovery, error) {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &ServiceDiscovery{
+		ServiceName: serviceName,
+		ClusterName: clusterName,
+		ECSClient:   ecs.NewFromConfig(cfg),
+		EC2Client:   ec2.NewFromConfig(cfg),
+	}, nil
 }
 
-func (sd *ServiceDiscovery) initSD() {
-	sd.once.Do(func() {
-		sd.containerInstanceArnToEC2InstanceId = NewCache(512)
-		sd.ec2InstancesToAddress = NewCache(512)
+// initSD fills in anything that wasn't configured up front. Failures are returned rather than cached, so the next
+// call tries again.
+func (sd *ServiceDiscovery) initSD() error {
+	sd.m.Lock()
+	defer sd.m.Unlock()
+	if sd.ready {
+		return nil
+	}
+	if sd.InstanceTTL == 0 {
+		sd.InstanceTTL = defaultInstanceTTL
+	}
+	if sd.AddressTTL == 0 {
+		sd.AddressTTL = defaultAddressTTL
+	}
+	if sd.NegativeTTL == 0 {
+		sd.NegativeTTL = defaultNegativeTTL
+	}
+	if sd.containerInstanceArnToEC2InstanceId == nil {
+		sd.containerInstanceArnToEC2InstanceId = sd.newCache("container-instances", sd.InstanceTTL)
+	}
+	if sd.ec2InstancesToAddress == nil {
+		sd.ec2InstancesToAddress = sd.newCache("ec2-addresses", sd.AddressTTL)
+	}
+	if sd.ECSClient == nil || sd.EC2Client == nil {
+		cfg, err := config.LoadDefaultConfig(context.Background())
+		if err != nil {
+			return fmt.Errorf("unable to load aws config: %w", err)
+		}
 		if sd.ECSClient == nil {
-			cfg, err := config.LoadDefaultConfig(context.Background())
-			if err != nil {
-				panic(err)
-			}
 			sd.ECSClient = ecs.NewFromConfig(cfg)
 		}
 		if sd.EC2Client == nil {
-			cfg, err := config.LoadDefaultConfig(context.Background())
-			if err != nil {
-				panic(err)
-			}
 			sd.EC2Client = ec2.NewFromConfig(cfg)
 		}
+	}
+	if sd.ServiceName == "" || sd.ClusterName == "" {
+		var m metadata
+		if err := getTaskMetadata(http.DefaultClient, &m); err != nil {
+			return fmt.Errorf("no service or cluster provided: %w", err)
+		}
 		if sd.ServiceName == "" {
-			root, ok := os.LookupEnv("ECS_CONTAINER_METADATA_URI_V4")
-			if !ok {
-				panic("no ECS_CONTAINER_METADATA_URI_V4 found, and no service arn provided")
-			}
-			metadataEndpoint, err := url.Parse(root + "/task")
-			if err != nil {
-				panic(err)
-			}
-			resp, err := http.Get(metadataEndpoint.String())
-			if err != nil {
-				panic("unable to get response from metadata endpoint: " + err.Error())
-			}
-			data, err := io.ReadAll(resp.Body)
-			if err != nil {
-				panic(err)
-			}
-			var m metadata
-			if err := json.Unmarshal(data, &m); err != nil {
-				panic("bad json: " + err.Error())
-			}
 			if m.ServiceName == nil {
-				panic("no service name found in response: " + string(data))
+				return errors.New("no service name found in task metadata")
 			}
+			sd.ServiceName = *m.ServiceName
+		}
+		if sd.ClusterName == "" {
 			if m.Cluster == nil {
-				panic("no cluster name found in response: " + string(data))
+				return errors.New("no cluster name found in task metadata")
 			}
-			sd.ServiceName = *m.ServiceName
 			sd.ClusterName = *m.Cluster
 		}
-	})
+	}
+	sd.ready = true
+	return nil
 }
 
 func (sd *ServiceDiscovery) GetServiceMap() (*ServiceMap, error) {
-	sd.initSD()
+	if err := sd.initSD(); err != nil {
+		return nil, err
+	}
 	res, err := sd.ECSClient.ListTasks(context.Background(), &ecs.ListTasksInput{
 		ServiceName: &sd.ServiceName,
 		Cluster:     &sd.ClusterName,
@@ -105,17 +149,9 @@ func (sd *ServiceDiscovery) GetServiceMap() (*ServiceMap, error) {
 		return nil, err
 	}
 
-	/*containerInstanceArnToEC2InstanceId := make(map[string]string)
-	for _, task := range taskDetails.Tasks {
-		containerInstanceArnToEC2InstanceId[*task.ContainerInstanceArn] = ""
-		if s, ok := sd.containerInstanceArnToEC2InstanceId.Get(*task.ContainerInstanceArn); ok {
-			containerInstanceArnToEC2InstanceId[*task.ContainerInstanceArn] = s
-		}
-	}*/
-
 	var unknownInstanceMap = map[string]string{}
 	for _, task := range taskDetails.Tasks {
-		if task.ContainerInstanceArn == nil {
+		if task.ContainerInstanceArn == nil || sd.containerInstanceArnToEC2InstanceId.Missing(*task.ContainerInstanceArn) {
 			continue
 		}
 		if _, ok := sd.containerInstanceArnToEC2InstanceId.Get(*task.ContainerInstanceArn); !ok {
@@ -135,48 +171,70 @@ func (sd *ServiceDiscovery) GetServiceMap() (*ServiceMap, error) {
 		if err != nil {
 			return nil, err
 		}
-		if len(ecsInstanceDetails.ContainerInstances) < 1 {
-			return nil, fmt.Errorf("no container instances returned")
-		}
-
 		for _, instance := range ecsInstanceDetails.ContainerInstances {
+			if instance.ContainerInstanceArn == nil || instance.Ec2InstanceId == nil {
+				continue
+			}
 			sd.containerInstanceArnToEC2InstanceId.Put(*instance.ContainerInstanceArn, *instance.Ec2InstanceId)
+			delete(unknownInstanceMap, *instance.ContainerInstanceArn)
+		}
+		for arn := range unknownInstanceMap {
+			log.Println("container instance not found: ", arn)
+			sd.containerInstanceArnToEC2InstanceId.PutMissing(arn, sd.NegativeTTL)
 		}
 	}
-	var unknownEc2 []string
+	var unknownEc2 = map[string]struct{}{}
 	for _, task := range taskDetails.Tasks {
+		if task.ContainerInstanceArn == nil {
+			continue
+		}
 		arn := *task.ContainerInstanceArn
 		ec2Id, ok := sd.containerInstanceArnToEC2InstanceId.Get(arn)
 		if !ok {
-			log.Println("error. skipping id:  ", ec2Id)
+			log.Println("error. skipping container instance: ", arn)
+			continue
+		}
+		if sd.ec2InstancesToAddress.Missing(ec2Id) {
 			continue
 		}
 		if _, ok := sd.ec2InstancesToAddress.Get(ec2Id); !ok {
-			unknownEc2 = append(unknownEc2, ec2Id)
+			unknownEc2[ec2Id] = struct{}{}
 		}
 	}
 	if len(unknownEc2) > 0 {
+		var ids []string
+		for id := range unknownEc2 {
+			ids = append(ids, id)
+		}
+		// a filter, unlike InstanceIds, doesn't fail the whole call when one instance is gone
 		ec2ClientDetails, err := sd.EC2Client.DescribeInstances(context.Background(), &ec2.DescribeInstancesInput{
-			InstanceIds: unknownEc2,
+			Filters: []types.Filter{{Name: aws.String("instance-id"), Values: ids}},
 		})
 		if err != nil {
 			return nil, err
 		}
-		if len(ec2ClientDetails.Reservations) < 1 {
-			return nil, fmt.Errorf("no ec2 reservations found")
-		}
 
 		for _, reservation := range ec2ClientDetails.Reservations {
 			for _, instance := range reservation.Instances {
-				sd.ec2InstancesToAddress.Put(*instance.InstanceId, *instance.PrivateIpAddress)
+				if instance.InstanceId == nil || instance.PrivateIpAddress == nil || instance.State != nil &&
+					(instance.State.Name == types.InstanceStateNameTerminated || instance.State.Name == types.InstanceStateNameShuttingDown) {
+					continue
+				}
+				sd.putAddress(*instance.InstanceId, *instance.PrivateIpAddress)
+				delete(unknownEc2, *instance.InstanceId)
 			}
 		}
+		for id := range unknownEc2 {
+			log.Println("no address for ec2 instance: ", id)
+			sd.ec2InstancesToAddress.PutMissing(id, sd.NegativeTTL)
+		}
 	}
 
 	services := &ServiceMap{}
 	services.Tasks = make(map[string]*url.URL, len(taskDetails.Tasks))
 	for _, task := range taskDetails.Tasks {
-		if task.LastStatus == nil || len(task.Containers) < 1 || len(task.Containers[0].NetworkBindings) < 1 {
+		if task.LastStatus == nil || task.ContainerInstanceArn == nil || len(task.Containers) < 1 ||
+			len(task.Containers[0].NetworkBindings) < 1 {
 			continue
 		}
 		nb := task.Containers[0].NetworkBindings[0]
@@ -193,13 +251,57 @@ func (sd *ServiceDiscovery) GetServiceMap() (*ServiceMap, error) {
 			port = strconv.Itoa(int(*nb.HostPort))
 		}
 
-		u, _ := url.Parse("http://" + ip + ":" + port)
+		scheme := sd.Scheme
+		if scheme == "" {
+			scheme = "http"
+		}
+		u, _ := url.Parse(scheme + "://" + ip + ":" + port)
 		services.Tasks[*task.TaskArn] = u
 	}
 
 	return services, nil
 }
 
+// newCache keeps lookups in CacheDir, if there is one and it can be opened.
+func (sd *ServiceDiscovery) newCache(name string, ttl time.Duration) Cache[string, string] {
+	opts := CacheOptions{Size: 512, TTL: ttl}
+	if sd.CacheDir != "" {
+		c, err := OpenDiskCache[string, string](filepath.Join(sd.CacheDir, name+".cache"), opts)
+		if err == nil {
+			return c
+		}
+		log.Println("caching in memory: ", err)
+	}
+	return NewCacheWith[string, string](opts)
+}
+
+// putAddress caches an ec2 instance's address. An address that used to belong to another instance has been reused,
+// so whatever is cached for the old instance is wrong.
+func (sd *ServiceDiscovery) putAddress(id, address string) {
+	sd.m.Lock()
+	defer sd.m.Unlock()
+	if sd.addressOwners == nil {
+		sd.addressOwners = map[string]string{}
+	}
+	if owner, ok := sd.addressOwners[address]; ok && owner != id {
+		log.Printf("address %s moved from %s to %s\n", address, owner, id)
+		sd.ec2InstancesToAddress.Invalidate(owner)
+	}
+	sd.addressOwners[address] = id
+	sd.ec2InstancesToAddress.Put(id, address)
+}
+
+// CacheStats reports on the container instance and ec2 address caches.
+func (sd *ServiceDiscovery) CacheStats() map[string]CacheStats {
+	if err := sd.initSD(); err != nil {
+		return nil
+	}
+	return map[string]CacheStats{
+		"containerInstances": sd.containerInstanceArnToEC2InstanceId.Stats(),
+		"ec2Addresses":       sd.ec2InstancesToAddress.Stats(),
+	}
+}
+
 type metadata struct {
 	ServiceName *string
 	Cluster     *string
@@ -1,7 +1,17 @@
 package hypatia
 
 import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestServiceDiscovery(t *testing.T) {
@@ -14,3 +24,200 @@ func TestServiceDiscovery(t *testing.T) {
 	t.Log(things)
 	t.Log(err)
 }
+
+// fakeAWS answers the ecs and ec2 calls service discovery makes, from maps the test can change between calls.
+type fakeAWS struct {
+	m sync.Mutex
+	// containerInstances maps container instance arns to ec2 ids, instances ec2 ids to addresses. An address of
+	// "terminated" is a terminated instance.
+	containerInstances map[string]string
+	instances          map[string]string
+	calls              map[string]int
+	// fargate runs task-2 without a container instance
+	fargate bool
+}
+
+func (f *fakeAWS) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if target := req.Header.Get("X-Amz-Target"); target != "" {
+		action := target[strings.LastIndex(target, ".")+1:]
+		f.calls[action]++
+		res.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch action {
+		case "ListTasks":
+			fmt.Fprint(res, `{"taskArns": ["task-1", "task-2"]}`)
+		case "DescribeTasks":
+			var tasks []any
+			for i := 1; i <= 2; i++ {
+				task := map[string]any{
+					"taskArn":              fmt.Sprint("task-", i),
+					"containerInstanceArn": fmt.Sprint("ci-", i),
+					"lastStatus":           "RUNNING",
+					"containers":           []any{map[string]any{"networkBindings": []any{map[string]any{"hostPort": 8000}}}},
+				}
+				if f.fargate && i == 2 {
+					delete(task, "containerInstanceArn")
+				}
+				tasks = append(tasks, task)
+			}
+			json.NewEncoder(res).Encode(map[string]any{"tasks": tasks})
+		case "DescribeContainerInstances":
+			var input struct{ ContainerInstances []string }
+			json.NewDecoder(req.Body).Decode(&input)
+			var found []any
+			for _, arn := range input.ContainerInstances {
+				if id, ok := f.containerInstances[arn]; ok {
+					found = append(found, map[string]any{"containerInstanceArn": arn, "ec2InstanceId": id})
+				}
+			}
+			json.NewEncoder(res).Encode(map[string]any{"containerInstances": found})
+		}
+		return
+	}
+	req.ParseForm()
+	f.calls[req.Form.Get("Action")]++
+	var items strings.Builder
+	for i := 1; req.Form.Has(fmt.Sprint("Filter.1.Value.", i)); i++ {
+		id := req.Form.Get(fmt.Sprint("Filter.1.Value.", i))
+		address, ok := f.instances[id]
+		if !ok {
+			continue
+		}
+		state := "running"
+		if address == "terminated" {
+			state, address = "terminated", ""
+		}
+		fmt.Fprintf(&items, "<item><instanceId>%s</instanceId><privateIpAddress>%s</privateIpAddress><instanceState><name>%s</name></instanceState></item>", id, address, state)
+	}
+	res.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(res, `<DescribeInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/"><reservationSet><item><instancesSet>%s</instancesSet></item></reservationSet></DescribeInstancesResponse>`, items.String())
+}
+
+func (f *fakeAWS) set(change func()) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	change()
+}
+
+func TestServiceDiscoveryCaching(t *testing.T) {
+	fake := &fakeAWS{
+		containerInstances: map[string]string{"ci-1": "i-1"},
+		instances:          map[string]string{"i-1": "10.0.0.1"},
+		calls:              map[string]int{},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	sd := &ServiceDiscovery{
+		ServiceName: "hypatia",
+		ClusterName: "default",
+		ECSClient:   ecs.New(ecs.Options{Region: "us-west-2", BaseEndpoint: aws.String(server.URL), Credentials: aws.AnonymousCredentials{}}),
+		EC2Client:   ec2.New(ec2.Options{Region: "us-west-2", BaseEndpoint: aws.String(server.URL), Credentials: aws.AnonymousCredentials{}}),
+		NegativeTTL: 50 * time.Millisecond,
+	}
+	hosts := func() [2]string {
+		t.Helper()
+		m, err := sd.GetServiceMap()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return [2]string{m.Tasks["task-1"].Hostname(), m.Tasks["task-2"].Hostname()}
+	}
+	calls := func(ecsCalls, ec2Calls int) {
+		t.Helper()
+		fake.m.Lock()
+		defer fake.m.Unlock()
+		if fake.calls["DescribeContainerInstances"] != ecsCalls || fake.calls["DescribeInstances"] != ec2Calls {
+			t.Errorf("expected %d ecs and %d ec2 lookups, got %v", ecsCalls, ec2Calls, fake.calls)
+		}
+	}
+
+	if h := hosts(); h != [2]string{"10.0.0.1", "<nil>"} {
+		t.Errorf("expected only the first task to resolve, got %v", h)
+	}
+	calls(1, 1)
+	hosts()
+	calls(1, 1)
+	if stats := sd.CacheStats()["containerInstances"]; stats.NegativeHits != 1 {
+		t.Errorf("expected the missing container instance to be skipped: %+v", stats)
+	}
+
+	// the second instance shows up with the first one's address, so the first must be gone
+	fake.set(func() {
+		fake.containerInstances["ci-2"] = "i-2"
+		fake.instances["i-2"] = "10.0.0.1"
+		fake.instances["i-1"] = "terminated"
+	})
+	time.Sleep(100 * time.Millisecond)
+	if h := hosts(); h != [2]string{"<resolvedEC2>", "10.0.0.1"} {
+		t.Errorf("expected the reused address to move, got %v", h)
+	}
+	calls(2, 2)
+	if h := hosts(); h != [2]string{"<resolvedEC2>", "10.0.0.1"} {
+		t.Errorf("expected the terminated instance to stay unresolved, got %v", h)
+	}
+	calls(2, 3)
+	hosts()
+	calls(2, 3)
+	if stats := sd.CacheStats()["ec2Addresses"]; stats.Invalidations != 1 || stats.NegativeHits != 1 {
+		t.Errorf("unexpected address stats: %+v", stats)
+	}
+}
+
+func TestServiceDiscoveryFargate(t *testing.T) {
+	fake := &fakeAWS{
+		containerInstances: map[string]string{"ci-1": "i-1"},
+		instances:          map[string]string{"i-1": "10.0.0.1"},
+		calls:              map[string]int{},
+		fargate:            true,
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	sd := &ServiceDiscovery{
+		ServiceName: "hypatia",
+		ClusterName: "default",
+		ECSClient:   ecs.New(ecs.Options{Region: "us-west-2", BaseEndpoint: aws.String(server.URL), Credentials: aws.AnonymousCredentials{}}),
+		EC2Client:   ec2.New(ec2.Options{Region: "us-west-2", BaseEndpoint: aws.String(server.URL), Credentials: aws.AnonymousCredentials{}}),
+	}
+	m, err := sd.GetServiceMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Tasks) != 1 || m.Tasks["task-1"].Hostname() != "10.0.0.1" {
+		t.Errorf("expected only the task on a container instance, got %v", m.Tasks)
+	}
+}
+
+func TestServiceDiscoveryCacheDir(t *testing.T) {
+	fake := &fakeAWS{
+		containerInstances: map[string]string{"ci-1": "i-1", "ci-2": "i-2"},
+		instances:          map[string]string{"i-1": "10.0.0.1", "i-2": "10.0.0.2"},
+		calls:              map[string]int{},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	dir := t.TempDir()
+	newSD := func() *ServiceDiscovery {
+		return &ServiceDiscovery{
+			ServiceName: "hypatia",
+			ClusterName: "default",
+			ECSClient:   ecs.New(ecs.Options{Region: "us-west-2", BaseEndpoint: aws.String(server.URL), Credentials: aws.AnonymousCredentials{}}),
+			EC2Client:   ec2.New(ec2.Options{Region: "us-west-2", BaseEndpoint: aws.String(server.URL), Credentials: aws.AnonymousCredentials{}}),
+			CacheDir:    dir,
+		}
+	}
+	if _, err := newSD().GetServiceMap(); err != nil {
+		t.Fatal(err)
+	}
+	// a sidecar starting up next to the first one
+	m, err := newSD().GetServiceMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Tasks["task-2"].Hostname() != "10.0.0.2" {
+		t.Errorf("expected addresses from the shared cache, got %v", m.Tasks)
+	}
+	if fake.calls["DescribeContainerInstances"] != 1 || fake.calls["DescribeInstances"] != 1 {
+		t.Errorf("expected the second sidecar to start warm, got %v", fake.calls)
+	}
+}
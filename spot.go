@@ -0,0 +1,91 @@
+package hypatia
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const defaultSpotInterval = 5 * time.Second
+
+// SpotReaction is what the server does about a spot notice. The notice is published as an event either way.
+type SpotReaction struct {
+	// RemoteUnhealthy fails the remote healthcheck, so load balancers drain the task.
+	RemoteUnhealthy bool `json:"remoteUnhealthy"`
+	// DropProtection turns task protection off, so ecs is free to replace the task.
+	DropProtection bool `json:"dropProtection"`
+}
+
+// SpotWatch polls IMDS for spot interruption and rebalance notices, and reacts to each new one once.
+type SpotWatch struct {
+	// Interval is how often IMDS is polled. Defaults to 5 seconds; an interruption comes two minutes ahead.
+	Interval     time.Duration
+	Interruption SpotReaction
+	Rebalance    SpotReaction
+}
+
+// WatchSpot reacts to spot notices until ctx is done. Off ec2 there are never any notices, so it does nothing.
+func (hs *Server) WatchSpot(ctx context.Context) {
+	if hs.Spot == nil {
+		return
+	}
+	hs.initState()
+	if hs.Instance == nil {
+		hs.Instance = &InstanceContext{}
+	}
+	interval := hs.Spot.Interval
+	if interval <= 0 {
+		interval = defaultSpotInterval
+	}
+	seen := map[any]bool{}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		hs.checkSpot(seen)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkSpot reacts to notices that aren't in seen. A notice that's withdrawn and sent again with a new time is new.
+func (hs *Server) checkSpot(seen map[any]bool) {
+	action, rebalance, err := hs.Instance.SpotNotices()
+	if err != nil {
+		return
+	}
+	if action != nil && !seen[*action] {
+		seen[*action] = true
+		hs.reactToSpot("interruption", hs.Spot.Interruption, map[string]any{"action": action.Action, "time": action.Time})
+	}
+	if rebalance != nil && !seen[*rebalance] {
+		seen[*rebalance] = true
+		hs.reactToSpot("rebalance", hs.Spot.Rebalance, map[string]any{"noticeTime": rebalance.NoticeTime})
+	}
+}
+
+func (hs *Server) reactToSpot(notice string, reaction SpotReaction, data map[string]any) {
+	log.Println("spot notice: ", notice, data)
+	data["notice"] = notice
+	data["remoteUnhealthy"] = reaction.RemoteUnhealthy
+	data["dropProtection"] = reaction.DropProtection
+	var errs []string
+	if reaction.RemoteUnhealthy {
+		if err := hs.setHealth(HealthRemote, false, "spot "+notice); err != nil {
+			log.Println("unable to fail remote health: ", err)
+			errs = append(errs, err.Error())
+		}
+	}
+	if reaction.DropProtection && hs.Protection != nil {
+		if err := hs.putProtection(false, nil); err != nil {
+			log.Println("unable to drop task protection: ", err)
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		data["errors"] = errs
+	}
+	hs.Events.Publish(EventSpot, data)
+}
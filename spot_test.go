@@ -0,0 +1,109 @@
+package hypatia
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSpotWatch(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "false")
+	fake := NewFakeIMDS()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	srv := newV1TestServer(t)
+	srv.Instance = &InstanceContext{Endpoint: server.URL}
+	srv.Spot = &SpotWatch{Interruption: SpotReaction{RemoteUnhealthy: true, DropProtection: true}}
+	srv.initState()
+	if err := srv.setHealth(HealthRemote, true, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.putProtection(true, nil); err != nil {
+		t.Fatal(err)
+	}
+	spotEvents := func() []Event {
+		var found []Event
+		for _, e := range srv.Events.Since(0) {
+			if e.Type == EventSpot {
+				found = append(found, e)
+			}
+		}
+		return found
+	}
+	seen := map[any]bool{}
+
+	srv.checkSpot(seen)
+	if len(spotEvents()) != 0 {
+		t.Fatalf("expected no notices yet, got %v", spotEvents())
+	}
+
+	fake.Rebalance(time.Now())
+	srv.checkSpot(seen)
+	if events := spotEvents(); len(events) != 1 || events[0].Data["notice"] != "rebalance" {
+		t.Fatalf("expected a rebalance event, got %v", events)
+	}
+	if srv.RemoteHealth.GetHealth() != nil {
+		t.Error("expected a rebalance to only publish an event by default")
+	}
+
+	fake.Interrupt("stop", time.Now().Add(2*time.Minute))
+	srv.checkSpot(seen)
+	srv.checkSpot(seen)
+	if events := spotEvents(); len(events) != 2 || events[1].Data["action"] != "stop" {
+		t.Fatalf("expected one interruption event, got %v", events)
+	}
+	if srv.RemoteHealth.GetHealth() == nil {
+		t.Error("expected remote health to fail on interruption")
+	}
+	if p, _ := srv.Protection.Get(); p.ProtectionEnabled == nil || *p.ProtectionEnabled {
+		t.Errorf("expected protection to be dropped, got %+v", p)
+	}
+	if instance, _ := srv.Instance.Get(); instance.SpotAction == nil || instance.Rebalance == nil {
+		t.Errorf("expected the instance to show the notices, got %+v", instance)
+	}
+}
+
+func TestSpotWatchOffEC2(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	srv := newV1TestServer(t)
+	srv.Spot = &SpotWatch{Interval: time.Millisecond, Interruption: SpotReaction{RemoteUnhealthy: true}}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	srv.WatchSpot(ctx)
+	if events := srv.Events.Since(0); len(events) != 0 {
+		t.Errorf("expected nothing to happen off ec2, got %v", events)
+	}
+}
+
+func TestFakeIMDSControl(t *testing.T) {
+	fake := NewFakeIMDS()
+	for _, tc := range []struct {
+		method, path, notice string
+		code                 int
+	}{
+		{http.MethodPost, "/fake/spot/interrupt?action=hibernate&in=30s", spotActionPath, http.StatusNoContent},
+		{http.MethodPost, "/fake/spot/interrupt?in=soon", "", http.StatusBadRequest},
+		{http.MethodPost, "/fake/spot/rebalance", rebalancePath, http.StatusNoContent},
+	} {
+		rec := httptest.NewRecorder()
+		fake.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+		if rec.Code != tc.code {
+			t.Errorf("%s %s: expected %d, got %d", tc.method, tc.path, tc.code, rec.Code)
+		}
+		if _, ok := fake.metadata[tc.notice]; tc.notice != "" && !ok {
+			t.Errorf("%s %s: expected %s to be set", tc.method, tc.path, tc.notice)
+		}
+	}
+	if fake.metadata["instance-life-cycle"] != "spot" {
+		t.Error("expected a notice to make the instance spot")
+	}
+	rec := httptest.NewRecorder()
+	fake.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/fake/spot", nil))
+	_, action := fake.metadata[spotActionPath]
+	_, rebalance := fake.metadata[rebalancePath]
+	if rec.Code != http.StatusNoContent || action || rebalance {
+		t.Errorf("expected the notices to be withdrawn, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,285 @@
+package hypatia
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const stateVersion = 1
+
+var ErrNoState = errors.New("no saved state")
+
+// StateStore keeps the server's mutable state across restarts.
+type StateStore interface {
+	// Load returns ErrNoState if nothing has been saved yet.
+	Load() (*State, error)
+	Save(*State) error
+}
+
+// State is everything about the server that a restart would otherwise lose.
+type State struct {
+	Version       int       `json:"version"`
+	SavedAt       time.Time `json:"savedAt"`
+	LocalHealthy  bool      `json:"localHealthy"`
+	RemoteHealthy bool      `json:"remoteHealthy"`
+	// Health is every other named healthcheck.
+	Health     map[string]bool  `json:"health,omitempty"`
+	Protection *StateProtection `json:"protection,omitempty"`
+	Stress     *StressStatus    `json:"stress,omitempty"`
+}
+
+func (s *State) setHealthy(name string, healthy bool) {
+	switch name {
+	case HealthLocal:
+		s.LocalHealthy = healthy
+	case HealthRemote:
+		s.RemoteHealthy = healthy
+	default:
+		if s.Health == nil {
+			s.Health = make(map[string]bool)
+		}
+		s.Health[name] = healthy
+	}
+}
+
+type StateProtection struct {
+	Enabled bool `json:"enabled"`
+	// ExpiresAt is empty when the agent didn't say, or protection is off.
+	ExpiresAt string `json:"expiresAt,omitempty"`
+}
+
+// FileStateStore saves state as json. Writes are atomic, so a crash mid-save leaves the previous state intact.
+type FileStateStore struct {
+	Path string
+}
+
+func (f *FileStateStore) Load() (*State, error) {
+	data, err := os.ReadFile(f.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoState
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s State
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Path, err)
+	}
+	if s.Version != stateVersion {
+		return nil, fmt.Errorf("%s: unsupported state version %d", f.Path, s.Version)
+	}
+	return &s, nil
+}
+
+func (f *FileStateStore) Save(s *State) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.Path, append(data, '\n'), 0644)
+}
+
+// MemoryStateStore keeps state for the life of the process, for tests and for running without a state file.
+type MemoryStateStore struct {
+	m    sync.Mutex
+	data []byte
+}
+
+func (s *MemoryStateStore) Load() (*State, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.data == nil {
+		return nil, ErrNoState
+	}
+	var out State
+	return &out, json.Unmarshal(s.data, &out)
+}
+
+func (s *MemoryStateStore) Save(state *State) error {
+	// stored encoded so callers can't change what was saved
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.data = data
+	return nil
+}
+
+// writeFileAtomic replaces path with data by writing a temporary file next to it, syncing it and renaming it into
+// place. The directory is synced too, so the rename itself survives a crash.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// initState sets up only what changing state needs, so state can be restored before the rest of the server is
+// configured.
+func (hs *Server) initState() {
+	hs.stateOnce.Do(func() {
+		if hs.Events == nil {
+			hs.Events = NewEventBus(0)
+		}
+		hs.stress.events = hs.Events
+		hs.stress.changed = func(status StressStatus) {
+			hs.updateState(func(s *State) {
+				s.Stress = nil
+				if status.Running {
+					s.Stress = &status
+				}
+			})
+		}
+	})
+}
+
+// updateState changes the server's state and saves it.
+func (hs *Server) updateState(change func(*State)) {
+	hs.stateM.Lock()
+	defer hs.stateM.Unlock()
+	change(&hs.state)
+	if hs.State == nil {
+		return
+	}
+	hs.state.Version = stateVersion
+	hs.state.SavedAt = time.Now().UTC()
+	if err := hs.State.Save(&hs.state); err != nil {
+		log.Println("unable to save state: ", err)
+	}
+}
+
+// ResetState saves the server as it is now over any previously saved state.
+func (hs *Server) ResetState() {
+	hs.initState()
+	hs.updateState(func(s *State) {
+		*s = State{}
+		for name, hc := range hs.healthChecks() {
+			s.setHealthy(name, hc.GetHealth() == nil)
+		}
+	})
+}
+
+// RestoreState applies the saved state, if there is any. Protection is only turned back on until its saved expiry, and
+// stress resumes for whatever time it had left. Health files that are still there are left as they are.
+func (hs *Server) RestoreState() error {
+	if hs.State == nil {
+		return nil
+	}
+	saved, err := hs.State.Load()
+	if errors.Is(err, ErrNoState) {
+		log.Println("no saved state, starting fresh")
+		hs.ResetState()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	hs.initState()
+	log.Println("restoring state saved at ", saved.SavedAt)
+	var errs []error
+	health := map[string]bool{HealthLocal: saved.LocalHealthy, HealthRemote: saved.RemoteHealthy}
+	for name, healthy := range saved.Health {
+		// a healthcheck that's no longer configured is dropped
+		if _, ok := hs.healthCheck(name); ok {
+			health[name] = healthy
+		}
+	}
+	for name := range health {
+		hc, _ := hs.healthCheck(name)
+		if fc, ok := hc.(*FileHealthcheck); ok && !restoreFile(fc) {
+			// the file outlived the restart, and knows better than the saved state
+			status := fc.current()
+			hs.updateState(func(s *State) {
+				hs.sawHealth(name, status)
+				s.setHealthy(name, status.Status == StatusHealthy)
+			})
+			delete(health, name)
+		}
+	}
+	errs = append(errs, hs.setHealths(health)...)
+	if p := saved.Protection; p != nil && p.Enabled {
+		// without a readable expiry there's no telling how long is left, and the agent's default every restart would
+		// keep a crash looping task protected forever
+		left := 0
+		if expiry, err := time.Parse(time.RFC3339, p.ExpiresAt); err == nil {
+			left = int(math.Ceil(time.Until(expiry).Minutes()))
+		}
+		if left <= 0 {
+			log.Println("saved protection has expired, or has no expiry")
+			hs.updateState(func(s *State) { s.Protection = nil })
+		} else if err := hs.putProtection(true, &left); err != nil {
+			errs = append(errs, fmt.Errorf("protection: %w", err))
+		}
+	}
+	if st := saved.Stress; st != nil && st.Running && st.Until != nil {
+		if until, err := time.Parse(time.RFC3339, *st.Until); err == nil && time.Until(until) > 0 {
+			hs.stress.start(StressRequest{CPU: st.CPU, MemoryMB: st.MemoryMB, Duration: Duration(time.Until(until))})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// restoreFile reports whether a health file should be set from the saved state. Only a new container starts without
+// its files, and a heartbeat is never restored: only whatever writes it can say it's fresh.
+func restoreFile(fc *FileHealthcheck) bool {
+	if fc.MaxAge > 0 {
+		return false
+	}
+	_, err := os.Stat(fc.filename())
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+// putProtection changes task protection and records the change.
+func (hs *Server) putProtection(enabled bool, minutes *int) error {
+	protection, err := hs.Protection.Put(enabled, minutes)
+	if err != nil {
+		return err
+	}
+	hs.Events.Publish(EventProtection, map[string]any{"enabled": enabled, "expiresInMinutes": minutes})
+	hs.updateState(func(s *State) {
+		s.Protection = nil
+		if enabled {
+			s.Protection = &StateProtection{Enabled: true}
+			if protection != nil && protection.ExpirationDate != nil {
+				s.Protection.ExpiresAt = *protection.ExpirationDate
+			}
+		}
+	})
+	return nil
+}
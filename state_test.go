@@ -0,0 +1,115 @@
+package hypatia
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStateStore(t *testing.T) {
+	dir := t.TempDir()
+	store := &FileStateStore{Path: filepath.Join(dir, "state.json")}
+	if _, err := store.Load(); !errors.Is(err, ErrNoState) {
+		t.Errorf("expected no state, got %v", err)
+	}
+	until := "2030-01-01T00:00:00Z"
+	want := &State{Version: stateVersion, LocalHealthy: true, Protection: &StateProtection{Enabled: true, ExpiresAt: until}}
+	for i := 0; i < 2; i++ {
+		if err := store.Save(want); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.LocalHealthy || got.RemoteHealthy || got.Protection == nil || got.Protection.ExpiresAt != until {
+		t.Errorf("expected saved state back, got %+v", got)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expected temporary files to be cleaned up, got %d files", len(entries))
+	}
+
+	os.WriteFile(store.Path, []byte(`{"version": 99}`), 0644)
+	if _, err := store.Load(); err == nil {
+		t.Error("expected an unknown version to fail")
+	}
+}
+
+func TestMemoryStateStore(t *testing.T) {
+	store := &MemoryStateStore{}
+	if _, err := store.Load(); !errors.Is(err, ErrNoState) {
+		t.Errorf("expected no state, got %v", err)
+	}
+	saved := &State{RemoteHealthy: true}
+	store.Save(saved)
+	saved.RemoteHealthy = false
+	if got, err := store.Load(); err != nil || !got.RemoteHealthy {
+		t.Errorf("expected the state as it was saved, got %+v %v", got, err)
+	}
+}
+
+func TestRestoreState(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	store := &MemoryStateStore{}
+	before := newV1TestServer(t)
+	before.State = store
+	if err := before.RestoreState(); err != nil {
+		t.Fatal(err)
+	}
+	if rec := v1Do(before, http.MethodPatch, "/v1/state", `{"localHealthy": true, "taskProtectionEnabled": true, "expiresInMinutes": 10}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	before.stress.start(StressRequest{Duration: Duration(time.Minute)})
+	defer before.stress.stop()
+
+	// a new container, with none of the old one's files
+	after := newV1TestServer(t)
+	after.State = store
+	if err := after.RestoreState(); err != nil {
+		t.Fatal(err)
+	}
+	defer after.stress.stop()
+	if after.LocalHealth.GetHealth() != nil || after.RemoteHealth.GetHealth() == nil {
+		t.Error("expected health to be restored")
+	}
+	p, _ := after.Protection.Get()
+	if p.ProtectionEnabled == nil || !*p.ProtectionEnabled || p.ExpirationDate == nil {
+		t.Errorf("expected protection to be restored: %+v", p)
+	}
+	if status := after.stress.get(); !status.Running {
+		t.Error("expected stress to resume")
+	}
+
+	saved, _ := store.Load()
+	saved.Protection.ExpiresAt = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	store.Save(saved)
+	expired := newV1TestServer(t)
+	expired.State = store
+	expired.RestoreState()
+	defer expired.stress.stop()
+	if p, _ := expired.Protection.Get(); p.ProtectionEnabled != nil && *p.ProtectionEnabled {
+		t.Error("expected expired protection to stay off")
+	}
+
+	// with no telling when it ends, protection isn't renewed for the agent's default on every restart
+	saved.Protection.ExpiresAt = ""
+	store.Save(saved)
+	unknown := newV1TestServer(t)
+	unknown.State = store
+	unknown.RestoreState()
+	defer unknown.stress.stop()
+	if p, _ := unknown.Protection.Get(); p.ProtectionEnabled != nil && *p.ProtectionEnabled {
+		t.Error("expected protection without an expiry to stay off")
+	}
+
+	fresh := newV1TestServer(t)
+	fresh.State = store
+	fresh.ResetState()
+	if saved, _ := store.Load(); saved.LocalHealthy || saved.Protection != nil || saved.Stress != nil {
+		t.Errorf("expected a fresh start to overwrite saved state: %+v", saved)
+	}
+}
@@ -0,0 +1,232 @@
+package hypatia
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxStressMemoryMB bounds how much memory stress will try to hold.
+	MaxStressMemoryMB = 4 << 10
+
+	defaultStressDuration = time.Minute
+	minCrashDelay         = 100 * time.Millisecond
+)
+
+// MaxStressCPU bounds how many goroutines stress will spin, a few for each cpu.
+var MaxStressCPU = 4 * runtime.NumCPU()
+
+type StressRequest struct {
+	// CPU is how many goroutines to spin.
+	CPU int `json:"cpu,omitempty"`
+	// MemoryMB is how much memory to allocate and hold.
+	MemoryMB int `json:"memoryMb,omitempty"`
+	// Duration defaults to a minute.
+	Duration Duration `json:"duration,omitempty"`
+}
+
+func (r *StressRequest) Validate() error {
+	if r.CPU < 0 || r.MemoryMB < 0 {
+		return errors.New("cpu and memoryMb must not be negative")
+	}
+	if r.CPU > MaxStressCPU {
+		return fmt.Errorf("cpu must be at most %d", MaxStressCPU)
+	}
+	if r.MemoryMB > MaxStressMemoryMB {
+		return fmt.Errorf("memoryMb must be at most %d", MaxStressMemoryMB)
+	}
+	return nil
+}
+
+type StressStatus struct {
+	Running  bool    `json:"running"`
+	CPU      int     `json:"cpu,omitempty"`
+	MemoryMB int     `json:"memoryMb,omitempty"`
+	Until    *string `json:"until,omitempty"`
+}
+
+type CrashRequest struct {
+	ExitCode int `json:"exitCode"`
+	// Delay is how long to wait before exiting, so the response can make it back.
+	Delay Duration `json:"delay,omitempty"`
+}
+
+// stressor burns cpu and holds memory until its duration is up or it's stopped.
+type stressor struct {
+	m      sync.Mutex
+	cancel context.CancelFunc
+	status StressStatus
+	// run tells a finished run apart from the one that replaced it
+	run    int
+	events *EventBus
+	// changed is told about every new status, so it can be saved
+	changed func(StressStatus)
+}
+
+func (s *stressor) start(r StressRequest) StressStatus {
+	s.stop()
+	duration := time.Duration(r.Duration)
+	if duration <= 0 {
+		duration = defaultStressDuration
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	until := time.Now().Add(duration).UTC().Format(time.RFC3339)
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.run++
+	run := s.run
+	s.cancel = cancel
+	s.status = StressStatus{Running: true, CPU: r.CPU, MemoryMB: r.MemoryMB, Until: &until}
+	log.Printf("stress starting: %d cpu, %d MB, until %s\n", r.CPU, r.MemoryMB, until)
+	s.events.Publish(EventStress, map[string]any{"running": true, "cpu": r.CPU, "memoryMb": r.MemoryMB, "until": until})
+	s.notify()
+	for i := 0; i < r.CPU; i++ {
+		go func() {
+			for ctx.Err() == nil {
+			}
+		}()
+	}
+	go func() {
+		// a megabyte at a time, so stopping doesn't wait on one huge allocation
+		held := make([][]byte, 0, r.MemoryMB)
+		for i := 0; i < r.MemoryMB && ctx.Err() == nil; i++ {
+			chunk := make([]byte, 1<<20)
+			// touch every page so the memory is actually resident
+			for j := 0; j < len(chunk); j += 4096 {
+				chunk[j] = 1
+			}
+			held = append(held, chunk)
+		}
+		<-ctx.Done()
+		runtime.KeepAlive(held)
+		s.m.Lock()
+		defer s.m.Unlock()
+		if s.run == run {
+			s.status = StressStatus{}
+			s.notify()
+		}
+		log.Println("stress stopped")
+		reason := "stopped"
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			reason = "finished"
+		}
+		s.events.Publish(EventStress, map[string]any{"running": false, "reason": reason})
+	}()
+	return s.status
+}
+
+func (s *stressor) stop() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+	s.status = StressStatus{}
+	s.notify()
+}
+
+// notify must be called with s.m held.
+func (s *stressor) notify() {
+	if s.changed != nil {
+		s.changed(s.status)
+	}
+}
+
+func (s *stressor) get() StressStatus {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.status
+}
+
+// ServeStress reports on stress with GET, starts it with POST and stops it with DELETE.
+func (hs *Server) ServeStress(res http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var input StressRequest
+		if err := decodeBody(req, &input); err != nil {
+			handleError(res, http.StatusBadRequest, err)
+			return
+		}
+		if err := input.Validate(); err != nil {
+			handleError(res, http.StatusBadRequest, err)
+			return
+		}
+		hs.stress.start(input)
+	case http.MethodDelete:
+		hs.stress.stop()
+	default:
+		handleError(res, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	writeJSON(res, hs.stress.get())
+}
+
+// ServeCrash exits the process with the requested code once the response is sent.
+func (hs *Server) ServeCrash(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		handleError(res, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	var input CrashRequest
+	if err := decodeBody(req, &input); err != nil {
+		handleError(res, http.StatusBadRequest, err)
+		return
+	}
+	delay := time.Duration(input.Delay)
+	if delay < minCrashDelay {
+		delay = minCrashDelay
+	}
+	exit := hs.Exit
+	if exit == nil {
+		exit = os.Exit
+	}
+	log.Printf("crashing with exit code %d in %s\n", input.ExitCode, delay)
+	res.WriteHeader(http.StatusAccepted)
+	writeJSON(res, &input)
+	time.AfterFunc(delay, func() {
+		exit(input.ExitCode)
+	})
+}
+
+// decodeBody reads an optional json body into v. An empty body leaves v alone.
+func decodeBody(req *http.Request, v any) error {
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+func writeJSON(res http.ResponseWriter, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println("unable to json things: ", err)
+		handleISE(res)
+		return
+	}
+	writeResponse(res, data)
+}
+
+func isStress(req *http.Request) bool {
+	return strings.EqualFold(req.URL.Path, "/stress")
+}
+
+func isCrash(req *http.Request) bool {
+	return strings.EqualFold(req.URL.Path, "/crash")
+}
@@ -0,0 +1,68 @@
+package hypatia
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStress(t *testing.T) {
+	srv := &Server{Writeable: true}
+	do := func(method, body string) StressStatus {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(method, "/stress", strings.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", method, rec.Code, rec.Body.String())
+		}
+		var status StressStatus
+		json.Unmarshal(rec.Body.Bytes(), &status)
+		return status
+	}
+	if status := do(http.MethodPost, `{"cpu":1,"memoryMb":1,"duration":"50ms"}`); !status.Running || status.CPU != 1 {
+		t.Errorf("expected stress to start: %+v", status)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if status := do(http.MethodGet, ""); status.Running {
+		t.Errorf("expected stress to finish: %+v", status)
+	}
+	do(http.MethodPost, `{"cpu":1,"duration":"1m"}`)
+	if status := do(http.MethodDelete, ""); status.Running {
+		t.Errorf("expected stress to stop: %+v", status)
+	}
+
+	for _, body := range []string{`{"memoryMb":-1}`, `{"memoryMb":4097}`, `{"cpu":1000000}`} {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/stress", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, rec.Code)
+		}
+	}
+}
+
+func TestCrash(t *testing.T) {
+	exited := make(chan int, 1)
+	srv := &Server{Writeable: true, Exit: func(code int) { exited <- code }}
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/crash", strings.NewReader(`{"exitCode":3}`)))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", rec.Code)
+	}
+	select {
+	case code := <-exited:
+		if code != 3 {
+			t.Errorf("expected exit code 3, got %d", code)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected server to exit")
+	}
+
+	srv.Writeable = false
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/crash", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected read only server to refuse, got %d", rec.Code)
+	}
+}
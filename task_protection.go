@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -13,33 +14,46 @@ import (
 	"time"
 )
 
+var (
+	// ErrAgentUnreachable means the ecs agent couldn't be reached, as outside of ecs or while it restarts.
+	ErrAgentUnreachable = errors.New("ecs agent unreachable")
+	// ErrProtectionFailed means the agent answered, but couldn't get or change task protection.
+	ErrProtectionFailed = errors.New("task protection failed")
+)
+
 type TaskProtectionClient struct {
 	Location  *url.URL
 	Client    *http.Client
-	_once     sync.Once
-	_memo     sync.Once
+	m         sync.Mutex
 	_metadata *TaskMetadata
 }
 
+// NewTaskProtectionClient resolves the agent endpoint from ECS_AGENT_URI. The returned client is always usable; a
+// non-nil error means the endpoint couldn't be resolved yet and will be retried on each call.
+func NewTaskProtectionClient() (*TaskProtectionClient, error) {
+	tpc := &TaskProtectionClient{}
+	return tpc, tpc.init()
+}
+
 func (tpc *TaskProtectionClient) init() error {
-	var err error
-	tpc._once.Do(func() {
-		if tpc.Client == nil {
-			tpc.Client = http.DefaultClient
-		}
-		if tpc.Location == nil {
-			root, ok := os.LookupEnv("ECS_AGENT_URI")
-			if !ok {
-				err = errors.New("no ECS_AGENT_URI found")
-				return
-			}
-			tpc.Location, err = url.Parse(root + "/task-protection/v1/state")
-			if err != nil {
-				return
-			}
-		}
-	})
-	return err
+	tpc.m.Lock()
+	defer tpc.m.Unlock()
+	if tpc.Client == nil {
+		tpc.Client = http.DefaultClient
+	}
+	if tpc.Location != nil {
+		return nil
+	}
+	root, ok := os.LookupEnv("ECS_AGENT_URI")
+	if !ok {
+		return errors.New("no ECS_AGENT_URI found")
+	}
+	location, err := url.Parse(root + "/task-protection/v1/state")
+	if err != nil {
+		return err
+	}
+	tpc.Location = location
+	return nil
 }
 
 func (tpc *TaskProtectionClient) Get() (*Protection, error) {
@@ -60,43 +74,50 @@ func (tpc *TaskProtectionClient) Put(protect bool, min *int) (*Protection, error
 }
 
 func (tpc *TaskProtectionClient) Self() (*TaskMetadata, error) {
-	var metadata TaskMetadata
-	if tpc._metadata != nil {
-		metadata = *tpc._metadata
-		return &metadata, nil
-	}
 	if err := tpc.init(); err != nil {
 		return nil, err
 	}
+	tpc.m.Lock()
+	defer tpc.m.Unlock()
+	if tpc._metadata == nil {
+		var metadata TaskMetadata
+		if err := getTaskMetadata(tpc.Client, &metadata); err != nil {
+			return nil, err
+		}
+		tpc._metadata = &metadata
+	}
+	metadata := *tpc._metadata
+	return &metadata, nil
+}
+
+// getTaskMetadata decodes the task metadata endpoint into out.
+func getTaskMetadata(client *http.Client, out any) error {
 	location, ok := os.LookupEnv("ECS_CONTAINER_METADATA_URI_V4")
 	if !ok {
-		return nil, errors.New("no ECS_CONTAINER_METADATA_URI_V4 set")
+		return errors.New("no ECS_CONTAINER_METADATA_URI_V4 set")
 	}
 	u, err := url.Parse(location + "/task")
 	if err != nil {
-		return nil, err
+		return err
 	}
-	r, err := http.Get(u.String())
+	r, err := client.Get(u.String())
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer r.Body.Close()
 	data, err := io.ReadAll(r.Body)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if err := json.Unmarshal(data, &metadata); err != nil {
-		return nil, err
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("metadata endpoint returned %d: %s", r.StatusCode, string(data))
 	}
-	tpc._memo.Do(func() {
-		tpc._metadata = &metadata
-	})
-	return &metadata, nil
+	return json.Unmarshal(data, out)
 }
 
 func (tpc *TaskProtectionClient) doRequest(method string, body io.Reader) (*Protection, error) {
 	if err := tpc.init(); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", ErrAgentUnreachable, err)
 	}
 	req, err := http.NewRequest(method, tpc.Location.String(), body)
 	if err != nil {
@@ -107,23 +128,28 @@ func (tpc *TaskProtectionClient) doRequest(method string, body io.Reader) (*Prot
 	}
 	res, err := tpc.Client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", ErrAgentUnreachable, err)
 	}
 	defer res.Body.Close()
 	raw, err := io.ReadAll(res.Body)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", ErrAgentUnreachable, err)
 	}
 	log.Println("res body: ", string(raw))
 	var tpr TaskProtectionResponse
-	err = json.Unmarshal(raw, &tpr)
-	if err != nil {
-		return nil, err
+	if err := json.Unmarshal(raw, &tpr); err != nil {
+		return nil, fmt.Errorf("%w: unable to decipher response: %s", ErrProtectionFailed, string(raw))
 	}
 	if tpr.Protection != nil && tpr.Protection.TaskArn != nil && *tpr.Protection.TaskArn != "" {
 		return tpr.Protection, nil
 	}
-	return nil, errors.New("unable to decipher response: " + string(raw))
+	if f := tpr.Failure; f != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrProtectionFailed, deref(f.Reason), deref(f.Detail))
+	}
+	if e := tpr.Error; e != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrProtectionFailed, deref(e.Code), deref(e.Message))
+	}
+	return nil, fmt.Errorf("%w: unable to decipher response: %s", ErrProtectionFailed, string(raw))
 }
 
 type TaskProtectionResponse struct {
@@ -176,7 +202,7 @@ func (t *TaskProtectionStub) Self() (*TaskMetadata, error) {
 func (t *TaskProtectionStub) Put(enabled bool, minutes *int) (*Protection, error) {
 	t.ProtectionEnabled = &enabled
 	if minutes != nil && *minutes > 0 {
-		next := time.Now().Add(time.Minute * time.Duration(*minutes)).String()
+		next := time.Now().Add(time.Minute * time.Duration(*minutes)).UTC().Format(time.RFC3339)
 		t.ExpirationDate = &next
 	}
 	return t.Protection, nil
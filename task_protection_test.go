@@ -2,6 +2,11 @@ package hypatia
 
 import (
 	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 )
 
@@ -15,3 +20,26 @@ func TestMarshal(t *testing.T) {
 	}
 	t.Log(res)
 }
+
+func TestTaskProtectionErrors(t *testing.T) {
+	agent := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPut {
+			res.WriteHeader(http.StatusBadRequest)
+			res.Write([]byte(`{"failure":{"Arn":"arn","Reason":"TASK_NOT_VALID","Detail":"not in a service"}}`))
+			return
+		}
+		res.Write([]byte(exampleGoodResponse))
+	}))
+	location, _ := url.Parse(agent.URL)
+	tpc := &TaskProtectionClient{Location: location}
+	if _, err := tpc.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tpc.Put(true, nil); !errors.Is(err, ErrProtectionFailed) || !strings.Contains(err.Error(), "TASK_NOT_VALID") {
+		t.Errorf("expected a protection failure, got %v", err)
+	}
+	agent.Close()
+	if _, err := tpc.Get(); !errors.Is(err, ErrAgentUnreachable) {
+		t.Errorf("expected the agent to be unreachable, got %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package hypatia
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader serves a certificate/key pair from disk and swaps it out when the files change, so certificates can be
+// rotated without restarting the task.
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+	m        sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{CertFile: certFile, KeyFile: keyFile}
+	return c, c.Reload()
+}
+
+// Reload reads the pair from disk. On failure the previous certificate stays in use.
+func (c *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return err
+	}
+	modTime, _ := c.latestModTime()
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// Watch polls the files every interval and reloads when either is modified, until stop is closed.
+func (c *CertReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		modTime, err := c.latestModTime()
+		if err != nil {
+			log.Println("unable to stat certificate: ", err)
+			continue
+		}
+		c.m.RLock()
+		changed := modTime.After(c.modTime)
+		c.m.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := c.Reload(); err != nil {
+			log.Println("unable to reload certificate: ", err)
+		} else {
+			log.Println("reloaded certificate ", c.CertFile)
+		}
+	}
+}
+
+func (c *CertReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{c.CertFile, c.KeyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.cert, nil
+}
+
+func (c *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.cert, nil
+}
+
+// LoadCertPool reads a PEM bundle of CA certificates.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates found in " + path)
+	}
+	return pool, nil
+}
+
+// GenerateDevCert makes a self-signed certificate for local testing. It is its own CA and is valid for both server
+// and client auth, so the same files work for -tls-cert, -tls-client-ca and the proxy's CA bundle.
+func GenerateDevCert(hosts []string, validFor time.Duration) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"hypatia dev"}},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return certPEM, keyPEM, nil
+}
@@ -0,0 +1,97 @@
+package hypatia
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeDevCert(t *testing.T, dir string) *x509.CertPool {
+	certPEM, keyPEM, err := GenerateDevCert([]string{"localhost", "127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0644)
+	os.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0600)
+	pool, err := LoadCertPool(filepath.Join(dir, "cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+// startTLS serves with cfg as is; httptest's StartTLS installs its own certificate, which would shadow GetCertificate.
+func startTLS(handler http.Handler, cfg *tls.Config) *httptest.Server {
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener = tls.NewListener(server.Listener, cfg)
+	server.Start()
+	server.URL = "https" + server.URL[len("http"):]
+	return server
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	first := writeDevCert(t, dir)
+	reloader, err := NewCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := startTLS(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+		&tls.Config{GetCertificate: reloader.GetCertificate})
+	defer upstream.Close()
+
+	get := func(pool *x509.CertPool) error {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+		res, err := client.Get(upstream.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+	if err := get(first); err != nil {
+		t.Fatal("expected first certificate to verify: ", err)
+	}
+
+	second := writeDevCert(t, dir)
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(second); err != nil {
+		t.Error("expected reloaded certificate to verify: ", err)
+	}
+	if err := get(first); err == nil {
+		t.Error("expected old certificate to be replaced")
+	}
+}
+
+func TestProxyMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	pool := writeDevCert(t, dir)
+	reloader, err := NewCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := startTLS(http.HandlerFunc(func(res http.ResponseWriter, _ *http.Request) {
+		res.Write([]byte("secure"))
+	}), &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		ClientCAs:      pool,
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+	})
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	srv := newProxyTestServer(&staticDiscovery{tasks: map[string]*url.URL{testNeighborArn: u}})
+	srv.ProxyTLSConfig = &tls.Config{RootCAs: pool, GetClientCertificate: reloader.GetClientCertificate}
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/task/"+testNeighborArn, nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "secure" {
+		t.Errorf("expected https neighbor response, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,35 @@
+package hypatia
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+// ServeUI serves the dashboard at /ui/. It only reads the json apis, so it works the same when reached through
+// another task's proxy at /task/{arn}/ui/.
+func (hs *Server) ServeUI(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		handleError(res, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		return
+	}
+	if req.URL.Path == "/ui" {
+		// relative links in the page need the trailing slash. the location is relative too, so any proxy prefix in
+		// front of us survives. http.Redirect would make it absolute.
+		res.Header().Set("Location", "ui/")
+		res.WriteHeader(http.StatusMovedPermanently)
+		return
+	}
+	files, _ := fs.Sub(uiFiles, "ui")
+	res.Header().Set("Cache-Control", "no-cache")
+	http.StripPrefix("/ui", http.FileServer(http.FS(files))).ServeHTTP(res, req)
+}
+
+func isUI(req *http.Request) bool {
+	return req.URL.Path == "/ui" || strings.HasPrefix(req.URL.Path, "/ui/")
+}
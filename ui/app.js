@@ -0,0 +1,295 @@
+'use strict';
+
+// everything is relative to where the page was served from, so the dashboard also works through another task's
+// proxy at /task/{arn}/ui/
+const base = location.pathname.replace(/ui\/[^/]*$/, '');
+const eventTypes = ['health', 'protection', 'proxy', 'discovery', 'signal', 'stress', 'spot'];
+const maxEvents = 200;
+const refreshInterval = 5000;
+
+const $ = (id) => document.getElementById(id);
+const tokenInput = $('token');
+tokenInput.value = localStorage.getItem('hypatia-token') || '';
+tokenInput.addEventListener('change', () => localStorage.setItem('hypatia-token', tokenInput.value));
+
+let selfArn = '';
+
+async function api(path, body) {
+  const init = {headers: {}};
+  if (body !== undefined) {
+    init.method = 'POST';
+    init.body = JSON.stringify(body);
+    init.headers['Content-Type'] = 'application/json';
+    if (tokenInput.value) {
+      init.headers['Authorization'] = 'Bearer ' + tokenInput.value;
+    }
+  }
+  const res = await fetch(base + path, init);
+  const text = await res.text();
+  let data = {};
+  try {
+    data = text ? JSON.parse(text) : {};
+  } catch (e) {
+    throw new Error(`${res.status}: ${text}`);
+  }
+  if (!res.ok) {
+    throw new Error(`${res.status}: ${(data.errors || [res.statusText]).join('; ')}`);
+  }
+  return data;
+}
+
+// taskPath reaches a neighbor through this task's proxy, by task id
+function taskPath(arn) {
+  return 'task/' + encodeURIComponent(arn.split('/').pop()) + '/';
+}
+
+function toast(message, bad) {
+  const el = $('toast');
+  el.textContent = message;
+  el.className = bad ? 'bad' : '';
+  el.hidden = false;
+  clearTimeout(toast.timer);
+  toast.timer = setTimeout(() => el.hidden = true, 4000);
+}
+
+function health(el, value) {
+  el.textContent = value || '-';
+  el.className = el.className.replace(/\b(good|bad)\b/g, '').trim();
+  if (value) {
+    el.classList.add(value === 'Healthy' ? 'good' : 'bad');
+  }
+}
+
+function countdown(expiry) {
+  if (!expiry) {
+    return '';
+  }
+  const ms = Date.parse(expiry) - Date.now();
+  if (isNaN(ms)) {
+    return 'until ' + expiry;
+  }
+  if (ms <= 0) {
+    return 'expired';
+  }
+  const s = Math.floor(ms / 1000);
+  const h = Math.floor(s / 3600);
+  const m = Math.floor(s / 60) % 60;
+  const pad = (n) => String(n).padStart(2, '0');
+  return `expires in ${h > 0 ? h + 'h' : ''}${pad(m)}m${pad(s % 60)}s`;
+}
+
+function protection(enabled) {
+  if (enabled === undefined) {
+    return '-';
+  }
+  return enabled ? 'protected' : 'unprotected';
+}
+
+async function refreshSelf() {
+  let status;
+  try {
+    status = await api('');
+  } catch (e) {
+    $('errors').replaceChildren(item(e.message));
+    return;
+  }
+  selfArn = status.taskArn || '';
+  $('task').textContent = selfArn || '-';
+  health($('local-health'), status.localHealth);
+  health($('remote-health'), status.remoteHealth);
+  otherHealth(status.health || {});
+  $('protection').textContent = protection(status.taskProtectionEnabled);
+  const expiry = status.taskProtectionEnabled ? status.taskProtectionExpiry || '' : '';
+  $('protection-countdown').dataset.expiry = expiry;
+  $('protection-countdown').textContent = countdown(expiry);
+  $('instance').textContent = instance(status.instance) || status.ec2Instance || '-';
+  $('updated').textContent = new Date().toLocaleTimeString();
+  $('errors').replaceChildren(...(status.errors || []).map(item));
+}
+
+// otherHealth lists the named health checks beyond local and remote, each with a button to flip it
+function otherHealth(all) {
+  const names = Object.keys(all).filter((name) => name !== 'local' && name !== 'remote').sort();
+  $('other-health-card').hidden = names.length === 0;
+  $('other-health').replaceChildren(...names.flatMap((name) => {
+    const dt = document.createElement('dt');
+    dt.textContent = name;
+    const dd = document.createElement('dd');
+    const value = document.createElement('span');
+    health(value, all[name] ? 'Healthy' : 'Unhealthy');
+    dd.append(value, ' ', button('flip', () => act('', {health: {[name]: !all[name]}})));
+    return [dt, dd];
+  }));
+}
+
+function instance(i) {
+  if (!i) return '';
+  const details = [i.instanceType, i.availabilityZone, i.lifecycle].filter(Boolean).join(', ');
+  const spot = i.spotAction ? ` spot ${i.spotAction.action} at ${i.spotAction.time}` : '';
+  const rebalance = i.rebalance ? ` rebalance recommended at ${i.rebalance.noticeTime}` : '';
+  return `${i.instanceId} (${details})${spot}${rebalance}`;
+}
+
+function item(text) {
+  const li = document.createElement('li');
+  li.textContent = text;
+  return li;
+}
+
+function cell(text, className) {
+  const td = document.createElement('td');
+  td.textContent = text || '-';
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+function button(label, onClick) {
+  const b = document.createElement('button');
+  b.textContent = label;
+  b.addEventListener('click', onClick);
+  return b;
+}
+
+async function refreshNeighbors() {
+  let neighbors;
+  try {
+    neighbors = (await api('tasks?detail=true')).neighbors || [];
+  } catch (e) {
+    const row = document.createElement('tr');
+    const td = cell(e.message, 'bad');
+    td.colSpan = 8;
+    row.append(td);
+    $('neighbors').replaceChildren(row);
+    $('task-count').textContent = '';
+    return;
+  }
+  $('task-count').textContent = `(${neighbors.length} tasks)`;
+  $('neighbors').replaceChildren(...neighbors.map((n) => {
+    const row = document.createElement('tr');
+    if (n.taskArn === selfArn) {
+      row.className = 'self';
+    }
+    const local = cell();
+    const remote = cell();
+    health(local, n.localHealth);
+    health(remote, n.remoteHealth);
+    const expiry = n.taskProtectionEnabled ? n.taskProtectionExpiry || '' : '';
+    const prot = cell(protection(n.taskProtectionEnabled));
+    if (expiry) {
+      const cd = document.createElement('div');
+      cd.className = 'countdown';
+      cd.dataset.expiry = expiry;
+      cd.textContent = countdown(expiry);
+      prot.append(cd);
+    }
+    const actions = document.createElement('td');
+    actions.className = 'actions';
+    const path = taskPath(n.taskArn);
+    actions.append(
+      button('flip local', () => act(path, {setLocalHealth: n.localHealth !== 'Healthy'})),
+      button('flip remote', () => act(path, {setRemoteHealth: n.remoteHealth !== 'Healthy'})),
+      button(n.taskProtectionEnabled ? 'unprotect' : 'protect',
+        () => act(path, {taskProtectionEnabled: !n.taskProtectionEnabled})),
+    );
+    const task = cell(n.taskArn, 'mono');
+    if (n.errors && n.errors.length) {
+      task.title = n.errors.join('\n');
+      task.append(' ⚠');
+    }
+    row.append(task, cell(n.address, 'mono'), local, remote, prot, cell(n.ec2Instance, 'mono'),
+      cell(n.lastSeen ? new Date(n.lastSeen).toLocaleTimeString() : ''), actions);
+    return row;
+  }));
+}
+
+async function act(path, body) {
+  try {
+    const res = await api(path, body);
+    if (res.errors && res.errors.length) {
+      toast(res.errors.join('; '), true);
+    } else {
+      toast('done');
+    }
+  } catch (e) {
+    toast(e.message, true);
+  }
+  refresh();
+}
+
+async function broadcast(body) {
+  let tasks;
+  try {
+    tasks = (await api('tasks')).tasks || [];
+  } catch (e) {
+    toast(e.message, true);
+    return;
+  }
+  const results = await Promise.allSettled(tasks.map((t) => api(taskPath(t), body)));
+  const failed = results.filter((r) => r.status === 'rejected');
+  if (failed.length) {
+    toast(`${failed.length} of ${tasks.length} tasks failed: ${failed[0].reason.message}`, true);
+  } else {
+    toast(`updated ${tasks.length} tasks`);
+  }
+  refresh();
+}
+
+function refresh() {
+  refreshSelf().then(refreshNeighbors);
+}
+
+function parseValue(el) {
+  return el.dataset.value === 'true';
+}
+
+document.querySelectorAll('[data-self]').forEach((el) => el.addEventListener('click', () => {
+  act('', {[el.dataset.self]: parseValue(el)});
+}));
+
+document.querySelectorAll('[data-broadcast]').forEach((el) => el.addEventListener('click', () => {
+  const what = `${el.textContent} on every task`;
+  if (confirm(what + '?')) {
+    broadcast({[el.dataset.broadcast]: parseValue(el)});
+  }
+}));
+
+$('protect-on').addEventListener('click', () => {
+  const minutes = parseInt($('protect-minutes').value, 10);
+  const body = {taskProtectionEnabled: true};
+  if (minutes > 0) {
+    body.expiresInMinutes = minutes;
+  }
+  act('', body);
+});
+
+function listen() {
+  const source = new EventSource(base + 'events');
+  const state = $('events-state');
+  source.onopen = () => state.textContent = '(live)';
+  source.onerror = () => state.textContent = '(reconnecting)';
+  let pending;
+  eventTypes.forEach((type) => source.addEventListener(type, (msg) => {
+    const e = JSON.parse(msg.data);
+    const list = $('events');
+    list.prepend(item(`${new Date(e.time).toLocaleTimeString()} ${e.type} ${JSON.stringify(e.data || {})}`));
+    while (list.children.length > maxEvents) {
+      list.lastChild.remove();
+    }
+    if (type !== 'proxy') {
+      // coalesce bursts, like a broadcast, into one refresh
+      clearTimeout(pending);
+      pending = setTimeout(refresh, 250);
+    }
+  }));
+}
+
+setInterval(() => {
+  document.querySelectorAll('.countdown[data-expiry]').forEach((el) => {
+    el.textContent = countdown(el.dataset.expiry);
+  });
+}, 1000);
+setInterval(refresh, refreshInterval);
+refresh();
+listen();
@@ -0,0 +1,41 @@
+package hypatia
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeUI(t *testing.T) {
+	srv := newProxyTestServer(nil)
+	get := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	if rec := get(http.MethodGet, "/ui"); rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "ui/" {
+		t.Errorf("expected a relative redirect to ui/, got %d %v", rec.Code, rec.Header())
+	}
+	if rec := get(http.MethodGet, "/ui/"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `<script src="app.js">`) {
+		t.Errorf("expected the dashboard, got %d: %s", rec.Code, rec.Body.String())
+	}
+	for path, contentType := range map[string]string{
+		"/ui/app.js":                    "javascript",
+		"/ui/style.css":                 "text/css",
+		"/task/" + testSelfArn + "/ui/": "text/html",
+		"/task/self/ui/app.js":          "javascript",
+	} {
+		rec := get(http.MethodGet, path)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Header().Get("Content-Type"), contentType) {
+			t.Errorf("%s: expected %s, got %d %s", path, contentType, rec.Code, rec.Header().Get("Content-Type"))
+		}
+	}
+	if rec := get(http.MethodGet, "/ui/nope.js"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected missing files to 404, got %d", rec.Code)
+	}
+	if rec := get(http.MethodPost, "/ui/"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected the dashboard to be read only, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,437 @@
+package hypatia
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	v1Prefix = "/v1"
+	// maxProtectionMinutes is the longest expiry the ecs agent accepts.
+	maxProtectionMinutes = 2880
+	maxV1Body            = 1 << 20
+)
+
+// V1StateRequest changes this task. Every field is optional, but at least one must be set.
+type V1StateRequest struct {
+	LocalHealthy          *bool           `json:"localHealthy,omitempty" doc:"set the local healthcheck"`
+	RemoteHealthy         *bool           `json:"remoteHealthy,omitempty" doc:"set the remote healthcheck, which /ping reports by default"`
+	TaskProtectionEnabled *bool           `json:"taskProtectionEnabled,omitempty" doc:"turn ecs task protection on or off"`
+	ExpiresInMinutes      *int            `json:"expiresInMinutes,omitempty" doc:"minutes until protection expires. only allowed when enabling protection, defaults to the agent's expiry" minimum:"1" maximum:"2880"`
+	Health                map[string]bool `json:"health,omitempty" doc:"set healthchecks by name, including local and remote"`
+}
+
+// V1State is this task as the server sees it. Anything that couldn't be looked up is listed in Unavailable rather than
+// failing the whole request.
+type V1State struct {
+	TaskArn       string              `json:"taskArn,omitempty"`
+	EC2InstanceID string              `json:"ec2InstanceId,omitempty"`
+	Instance      *Instance           `json:"instance,omitempty" doc:"the ec2 instance, left out when there isn't one, as on fargate"`
+	LocalHealth   V1Health            `json:"localHealth"`
+	RemoteHealth  V1Health            `json:"remoteHealth"`
+	Health        map[string]V1Health `json:"health" doc:"every healthcheck by name, including local and remote"`
+	Protection    V1Protection        `json:"protection"`
+	Unavailable   []V1FieldError      `json:"unavailable,omitempty" doc:"fields that couldn't be looked up, and why"`
+}
+
+type V1Health struct {
+	Healthy bool   `json:"healthy"`
+	Reason  string `json:"reason,omitempty" doc:"why the check is failing"`
+}
+
+type V1Protection struct {
+	Enabled   bool   `json:"enabled"`
+	ExpiresAt string `json:"expiresAt,omitempty" doc:"when protection expires, as reported by the agent"`
+}
+
+type V1Tasks struct {
+	Tasks     []string   `json:"tasks" doc:"every task arn in the service, sorted"`
+	Neighbors []Neighbor `json:"neighbors,omitempty" doc:"each task's last polled state, with ?detail=true"`
+}
+
+type V1Ping struct {
+	Healthy bool   `json:"healthy"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// V1Error is the body of every failed /v1 request.
+type V1Error struct {
+	Errors []V1FieldError `json:"errors"`
+}
+
+type V1FieldError struct {
+	// Field is the json name of the field at fault, empty if the problem is with the request as a whole.
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e V1FieldError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Field + ": " + e.Message
+}
+
+type v1Param struct {
+	name, kind, doc string
+}
+
+type v1Route struct {
+	method  string
+	path    string
+	summary string
+	query   []v1Param
+	// request and response are zero values of the body types, for the openapi document
+	request  any
+	response any
+	handle   func(hs *Server, res http.ResponseWriter, req *http.Request)
+}
+
+// v1Routes drives both ServeV1 and the openapi document, so the two can't drift apart. It's a function since the
+// handlers, and the document, refer back to it.
+func v1Routes() []v1Route {
+	return []v1Route{
+		{
+			method:   http.MethodGet,
+			path:     "/v1/state",
+			summary:  "Get this task's health, protection and metadata",
+			response: V1State{},
+			handle:   (*Server).v1GetState,
+		},
+		{
+			method:   http.MethodPatch,
+			path:     "/v1/state",
+			summary:  "Change this task's health or protection, returning the new state",
+			request:  V1StateRequest{},
+			response: V1State{},
+			handle:   (*Server).v1PatchState,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v1/ping",
+			summary:  "Check the ping slots, remote unless configured otherwise. Fails with 503 unless all are healthy",
+			response: V1Ping{},
+			handle:   (*Server).v1Ping,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v1/tasks",
+			summary:  "List the tasks in this task's service",
+			query:    []v1Param{{name: "detail", kind: "boolean", doc: "include each task's last polled state"}},
+			response: V1Tasks{},
+			handle:   (*Server).v1Tasks,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v1/openapi.json",
+			summary:  "This document",
+			response: map[string]any{},
+			handle:   (*Server).ServeOpenAPI,
+		},
+	}
+}
+
+// ServeV1 routes the versioned api. Unlike /, it rejects requests it doesn't understand instead of ignoring them.
+func (hs *Server) ServeV1(res http.ResponseWriter, req *http.Request) {
+	var allowed []string
+	for _, route := range v1Routes() {
+		if route.path != req.URL.Path {
+			continue
+		}
+		if route.method != req.Method {
+			allowed = append(allowed, route.method)
+			continue
+		}
+		if isWrite(req) {
+			if status, err := hs.checkWrite(req); err != nil {
+				v1Error(res, status, V1FieldError{Message: err.Error()})
+				return
+			}
+		}
+		res.Header().Set("Content-Type", "application/json")
+		route.handle(hs, res, req)
+		return
+	}
+	if len(allowed) > 0 {
+		res.Header().Set("Allow", strings.Join(allowed, ", "))
+		v1Error(res, http.StatusMethodNotAllowed, V1FieldError{Message: fmt.Sprintf("method %s not allowed", req.Method)})
+		return
+	}
+	v1Error(res, http.StatusNotFound, V1FieldError{Message: fmt.Sprintf("no such endpoint %s", req.URL.Path)})
+}
+
+func (hs *Server) v1GetState(res http.ResponseWriter, _ *http.Request) {
+	writeJSON(res, hs.v1State())
+}
+
+func (hs *Server) v1PatchState(res http.ResponseWriter, req *http.Request) {
+	var input V1StateRequest
+	if status, errs := decodeStrict(req, &input); len(errs) > 0 {
+		v1Error(res, status, errs...)
+		return
+	}
+	errs := input.Validate()
+	for _, name := range sortedKeys(input.Health) {
+		if _, ok := hs.healthCheck(name); !ok {
+			errs = append(errs, V1FieldError{Field: "health." + name, Message: "no such healthcheck"})
+		}
+	}
+	if len(errs) > 0 {
+		v1Error(res, http.StatusBadRequest, errs...)
+		return
+	}
+	log.Printf("v1 request: %+v\n", input)
+
+	var failures []V1FieldError
+	if input.TaskProtectionEnabled != nil {
+		if err := hs.putProtection(*input.TaskProtectionEnabled, input.ExpiresInMinutes); err != nil {
+			failures = append(failures, V1FieldError{Field: "taskProtectionEnabled", Message: err.Error()})
+		}
+	}
+	if input.RemoteHealthy != nil {
+		if err := hs.setHealth(HealthRemote, *input.RemoteHealthy, ""); err != nil {
+			failures = append(failures, V1FieldError{Field: "remoteHealthy", Message: err.Error()})
+		}
+	}
+	if input.LocalHealthy != nil {
+		if err := hs.setHealth(HealthLocal, *input.LocalHealthy, ""); err != nil {
+			failures = append(failures, V1FieldError{Field: "localHealthy", Message: err.Error()})
+		}
+	}
+	for _, name := range sortedKeys(input.Health) {
+		if err := hs.setHealth(name, input.Health[name], ""); err != nil {
+			failures = append(failures, V1FieldError{Field: "health." + name, Message: err.Error()})
+		}
+	}
+	if len(failures) > 0 {
+		// anything listed before the failure was still applied
+		v1Error(res, http.StatusInternalServerError, failures...)
+		return
+	}
+	writeJSON(res, hs.v1State())
+}
+
+func (hs *Server) v1State() *V1State {
+	var state V1State
+	if protection, err := hs.Protection.Get(); err != nil {
+		state.Unavailable = append(state.Unavailable, V1FieldError{Field: "protection", Message: err.Error()})
+	} else {
+		state.TaskArn = deref(protection.TaskArn)
+		state.Protection.Enabled = protection.ProtectionEnabled != nil && *protection.ProtectionEnabled
+		state.Protection.ExpiresAt = deref(protection.ExpirationDate)
+	}
+	if self, err := hs.Metadata.Self(); err != nil {
+		state.Unavailable = append(state.Unavailable, V1FieldError{Field: "taskArn", Message: err.Error()})
+	} else if self.TaskARN != nil {
+		state.TaskArn = *self.TaskARN
+	}
+	if instance, err := hs.Instance.Get(); err == nil {
+		state.EC2InstanceID = instance.InstanceID
+		state.Instance = instance
+	}
+	state.LocalHealth = v1Health(hs.LocalHealth.GetHealth())
+	state.RemoteHealth = v1Health(hs.RemoteHealth.GetHealth())
+	state.Health = hs.healthStatus()
+	return &state
+}
+
+func (hs *Server) v1Ping(res http.ResponseWriter, _ *http.Request) {
+	health := v1Health(hs.pingHealth())
+	if !health.Healthy {
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(res, &V1Ping{Healthy: health.Healthy, Reason: health.Reason})
+}
+
+func (hs *Server) v1Tasks(res http.ResponseWriter, req *http.Request) {
+	detail := false
+	if raw := req.URL.Query().Get("detail"); raw != "" {
+		var err error
+		if detail, err = strconv.ParseBool(raw); err != nil {
+			v1Error(res, http.StatusBadRequest, V1FieldError{Field: "detail", Message: "must be true or false"})
+			return
+		}
+	}
+	if hs.ServiceDiscovery == nil {
+		v1Error(res, http.StatusServiceUnavailable, V1FieldError{Message: errNoServiceDiscovery.Error()})
+		return
+	}
+	services, err := hs.serviceMap()
+	if err != nil {
+		v1Error(res, http.StatusServiceUnavailable, V1FieldError{Message: err.Error()})
+		return
+	}
+	output := V1Tasks{Tasks: make([]string, 0, len(services.Tasks))}
+	for taskArn := range services.Tasks {
+		output.Tasks = append(output.Tasks, taskArn)
+	}
+	sort.Strings(output.Tasks)
+	if detail {
+		output.Neighbors = hs.neighborDetail(services)
+	}
+	writeJSON(res, &output)
+}
+
+// Validate returns every problem with the request, not just the first.
+func (r *V1StateRequest) Validate() []V1FieldError {
+	var errs []V1FieldError
+	if r.LocalHealthy == nil && r.RemoteHealthy == nil && len(r.Health) == 0 && r.TaskProtectionEnabled == nil && r.ExpiresInMinutes == nil {
+		errs = append(errs, V1FieldError{Message: "at least one of localHealthy, remoteHealthy, health or taskProtectionEnabled is required"})
+	}
+	if r.ExpiresInMinutes != nil {
+		switch {
+		case r.TaskProtectionEnabled == nil:
+			errs = append(errs, V1FieldError{Field: "expiresInMinutes", Message: "requires taskProtectionEnabled"})
+		case !*r.TaskProtectionEnabled:
+			errs = append(errs, V1FieldError{Field: "expiresInMinutes", Message: "only allowed when enabling protection"})
+		}
+		if *r.ExpiresInMinutes < 1 || *r.ExpiresInMinutes > maxProtectionMinutes {
+			errs = append(errs, V1FieldError{Field: "expiresInMinutes", Message: fmt.Sprintf("must be between 1 and %d", maxProtectionMinutes)})
+		}
+	}
+	return errs
+}
+
+// decodeStrict reads exactly one json object into v. Unknown fields, wrong types, trailing data and an empty body are
+// all errors, attributed to a field where possible.
+func decodeStrict(req *http.Request, v any) (int, []V1FieldError) {
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		if mediaType, _, err := mime.ParseMediaType(ct); err != nil || mediaType != "application/json" {
+			return http.StatusUnsupportedMediaType, []V1FieldError{{Message: "content type must be application/json"}}
+		}
+	}
+	data, err := io.ReadAll(io.LimitReader(req.Body, maxV1Body+1))
+	if err != nil {
+		return http.StatusBadRequest, []V1FieldError{{Message: err.Error()}}
+	}
+	if len(data) > maxV1Body {
+		return http.StatusRequestEntityTooLarge, []V1FieldError{{Message: "request body is too large"}}
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return http.StatusBadRequest, []V1FieldError{{Message: "request body is required"}}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return http.StatusBadRequest, []V1FieldError{jsonFieldError(err)}
+	}
+	if errs := exactFields(data, v); len(errs) > 0 {
+		return http.StatusBadRequest, errs
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return http.StatusBadRequest, []V1FieldError{{Message: "unexpected data after the json object"}}
+	}
+	return 0, nil
+}
+
+// exactFields rejects keys that only match one of v's fields ignoring case, which encoding/json otherwise allows.
+func exactFields(data []byte, v any) []V1FieldError {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var raw map[string]json.RawMessage
+	if t.Kind() != reflect.Struct || json.Unmarshal(data, &raw) != nil {
+		return nil
+	}
+	known := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, ok := jsonField(t.Field(i)); ok {
+			known[name] = true
+		}
+	}
+	var errs []V1FieldError
+	for key := range raw {
+		if !known[key] {
+			errs = append(errs, V1FieldError{Field: key, Message: "unknown field"})
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+	return errs
+}
+
+func jsonFieldError(err error) V1FieldError {
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return V1FieldError{Message: fmt.Sprintf("expected a json %s", jsonKind(typeErr.Type.Kind().String()))}
+		}
+		return V1FieldError{Field: typeErr.Field, Message: fmt.Sprintf("must be a %s, got %s", jsonKind(typeErr.Type.Kind().String()), typeErr.Value)}
+	case errors.As(err, &syntaxErr):
+		return V1FieldError{Message: fmt.Sprintf("invalid json at offset %d: %s", syntaxErr.Offset, syntaxErr)}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		return V1FieldError{Field: field, Message: "unknown field"}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return V1FieldError{Message: "truncated json"}
+	}
+	return V1FieldError{Message: err.Error()}
+}
+
+// jsonKind names a go kind the way a json client would think of it.
+func jsonKind(kind string) string {
+	switch {
+	case kind == "bool":
+		return "boolean"
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"):
+		return "integer"
+	case strings.HasPrefix(kind, "float"):
+		return "number"
+	case kind == "struct", kind == "map":
+		return "object"
+	case kind == "slice":
+		return "array"
+	}
+	return kind
+}
+
+func v1Health(err error) V1Health {
+	if err != nil {
+		return V1Health{Reason: err.Error()}
+	}
+	return V1Health{Healthy: true}
+}
+
+func v1Error(res http.ResponseWriter, status int, errs ...V1FieldError) {
+	data, err := json.Marshal(&V1Error{Errors: errs})
+	if err != nil {
+		log.Println("unable to json things: ", err)
+		handleISE(res)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	writeResponse(res, data)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func isV1(req *http.Request) bool {
+	return req.URL.Path == v1Prefix || strings.HasPrefix(req.URL.Path, v1Prefix+"/")
+}
@@ -0,0 +1,152 @@
+package hypatia
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newV1TestServer(t *testing.T) *Server {
+	dir := t.TempDir()
+	srv := newProxyTestServer(nil)
+	srv.Writeable = true
+	srv.LocalHealth = FileHealthcheck{Filepath: filepath.Join(dir, "local")}
+	srv.RemoteHealth = FileHealthcheck{Filepath: filepath.Join(dir, "remote")}
+	return srv
+}
+
+func v1Do(srv *Server, method, path, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	var req *http.Request
+	if body == "" {
+		req = httptest.NewRequest(method, path, nil)
+	} else {
+		req = httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+	}
+	srv.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestV1State(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	srv := newV1TestServer(t)
+
+	rec := v1Do(srv, http.MethodPatch, "/v1/state", `{"remoteHealthy": true, "taskProtectionEnabled": true, "expiresInMinutes": 10}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var state V1State
+	if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil {
+		t.Fatal(err)
+	}
+	if !state.RemoteHealth.Healthy || state.LocalHealth.Healthy || state.LocalHealth.Reason == "" {
+		t.Errorf("expected only remote health to pass: %+v", state)
+	}
+	if !state.Protection.Enabled || state.Protection.ExpiresAt == "" || state.TaskArn != testSelfArn {
+		t.Errorf("expected protection and the task arn: %+v", state)
+	}
+	if len(state.Unavailable) != 0 || state.Instance != nil {
+		t.Errorf("expected no instance, and no complaint about it, without imds: %+v", state)
+	}
+
+	if rec := v1Do(srv, http.MethodGet, "/v1/ping", ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"healthy":true`) {
+		t.Errorf("expected ping to pass, got %d: %s", rec.Code, rec.Body.String())
+	}
+	v1Do(srv, http.MethodPatch, "/v1/state", `{"remoteHealthy": false}`)
+	if rec := v1Do(srv, http.MethodGet, "/v1/ping", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected ping to fail, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestV1Validation(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	srv := newV1TestServer(t)
+	cases := []struct {
+		name, body string
+		status     int
+		field      string
+	}{
+		{"empty", "", http.StatusBadRequest, ""},
+		{"nothing to do", `{}`, http.StatusBadRequest, ""},
+		{"minutes alone", `{"expiresInMinutes": 5}`, http.StatusBadRequest, "expiresInMinutes"},
+		{"minutes when disabling", `{"taskProtectionEnabled": false, "expiresInMinutes": 5}`, http.StatusBadRequest, "expiresInMinutes"},
+		{"minutes too long", `{"taskProtectionEnabled": true, "expiresInMinutes": 3000}`, http.StatusBadRequest, "expiresInMinutes"},
+		{"unknown field", `{"localHealthy": true, "remotehealthy": true}`, http.StatusBadRequest, "remotehealthy"},
+		{"legacy field", `{"setLocalHealth": true}`, http.StatusBadRequest, "setLocalHealth"},
+		{"wrong type", `{"localHealthy": "yes"}`, http.StatusBadRequest, "localHealthy"},
+		{"not an object", `[true]`, http.StatusBadRequest, ""},
+		{"trailing data", `{"localHealthy": true} {}`, http.StatusBadRequest, ""},
+		{"syntax", `{"localHealthy": tru}`, http.StatusBadRequest, ""},
+	}
+	for _, c := range cases {
+		rec := v1Do(srv, http.MethodPatch, "/v1/state", c.body)
+		if rec.Code != c.status {
+			t.Errorf("%s: expected %d, got %d: %s", c.name, c.status, rec.Code, rec.Body.String())
+			continue
+		}
+		var body V1Error
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || len(body.Errors) == 0 {
+			t.Errorf("%s: expected errors, got %s", c.name, rec.Body.String())
+			continue
+		}
+		if body.Errors[0].Field != c.field || body.Errors[0].Message == "" {
+			t.Errorf("%s: expected an error on %q, got %+v", c.name, c.field, body.Errors)
+		}
+	}
+	if srv.LocalHealth.GetHealth() == nil {
+		t.Error("expected rejected requests to change nothing")
+	}
+
+	req := httptest.NewRequest(http.MethodPatch, "/v1/state", strings.NewReader(`{"localHealthy": true}`))
+	req.Header.Set("Content-Type", "text/plain")
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415, got %d", rec.Code)
+	}
+}
+
+func TestV1Routing(t *testing.T) {
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	srv := newV1TestServer(t)
+	if rec := v1Do(srv, http.MethodPost, "/v1/state", `{"localHealthy": true}`); rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET, PATCH" {
+		t.Errorf("expected 405 with allowed methods, got %d %v", rec.Code, rec.Header())
+	}
+	if rec := v1Do(srv, http.MethodGet, "/v1/nope", ""); rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), `"message"`) {
+		t.Errorf("expected a v1 style 404, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := v1Do(srv, http.MethodGet, "/v1/tasks", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected tasks to be unavailable without discovery, got %d", rec.Code)
+	}
+
+	srv.Writeable = false
+	rec := v1Do(srv, http.MethodPatch, "/v1/state", `{"localHealthy": true}`)
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), `{"message":"server is read only"}`) {
+		t.Errorf("expected a v1 style 403, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// the legacy contract is untouched, including ignoring what it doesn't understand
+	srv.Writeable = true
+	if rec := v1Do(srv, http.MethodPost, "/", `{"expiresInMinutes": 5, "whatever": 1}`); rec.Code != http.StatusOK {
+		t.Errorf("expected the legacy api to accept anything, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestV1Tasks(t *testing.T) {
+	u, _ := url.Parse("http://10.0.0.1:8000")
+	srv := newProxyTestServer(&staticDiscovery{tasks: map[string]*url.URL{testNeighborArn: u, testSelfArn: u}})
+	rec := v1Do(srv, http.MethodGet, "/v1/tasks", "")
+	var tasks V1Tasks
+	json.Unmarshal(rec.Body.Bytes(), &tasks)
+	if rec.Code != http.StatusOK || len(tasks.Tasks) != 2 || tasks.Tasks[0] != testNeighborArn || tasks.Neighbors != nil {
+		t.Errorf("expected sorted tasks, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := v1Do(srv, http.MethodGet, "/v1/tasks?detail=maybe", ""); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"field":"detail"`) {
+		t.Errorf("expected a bad detail to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+}